@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// Scopes of API keys, see scopePermissions. Sessions are not limited by
+// scopes.
+const (
+	ScopePhotosRead   = "photos:read"
+	ScopePhotosWrite  = "photos:write"
+	ScopePhotosDelete = "photos:delete"
+	ScopeAdmin        = "admin" // everything the key owner's role allows
+)
+
+var Scopes = []string{ScopePhotosRead, ScopePhotosWrite, ScopePhotosDelete, ScopeAdmin}
+
+const apiKeyKey contextKey = "apiKey"
+
+var errAPIKeyExpired = errors.New("API key expired")
+
+const (
+	apiKeyPrefix        = "pbk_"
+	apiKeyPrefixLength  = len(apiKeyPrefix) + 8 // shown in listings
+	apiKeyTouchInterval = time.Minute
+	maxAPIKeyNameLength = 100
+)
+
+// APIKeyFromContext returns the key a request was authenticated with, or
+// nil for requests with a session.
+func APIKeyFromContext(ctx context.Context) *model.APIKey {
+	key, _ := ctx.Value(apiKeyKey).(*model.APIKey)
+	return key
+}
+
+// authenticateAPIKey looks up the key of an Authorization header and
+// records its use. An expired key is returned with errAPIKeyExpired.
+func authenticateAPIKey(ctx context.Context, apiKeys storage.APIKeyDB, token string) (*model.APIKey, error) {
+	key, err := apiKeys.GetAPIKeyByTokenHash(ctx, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return key, errAPIKeyExpired
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		ip := ClientIPFromContext(ctx)
+		if err := apiKeys.TouchAPIKey(ctx, key.ID, now, ip); err == nil {
+			key.LastUsedAt, key.LastUsedIP = &now, ip
+		}
+	}
+	return key, nil
+}
+
+type APIKeyHandlers struct {
+	APIKeys storage.APIKeyDB
+	Log     *zap.Logger
+}
+
+func NewAPIKeyHandlers(apiKeys storage.APIKeyDB, logger *zap.Logger) *APIKeyHandlers {
+	return &APIKeyHandlers{
+		APIKeys: apiKeys,
+		Log:     logger,
+	}
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type APIKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Expired    bool       `json:"expired"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIP string     `json:"lastUsedIp,omitempty"`
+	Key        string     `json:"key,omitempty"` // only returned on creation
+}
+
+type APIKeyListResponse struct {
+	APIKeys    []APIKeyResponse `json:"apiKeys"`
+	Pagination Pagination       `json:"pagination"`
+}
+
+func newAPIKeyResponse(key *model.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         key.ID.Hex(),
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		Expired:    key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt),
+		LastUsedAt: key.LastUsedAt,
+		LastUsedIP: key.LastUsedIP,
+	}
+}
+
+// CREATE
+func (h *APIKeyHandlers) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len([]rune(name)) > maxAPIKeyNameLength {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid name, must be between 1 and 100 characters")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "At least one scope is required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown scope "+scope+", must be one of "+strings.Join(Scopes, ", "))
+			return
+		}
+	}
+	for _, scope := range req.Scopes {
+		if !roleAllowsScope(RoleFromContext(ctx), scope) {
+			writeError(w, http.StatusForbidden, CodeForbidden, "Your role does not allow the "+scope+" scope")
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "expiresAt must be in the future")
+		return
+	}
+
+	token, err := newToken(apiKeyPrefix)
+	if err != nil {
+		h.Log.Error("failed to generate API key", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create API key")
+		return
+	}
+	slices.Sort(req.Scopes)
+	saved, err := h.APIKeys.SaveAPIKey(ctx, model.APIKey{
+		OwnerID:   UserIDFromContext(ctx),
+		Name:      name,
+		Prefix:    token[:apiKeyPrefixLength],
+		TokenHash: hashToken(token),
+		Scopes:    slices.Compact(req.Scopes),
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create API key")
+		return
+	}
+
+	response := newAPIKeyResponse(saved)
+	response.Key = token
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// LIST
+func (h *APIKeyHandlers) HandleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	keys, err := h.APIKeys.GetAPIKeys(ctx, UserIDFromContext(ctx))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch API keys")
+		return
+	}
+
+	response := APIKeyListResponse{
+		APIKeys:    make([]APIKeyResponse, len(keys)),
+		Pagination: Pagination{Total: int64(len(keys))},
+	}
+	for i := range keys {
+		response.APIKeys[i] = newAPIKeyResponse(&keys[i])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// REVOKE
+func (h *APIKeyHandlers) HandleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	if err := h.APIKeys.DeleteAPIKey(ctx, id, UserIDFromContext(ctx)); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "API key not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to delete API key")
+		return
+	}
+
+	h.Log.Info("API key deleted", zap.String("api_key_id", id))
+	writeMessage(w, http.StatusOK, "API key deleted successfully")
+}
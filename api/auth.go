@@ -1,30 +1,72 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
+	"photo-backup/storage"
+	"strings"
 	"time"
 
 	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 )
 
+type contextKey string
+
+const userIDKey contextKey = "userId"
+
+const sessionName = "session-name"
+
+// UserIDFromContext returns the ID of the user authenticated by AuthMiddleware.
+func UserIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey).(string)
+	return userID
+}
+
 type LoginRequest struct {
 	Password string `json:"password"`
+	Code     string `json:"code,omitempty"` // TOTP or recovery code, if two-factor authentication is enabled
 }
 
-var Store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
+var Store = NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
 
-func init() {
-	Store.Options = &sessions.Options{
+// NewCookieStore returns a store for the signed cookies that carry the
+// session token and unlocked shares.
+func NewCookieStore(secret []byte) *sessions.CookieStore {
+	store := sessions.NewCookieStore(secret)
+	store.Options = &sessions.Options{
 		Path:     "/",
-		MaxAge:   24 * 60 * 60, 
-		HttpOnly: true, 
+		MaxAge:   int(sessionMaxLifetime / time.Second),
+		HttpOnly: true,
 		Secure:   false,
 		SameSite: http.SameSiteStrictMode,
 	}
+	return store
+}
+
+// newToken returns a random secret, prefixed to tell its kind at a glance.
+func newToken(prefix string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how tokens are stored. They are random, so a fast hash is
+// enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 func CheckPasswordHash(password, hash string) bool {
@@ -35,65 +77,166 @@ func CheckPasswordHash(password, hash string) bool {
 func (h *PhotoHandlers) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		h.Log.Error("unsupported HTTP method for login", zap.String("method", r.Method))
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.Log.Error("failed to decode login request body", zap.Error(err))
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
 		return
 	}
 
+	ip := ClientIPFromContext(r.Context())
+	if h.Lockout != nil {
+		if wait := h.Lockout.Check(ip); wait > 0 {
+			h.Log.Warn("login attempt while locked out", zap.String("ip", ip))
+			writeTooManyRequests(w, wait, "Too many failed login attempts, try again later")
+			return
+		}
+	}
+
 	pwHash := os.Getenv("PW")
 	if !CheckPasswordHash(req.Password, pwHash) {
-		h.Log.Warn("invalid login credentials")
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		h.Log.Warn("invalid login credentials", zap.String("ip", ip))
+		h.loginFailed(ip)
+		writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid credentials")
 		return
 	}
 
-	session, _ := Store.Get(r, "session-name")
-	session.Values["authenticated"] = true
-	session.Values["userId"] = "user123"
-	session.Values["createdAt"] = time.Now().Unix()
+	userID := "user123"
+	if h.TwoFactor != nil {
+		err := h.TwoFactor.checkLogin(r.Context(), userID, req.Code)
+		switch {
+		case errors.Is(err, errTwoFactorRequired):
+			writeError(w, http.StatusUnauthorized, CodeTwoFactorRequired, "Two-factor code required")
+			return
+		case errors.Is(err, errInvalidCode):
+			h.Log.Warn("invalid two-factor code", zap.String("ip", ip))
+			h.loginFailed(ip)
+			writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid credentials")
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to verify two-factor code")
+			return
+		}
+	}
+	if h.Lockout != nil {
+		h.Lockout.Succeed(ip)
+	}
 
-	if err := session.Save(r, w); err != nil {
+	if err := startSession(w, r, h.Sessions, userID); err != nil {
 		h.Log.Error("failed to save session", zap.Error(err))
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create session")
 		return
 	}
 
 	h.Log.Info("login successful")
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
+	writeMessage(w, http.StatusOK, "Login successful")
+}
+
+// loginFailed counts a failed login towards the lockout of the address.
+func (h *PhotoHandlers) loginFailed(ip string) {
+	if h.Lockout == nil {
+		return
+	}
+	if wait := h.Lockout.Fail(ip); wait > 0 {
+		h.Log.Warn("login locked out", zap.String("ip", ip), zap.Duration("backoff", wait))
+	}
 }
 
-func AuthMiddleware(logger *zap.Logger) func(http.Handler) http.Handler {
+// AuthMiddleware authenticates requests with an API key in the
+// Authorization header, or else with the session of the cookie's token,
+// and looks up the user's role. The role is read on every request, so
+// changes apply at once.
+func AuthMiddleware(sessionDb storage.SessionDB, apiKeys storage.APIKeyDB, users storage.UserDB, logger *zap.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			session, err := Store.Get(r, "session-name")
-			if err != nil {
-				logger.Warn("failed to get session", zap.Error(err), zap.String("path", r.URL.Path))
-				http.Error(w, "Invalid session", http.StatusUnauthorized)
-				return
+			var ctx context.Context
+			var ok bool
+			if header := r.Header.Get("Authorization"); header != "" {
+				ctx, ok = authenticateBearer(w, r, header, apiKeys, logger)
+			} else {
+				ctx, ok = authenticateSession(w, r, sessionDb, logger)
 			}
-
-			if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
-				logger.Warn("session not authenticated", zap.String("path", r.URL.Path))
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			if !ok {
 				return
 			}
 
-			createdAt, ok := session.Values["createdAt"].(int64)
-			if !ok || time.Now().Unix()-createdAt > 24*60*60 {
-				logger.Warn("session expired", zap.String("path", r.URL.Path))
-				http.Error(w, "Session expired", http.StatusUnauthorized)
+			user, err := users.GetUser(ctx, UserIDFromContext(ctx))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch user")
 				return
 			}
-
-			next.ServeHTTP(w, r)
+			ctx = context.WithValue(ctx, roleKey, user.EffectiveRole())
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
-}
\ No newline at end of file
+}
+
+func authenticateBearer(w http.ResponseWriter, r *http.Request, header string, apiKeys storage.APIKeyDB, logger *zap.Logger) (context.Context, bool) {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Unsupported authorization scheme, use Bearer")
+		return nil, false
+	}
+	key, err := authenticateAPIKey(r.Context(), apiKeys, strings.TrimSpace(token))
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		logger.Warn("unknown API key", zap.String("path", r.URL.Path))
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Unknown API key")
+		return nil, false
+	case errors.Is(err, errAPIKeyExpired):
+		logger.Warn("API key expired", zap.String("api_key_id", key.ID.Hex()), zap.String("path", r.URL.Path))
+		writeError(w, http.StatusUnauthorized, CodeAPIKeyExpired, "API key expired")
+		return nil, false
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to check API key")
+		return nil, false
+	}
+
+	ctx := context.WithValue(r.Context(), userIDKey, key.OwnerID)
+	return context.WithValue(ctx, apiKeyKey, key), true
+}
+
+// authenticateSession pushes the session's expiry back on every request, so
+// only idle sessions expire.
+func authenticateSession(w http.ResponseWriter, r *http.Request, sessionDb storage.SessionDB, logger *zap.Logger) (context.Context, bool) {
+	cookie, err := Store.Get(r, sessionName)
+	if err != nil {
+		logger.Warn("failed to get session", zap.Error(err), zap.String("path", r.URL.Path))
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Invalid session")
+		return nil, false
+	}
+
+	token, ok := cookie.Values[sessionTokenKey].(string)
+	if !ok || token == "" {
+		logger.Warn("session not authenticated", zap.String("path", r.URL.Path))
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	ctx := r.Context()
+	session, err := sessionDb.GetSessionByTokenHash(ctx, hashToken(token))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		logger.Warn("session expired or revoked", zap.String("path", r.URL.Path))
+		writeError(w, http.StatusUnauthorized, CodeSessionExpired, "Session expired")
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to check session")
+		return nil, false
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		session.LastSeenAt = now
+		session.IP = ClientIPFromContext(ctx)
+		session.ExpiresAt = sessionExpiry(session.CreatedAt, now)
+		sessionDb.TouchSession(ctx, session.ID, now, session.IP, session.ExpiresAt)
+	}
+
+	ctx = context.WithValue(ctx, userIDKey, session.UserID)
+	return context.WithValue(ctx, sessionKey, session), true
+}
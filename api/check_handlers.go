@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"photo-backup/model"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const maxCheckFiles = 1000
+
+// CheckFile describes a file the client is about to upload. Hash is the
+// hex encoded SHA-256 of the file; size and filename are optional.
+type CheckFile struct {
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+type CheckPhotosRequest struct {
+	Files []CheckFile `json:"files"`
+}
+
+type CheckedFile struct {
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	PhotoID  string `json:"photoId,omitempty"` // the stored photo, for existing files
+}
+
+// CheckPhotosResponse splits the checked files into those already stored
+// and those that still have to be uploaded, in request order.
+type CheckPhotosResponse struct {
+	Existing []CheckedFile `json:"existing"`
+	Missing  []CheckedFile `json:"missing"`
+}
+
+// CHECK BEFORE UPLOAD
+func (h *PhotoHandlers) HandleCheckPhotos(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req CheckPhotosRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.Log.Error("failed to decode check request", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(req.Files) == 0 {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No files provided")
+		return
+	}
+	if len(req.Files) > maxCheckFiles {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "At most "+strconv.Itoa(maxCheckFiles)+" files can be checked at once")
+		return
+	}
+
+	hashes := make([]string, 0, len(req.Files))
+	for i := range req.Files {
+		hash := strings.ToLower(strings.TrimSpace(req.Files[i].Hash))
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid SHA-256 hash: "+req.Files[i].Hash)
+			return
+		}
+		req.Files[i].Hash = hash
+		hashes = append(hashes, hash)
+	}
+
+	photos, err := h.Db.GetPhotosByHashes(ctx, UserIDFromContext(ctx), hashes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to check photos")
+		return
+	}
+
+	// a hash can be stored more than once, e.g. for photos uploaded before
+	// this check existed; any copy will do
+	stored := map[string]*model.PhotoDB{}
+	for i := range photos {
+		if _, ok := stored[photos[i].Hash]; !ok {
+			stored[photos[i].Hash] = &photos[i]
+		}
+	}
+
+	response := CheckPhotosResponse{Existing: []CheckedFile{}, Missing: []CheckedFile{}}
+	for _, file := range req.Files {
+		checked := CheckedFile{Hash: file.Hash, Size: file.Size, Filename: file.Filename}
+		photo, ok := stored[file.Hash]
+		// a size mismatch means the client hashed something else, so
+		// the file is uploaded rather than skipped
+		if ok && (file.Size == 0 || file.Size == photo.Size) {
+			checked.PhotoID = photo.ID.Hex()
+			response.Existing = append(response.Existing, checked)
+		} else {
+			response.Missing = append(response.Missing, checked)
+		}
+	}
+
+	h.Log.Info("checked photos before upload", zap.Int("files", len(req.Files)), zap.Int("existing", len(response.Existing)))
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const DeviceTokenHeader = "X-Device-Token"
+
+const deviceKey contextKey = "device"
+
+const (
+	maxDeviceNameLength = 100
+
+	// the last sighting is recorded at most this often, not on every request
+	deviceTouchInterval = time.Minute
+)
+
+// DeviceFromContext returns the device identified by DeviceMiddleware, or
+// nil when the request did not come from a registered device.
+func DeviceFromContext(ctx context.Context) *model.Device {
+	device, _ := ctx.Value(deviceKey).(*model.Device)
+	return device
+}
+
+// DeviceMiddleware identifies the device a request comes from by its
+// X-Device-Token header and records when it was last seen, at most once a
+// minute. Requests without
+// the header pass through unchanged; it must run after AuthMiddleware.
+func DeviceMiddleware(devices storage.DeviceDB, logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get(DeviceTokenHeader)
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			device, err := devices.GetDeviceByTokenHash(ctx, hashToken(token))
+			if err != nil || device.OwnerID != UserIDFromContext(ctx) {
+				logger.Warn("unknown device token", zap.String("path", r.URL.Path))
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Unknown device token")
+				return
+			}
+
+			now := time.Now()
+			if device.LastSeenAt == nil || now.Sub(*device.LastSeenAt) >= deviceTouchInterval {
+				if err := devices.TouchDevice(ctx, device.ID, now); err == nil {
+					device.LastSeenAt = &now
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, deviceKey, device)))
+		})
+	}
+}
+
+type DeviceHandlers struct {
+	Devices storage.DeviceDB
+	Photos  storage.PhotoDB
+	Log     *zap.Logger
+}
+
+func NewDeviceHandlers(devices storage.DeviceDB, photos storage.PhotoDB, logger *zap.Logger) *DeviceHandlers {
+	return &DeviceHandlers{
+		Devices: devices,
+		Photos:  photos,
+		Log:     logger,
+	}
+}
+
+type DeviceRequest struct {
+	Name string `json:"name"`
+}
+
+type DeviceResponse struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	LastSeenAt   *time.Time `json:"lastSeenAt,omitempty"`
+	LastUploadAt *time.Time `json:"lastUploadAt,omitempty"`
+	PhotoCount   int64      `json:"photoCount"`
+	Bytes        int64      `json:"bytes"`
+	Token        string     `json:"token,omitempty"` // only returned on registration
+}
+
+type DeviceListResponse struct {
+	Devices    []DeviceResponse `json:"devices"`
+	Pagination Pagination       `json:"pagination"`
+}
+
+func newDeviceResponse(device *model.Device, stats *storage.DeviceStats) DeviceResponse {
+	response := DeviceResponse{
+		ID:         device.ID.Hex(),
+		Name:       device.Name,
+		CreatedAt:  device.CreatedAt,
+		LastSeenAt: device.LastSeenAt,
+	}
+	if stats != nil {
+		response.PhotoCount = stats.Photos
+		response.Bytes = stats.Bytes
+		if !stats.LastUploadAt.IsZero() {
+			response.LastUploadAt = &stats.LastUploadAt
+		}
+	}
+	return response
+}
+
+// decodeDeviceName reads and validates the device name of the request body.
+func decodeDeviceName(r *http.Request) (string, error) {
+	var req DeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", errors.New("Invalid request body")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len([]rune(name)) > maxDeviceNameLength {
+		return "", errors.New("Invalid name, must be between 1 and 100 characters")
+	}
+	return name, nil
+}
+
+// REGISTER
+func (h *DeviceHandlers) HandleCreateDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	name, err := decodeDeviceName(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	token, err := newToken("dev_")
+	if err != nil {
+		h.Log.Error("failed to generate device token", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to register device")
+		return
+	}
+
+	saved, err := h.Devices.SaveDevice(ctx, model.Device{
+		OwnerID:   UserIDFromContext(ctx),
+		Name:      name,
+		TokenHash: hashToken(token),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to register device")
+		return
+	}
+
+	response := newDeviceResponse(saved, nil)
+	response.Token = token
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// LIST
+func (h *DeviceHandlers) HandleGetDevices(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := UserIDFromContext(ctx)
+
+	devices, err := h.Devices.GetDevices(ctx, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch devices")
+		return
+	}
+	stats, err := h.Photos.GetDeviceStats(ctx, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch devices")
+		return
+	}
+
+	byDevice := map[primitive.ObjectID]*storage.DeviceStats{}
+	for i := range stats {
+		byDevice[stats[i].DeviceID] = &stats[i]
+	}
+	response := DeviceListResponse{
+		Devices:    make([]DeviceResponse, len(devices)),
+		Pagination: Pagination{Total: int64(len(devices))},
+	}
+	for i := range devices {
+		response.Devices[i] = newDeviceResponse(&devices[i], byDevice[devices[i].ID])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// RENAME
+func (h *DeviceHandlers) HandleUpdateDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	name, err := decodeDeviceName(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	device, err := h.Devices.RenameDevice(ctx, id, UserIDFromContext(ctx), name)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Device not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to update device")
+		return
+	}
+
+	h.Log.Info("device renamed", zap.String("device_id", id))
+	writeJSON(w, http.StatusOK, newDeviceResponse(device, nil))
+}
+
+// REVOKE
+func (h *DeviceHandlers) HandleDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	if err := h.Devices.DeleteDevice(ctx, id, UserIDFromContext(ctx)); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Device not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to delete device")
+		return
+	}
+
+	h.Log.Info("device deleted", zap.String("device_id", id))
+	writeMessage(w, http.StatusOK, "Device deleted successfully")
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"photo-backup/model"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+func TestDeviceMiddlewareThrottlesTouches(t *testing.T) {
+	devices := &fakeDeviceDB{devices: []model.Device{{ID: primitive.NewObjectID(), OwnerID: "alice", TokenHash: hashToken("device-token")}}}
+	var seen *model.Device
+	handler := DeviceMiddleware(devices, zap.NewNop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = DeviceFromContext(r.Context())
+	}))
+	request := func(userID string) int {
+		r := asUser(httptest.NewRequest(http.MethodGet, "/photos", nil), userID, model.RoleMember)
+		r.Header.Set(DeviceTokenHeader, "device-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	for range 3 {
+		if status := request("alice"); status != http.StatusOK || seen == nil || seen.LastSeenAt == nil {
+			t.Fatalf("status %d, device %+v", status, seen)
+		}
+	}
+	if devices.touches != 1 {
+		t.Errorf("device touched %d times, want once", devices.touches)
+	}
+
+	stale := time.Now().Add(-deviceTouchInterval)
+	devices.devices[0].LastSeenAt = &stale
+	request("alice")
+	if devices.touches != 2 {
+		t.Errorf("device seen a minute ago touched %d times, want 2", devices.touches)
+	}
+
+	if status := request("bob"); status != http.StatusUnauthorized {
+		t.Errorf("device of another user: status %d, want 401", status)
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDuplicateDistance = 6
+	maxDuplicateDistance     = 16
+	defaultSimilarDistance   = 12
+	maxSimilarDistance       = 20
+)
+
+// DUPLICATES
+func (h *PhotoHandlers) HandleGetDuplicates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	distance := defaultDuplicateDistance
+	if distanceStr := query.Get("distance"); distanceStr != "" {
+		var err error
+		if distance, err = strconv.Atoi(distanceStr); err != nil || distance < 0 || distance > maxDuplicateDistance {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid distance value, must be between 0 and "+strconv.Itoa(maxDuplicateDistance))
+			return
+		}
+	}
+
+	var burstWindow time.Duration
+	if windowStr := query.Get("burstWindow"); windowStr != "" {
+		seconds, err := strconv.Atoi(windowStr)
+		if err != nil || seconds < 0 {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid burstWindow value")
+			return
+		}
+		burstWindow = time.Duration(seconds) * time.Second
+	}
+
+	hashes, err := h.Db.GetPhotoHashes(ctx, visibleTo(ctx))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch photos")
+		return
+	}
+	groups := storage.GroupSimilar(hashes, distance, burstWindow)
+
+	// load the complete records of the grouped photos only
+	var ids []primitive.ObjectID
+	for _, group := range groups {
+		for _, photo := range group {
+			ids = append(ids, photo.ID)
+		}
+	}
+	byID := map[primitive.ObjectID]model.PhotoDB{}
+	if len(ids) > 0 {
+		photos, err := h.Db.GetPhotosByIDs(ctx, ids)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch photos")
+			return
+		}
+		for _, photo := range photos {
+			byID[photo.ID] = photo
+		}
+	}
+
+	response := make([]DuplicateGroup, 0, len(groups))
+	for _, group := range groups {
+		item := DuplicateGroup{Keep: storage.BestPhoto(group).ID.Hex(), Photos: []PhotoResponse{}}
+		for _, photo := range group {
+			if full, ok := byID[photo.ID]; ok {
+				item.Photos = append(item.Photos, newPhotoResponse(&full))
+			}
+		}
+		response = append(response, item)
+	}
+
+	h.Log.Info("grouped similar photos", zap.Int("photos", len(hashes)), zap.Int("groups", len(response)), zap.Int("distance", distance))
+	writeJSON(w, http.StatusOK, DuplicateGroupListResponse{
+		Groups:     response,
+		Pagination: Pagination{Total: int64(len(response))},
+	})
+}
+
+// SIMILAR
+func (h *PhotoHandlers) HandleGetSimilar(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	limit := 20
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxPageLimit {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid limit value")
+			return
+		}
+	}
+	distance := defaultSimilarDistance
+	if distanceStr := query.Get("distance"); distanceStr != "" {
+		var err error
+		if distance, err = strconv.Atoi(distanceStr); err != nil || distance < 0 || distance > maxSimilarDistance {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid distance value, must be between 0 and "+strconv.Itoa(maxSimilarDistance))
+			return
+		}
+	}
+
+	photo, err := h.Db.GetPhoto(ctx, id)
+	if err != nil || !canView(ctx, photo) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Photo not found")
+		return
+	}
+
+	similar, err := h.Storage.FindSimilar(ctx, photo, distance, visibleTo(ctx))
+	if err != nil {
+		h.Log.Error("failed to find similar photos", zap.String("photo_id", id), zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to find similar photos")
+		return
+	}
+
+	visible := make([]SimilarPhotoResponse, 0, limit)
+	for i := range similar {
+		if len(visible) == limit {
+			break
+		}
+		if canView(ctx, &similar[i].PhotoDB) {
+			visible = append(visible, newSimilarPhotoResponse(&similar[i]))
+		}
+	}
+
+	h.Log.Info("retrieved similar photos", zap.String("photo_id", id), zap.Int("count", len(visible)))
+	writeJSON(w, http.StatusOK, SimilarPhotoListResponse{
+		Photos:     visible,
+		Pagination: Pagination{Total: int64(len(visible)), Limit: int64(limit)},
+	})
+}
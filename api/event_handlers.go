@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"photo-backup/events"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const heartbeatInterval = 25 * time.Second
+
+type EventHandlers struct {
+	Bus *events.Bus
+	Log *zap.Logger
+}
+
+func NewEventHandlers(bus *events.Bus, logger *zap.Logger) *EventHandlers {
+	return &EventHandlers{
+		Bus: bus,
+		Log: logger,
+	}
+}
+
+// eventStream marks responses that are Server-Sent Event streams.
+type eventStream struct{}
+
+// EVENTS
+// Streams library events as Server-Sent Events. Clients resume with the
+// Last-Event-ID header, which browsers send automatically on reconnect, or
+// the lastEventId query parameter. When events were missed, a "reset" event
+// tells the client to reload instead.
+func (h *EventHandlers) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := UserIDFromContext(ctx)
+	ownerID := visibleTo(ctx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Streaming not supported")
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	sub, replay, complete := h.Bus.Subscribe(lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, record := range replay {
+		writeEvent(w, ownerID, record)
+	}
+	flusher.Flush()
+	h.Log.Info("event stream opened", zap.String("user_id", userID), zap.Int("replayed", len(replay)))
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.Log.Info("event stream closed", zap.String("user_id", userID))
+			return
+		case record, ok := <-sub.C:
+			if !ok {
+				// too far behind, the client reconnects and resumes
+				return
+			}
+			writeEvent(w, ownerID, record)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes the record if the user may see the photo it is about,
+// ownerID being the user's as returned by visibleTo.
+func writeEvent(w http.ResponseWriter, ownerID string, record events.Record) {
+	if ownerID != "" && record.Event.OwnerID != "" && record.Event.OwnerID != ownerID {
+		return
+	}
+	data, err := json.Marshal(record.Event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", record.ID, record.Event.Type, data)
+}
@@ -0,0 +1,451 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// The fakes keep their data in memory. Methods the tests do not need are
+// left to the embedded interfaces and panic if called.
+
+type fakePhotoDB struct {
+	storage.PhotoDB
+	photos map[string]*model.PhotoDB
+}
+
+func newFakePhotoDB(photos ...model.PhotoDB) *fakePhotoDB {
+	db := &fakePhotoDB{photos: map[string]*model.PhotoDB{}}
+	for i := range photos {
+		if photos[i].ID.IsZero() {
+			photos[i].ID = primitive.NewObjectID()
+		}
+		db.photos[photos[i].ID.Hex()] = &photos[i]
+	}
+	return db
+}
+
+// visible returns the photos of the owner and those without one, like
+// the owner filters of MongoPhotoDB.
+func (db *fakePhotoDB) visible(ownerID string) []model.PhotoDB {
+	photos := []model.PhotoDB{}
+	for _, photo := range db.photos {
+		if ownerID == "" || photo.OwnerID == "" || photo.OwnerID == ownerID {
+			photos = append(photos, *photo)
+		}
+	}
+	return photos
+}
+
+func (db *fakePhotoDB) GetPhoto(ctx context.Context, id string) (*model.PhotoDB, error) {
+	photo, ok := db.photos[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	copied := *photo
+	return &copied, nil
+}
+
+func (db *fakePhotoDB) GetPhotosByIDs(ctx context.Context, ids []primitive.ObjectID) ([]model.PhotoDB, error) {
+	photos := []model.PhotoDB{}
+	for _, id := range ids {
+		if photo, ok := db.photos[id.Hex()]; ok {
+			photos = append(photos, *photo)
+		}
+	}
+	return photos, nil
+}
+
+func (db *fakePhotoDB) DeletePhoto(ctx context.Context, id string) (*model.PhotoDB, error) {
+	photo, ok := db.photos[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	delete(db.photos, id)
+	return photo, nil
+}
+
+func (db *fakePhotoDB) QueryPhotos(ctx context.Context, filter storage.PhotoFilter, sort string, cursor string, limit int64) (*storage.PhotoPage, error) {
+	photos := db.visible(filter.OwnerID)
+	return &storage.PhotoPage{Photos: photos, Total: int64(len(photos))}, nil
+}
+
+func (db *fakePhotoDB) UpdatePhoto(ctx context.Context, id string, update storage.PhotoUpdate) (*model.PhotoDB, error) {
+	photo, ok := db.photos[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	if update.Caption != nil {
+		photo.Caption = *update.Caption
+	}
+	if update.Favorite != nil {
+		photo.Favorite = *update.Favorite
+	}
+	copied := *photo
+	return &copied, nil
+}
+
+func (db *fakePhotoDB) GetTags(ctx context.Context, ownerID string, prefix string, limit int64) ([]storage.TagCount, error) {
+	counts := map[string]int64{}
+	for _, photo := range db.visible(ownerID) {
+		for _, tag := range photo.Tags {
+			counts[tag]++
+		}
+	}
+	tags := []storage.TagCount{}
+	for tag, count := range counts {
+		tags = append(tags, storage.TagCount{Tag: tag, Count: count})
+	}
+	return tags, nil
+}
+
+func (db *fakePhotoDB) GetPhotoHashes(ctx context.Context, ownerID string) ([]model.PhotoDB, error) {
+	return db.visible(ownerID), nil
+}
+
+func (db *fakePhotoDB) GetPhotosByHashes(ctx context.Context, ownerID string, hashes []string) ([]model.PhotoDB, error) {
+	photos := []model.PhotoDB{}
+	for _, photo := range db.visible(ownerID) {
+		for _, hash := range hashes {
+			if photo.Hash == hash {
+				photos = append(photos, photo)
+			}
+		}
+	}
+	return photos, nil
+}
+
+func (db *fakePhotoDB) GetChanges(ctx context.Context, ownerID string, since string, limit int64) (*storage.ChangePage, error) {
+	page := &storage.ChangePage{Since: "1"}
+	for _, photo := range db.visible(ownerID) {
+		page.Changes = append(page.Changes, storage.Change{Seq: 1, Photo: &photo, Created: true})
+	}
+	return page, nil
+}
+
+func (db *fakePhotoDB) GetDeviceStats(ctx context.Context, ownerID string) ([]storage.DeviceStats, error) {
+	return []storage.DeviceStats{}, nil
+}
+
+// fakePhotoStorage deletes from the fake database and stores no files.
+type fakePhotoStorage struct {
+	storage.PhotoStorage
+	db *fakePhotoDB
+}
+
+func (s *fakePhotoStorage) DeletePhoto(ctx context.Context, id string) error {
+	_, err := s.db.DeletePhoto(ctx, id)
+	return err
+}
+
+type fakeUserDB struct {
+	storage.UserDB
+	users map[string]*model.User
+}
+
+func newFakeUserDB(users ...model.User) *fakeUserDB {
+	db := &fakeUserDB{users: map[string]*model.User{}}
+	for i := range users {
+		db.users[users[i].ID] = &users[i]
+	}
+	return db
+}
+
+func (db *fakeUserDB) GetUser(ctx context.Context, id string) (*model.User, error) {
+	user, ok := db.users[id]
+	if !ok {
+		return &model.User{ID: id}, nil
+	}
+	copied := *user
+	if user.TwoFactor != nil {
+		twoFactor := *user.TwoFactor
+		copied.TwoFactor = &twoFactor
+	}
+	return &copied, nil
+}
+
+func (db *fakeUserDB) GetUsers(ctx context.Context) ([]model.User, error) {
+	users := []model.User{}
+	for _, user := range db.users {
+		users = append(users, *user)
+	}
+	return users, nil
+}
+
+func (db *fakeUserDB) user(id string) *model.User {
+	if db.users[id] == nil {
+		db.users[id] = &model.User{ID: id, CreatedAt: time.Now()}
+	}
+	return db.users[id]
+}
+
+func (db *fakeUserDB) SetTwoFactor(ctx context.Context, id string, twoFactor *model.TwoFactor) error {
+	db.user(id).TwoFactor = twoFactor
+	return nil
+}
+
+func (db *fakeUserDB) UseTOTPStep(ctx context.Context, id string, step int64) error {
+	user := db.users[id]
+	if user == nil || user.TwoFactor == nil || user.TwoFactor.LastStep >= step {
+		return mongo.ErrNoDocuments
+	}
+	user.TwoFactor.LastStep = step
+	return nil
+}
+
+func (db *fakeUserDB) UseRecoveryCode(ctx context.Context, id string, codeHash string) error {
+	user := db.users[id]
+	if user == nil || user.TwoFactor == nil {
+		return mongo.ErrNoDocuments
+	}
+	for i, hash := range user.TwoFactor.RecoveryCodes {
+		if hash == codeHash {
+			user.TwoFactor.RecoveryCodes = append(user.TwoFactor.RecoveryCodes[:i], user.TwoFactor.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return mongo.ErrNoDocuments
+}
+
+func (db *fakeUserDB) SetRecoveryCodes(ctx context.Context, id string, codeHashes []string) error {
+	db.user(id).TwoFactor.RecoveryCodes = codeHashes
+	return nil
+}
+
+func (db *fakeUserDB) SetRole(ctx context.Context, id string, role string) error {
+	db.user(id).Role = role
+	return nil
+}
+
+func (db *fakeUserDB) CountRole(ctx context.Context, role string) (int64, error) {
+	var count int64
+	for _, user := range db.users {
+		if user.Role == role {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *fakeUserDB) GetUserByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error) {
+	for _, user := range db.users {
+		if user.Identity != nil && user.Identity.Issuer == issuer && user.Identity.Subject == subject {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (db *fakeUserDB) LinkIdentity(ctx context.Context, id string, identity model.Identity) error {
+	user := db.users[id]
+	if user == nil || (user.Identity != nil && (user.Identity.Issuer != identity.Issuer || user.Identity.Subject != identity.Subject)) {
+		return mongo.ErrNoDocuments
+	}
+	user.Identity = &identity
+	return nil
+}
+
+func (db *fakeUserDB) CreateUser(ctx context.Context, user model.User) error {
+	if db.users[user.ID] != nil {
+		return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "duplicate key"}}}
+	}
+	db.users[user.ID] = &user
+	return nil
+}
+
+type fakeSessionDB struct {
+	storage.SessionDB
+	sessions []model.Session
+}
+
+func (db *fakeSessionDB) SaveSession(ctx context.Context, session model.Session) (*model.Session, error) {
+	session.ID = primitive.NewObjectID()
+	db.sessions = append(db.sessions, session)
+	return &session, nil
+}
+
+func (db *fakeSessionDB) GetSessionByTokenHash(ctx context.Context, tokenHash string) (*model.Session, error) {
+	for _, session := range db.sessions {
+		if session.TokenHash == tokenHash {
+			return &session, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (db *fakeSessionDB) GetSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	sessions := []model.Session{}
+	for _, session := range db.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+type fakeAPIKeyDB struct {
+	storage.APIKeyDB
+	keys []model.APIKey
+}
+
+func (db *fakeAPIKeyDB) SaveAPIKey(ctx context.Context, key model.APIKey) (*model.APIKey, error) {
+	key.ID = primitive.NewObjectID()
+	db.keys = append(db.keys, key)
+	return &key, nil
+}
+
+func (db *fakeAPIKeyDB) GetAPIKeys(ctx context.Context, ownerID string) ([]model.APIKey, error) {
+	keys := []model.APIKey{}
+	for _, key := range db.keys {
+		if key.OwnerID == ownerID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+type fakeShareDB struct {
+	storage.ShareDB
+	shares []*model.ShareLink
+}
+
+func (db *fakeShareDB) SaveShare(ctx context.Context, share model.ShareLink) (*model.ShareLink, error) {
+	share.ID = primitive.NewObjectID()
+	db.shares = append(db.shares, &share)
+	return &share, nil
+}
+
+func (db *fakeShareDB) GetShareByToken(ctx context.Context, token string) (*model.ShareLink, error) {
+	for _, share := range db.shares {
+		if share.Token == token {
+			return share, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (db *fakeShareDB) GetShares(ctx context.Context, ownerID string) ([]model.ShareLink, error) {
+	shares := []model.ShareLink{}
+	for _, share := range db.shares {
+		if share.OwnerID == ownerID {
+			shares = append(shares, *share)
+		}
+	}
+	return shares, nil
+}
+
+type fakeDeviceDB struct {
+	storage.DeviceDB
+	devices []model.Device
+	touches int
+}
+
+func (db *fakeDeviceDB) GetDeviceByTokenHash(ctx context.Context, tokenHash string) (*model.Device, error) {
+	for _, device := range db.devices {
+		if device.TokenHash == tokenHash {
+			return &device, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (db *fakeDeviceDB) TouchDevice(ctx context.Context, id primitive.ObjectID, seenAt time.Time) error {
+	db.touches++
+	for i := range db.devices {
+		if db.devices[i].ID == id {
+			db.devices[i].LastSeenAt = &seenAt
+		}
+	}
+	return nil
+}
+
+func (db *fakeDeviceDB) SaveDevice(ctx context.Context, device model.Device) (*model.Device, error) {
+	device.ID = primitive.NewObjectID()
+	db.devices = append(db.devices, device)
+	return &device, nil
+}
+
+func (db *fakeDeviceDB) GetDevices(ctx context.Context, ownerID string) ([]model.Device, error) {
+	devices := []model.Device{}
+	for _, device := range db.devices {
+		if device.OwnerID == ownerID {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+type fakeWebhookDB struct {
+	storage.WebhookDB
+	webhooks []model.Webhook
+}
+
+func (db *fakeWebhookDB) SaveWebhook(ctx context.Context, webhook model.Webhook) (*model.Webhook, error) {
+	webhook.ID = primitive.NewObjectID()
+	db.webhooks = append(db.webhooks, webhook)
+	return &webhook, nil
+}
+
+func (db *fakeWebhookDB) GetWebhooks(ctx context.Context, ownerID string) ([]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+	for _, webhook := range db.webhooks {
+		if webhook.OwnerID == ownerID {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+type fakeUsageDB struct {
+	storage.UsageDB
+}
+
+func (db *fakeUsageDB) GetUsage(ctx context.Context, ownerID string) ([]storage.UsageBucket, error) {
+	return []storage.UsageBucket{{Key: storage.UsageKey{OwnerID: ownerID, ContentType: "image/jpeg", Year: 2024}, Photos: 1, OriginalBytes: 1000}}, nil
+}
+
+func (db *fakeUsageDB) GetQuota(ctx context.Context, ownerID string) (int64, error) {
+	return 1 << 30, nil
+}
+
+func newTestPhotoHandlers(db *fakePhotoDB) *PhotoHandlers {
+	return NewPhotoHandlers(&fakePhotoStorage{db: db}, db, zap.NewNop())
+}
+
+// asUser returns the request as authenticated by AuthMiddleware.
+func asUser(r *http.Request, userID string, role string) *http.Request {
+	ctx := context.WithValue(r.Context(), userIDKey, userID)
+	ctx = context.WithValue(ctx, roleKey, role)
+	return r.WithContext(ctx)
+}
+
+func serve(t *testing.T, handler http.HandlerFunc, r *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	if vars != nil {
+		r = mux.SetURLVars(r, vars)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	return rec
+}
+
+func jsonRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func init() {
+	Store = NewCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"photo-backup/model"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const (
+	RenditionOriginal  = "original"
+	RenditionThumbnail = "thumbnail"
+)
+
+// GET FILE
+func (h *PhotoHandlers) HandleGetFile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+	rendition := vars["rendition"]
+
+	photo, err := h.Db.GetPhoto(ctx, id)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			h.Log.Error("failed to fetch photo for file", zap.String("photo_id", id), zap.Error(err))
+		}
+		writeError(w, http.StatusNotFound, CodeNotFound, "Photo not found")
+		return
+	}
+
+	// respond with 404 so that photo IDs of other users can't be probed
+	if !canView(ctx, photo) {
+		h.Log.Warn("photo access denied", zap.String("photo_id", id), zap.String("user_id", UserIDFromContext(ctx)))
+		writeError(w, http.StatusNotFound, CodeNotFound, "Photo not found")
+		return
+	}
+
+	h.serveRendition(w, r, photo, rendition)
+}
+
+// canView reports whether the authenticated user may see the photo. Viewers
+// own no photos and see the whole library.
+func canView(ctx context.Context, photo *model.PhotoDB) bool {
+	return RoleFromContext(ctx) == model.RoleViewer || canEdit(ctx, photo)
+}
+
+// canEdit reports whether the authenticated user may modify, share or
+// delete the photo. Photos uploaded before ownership was recorded belong to
+// every user.
+func canEdit(ctx context.Context, photo *model.PhotoDB) bool {
+	return photo.OwnerID == "" || photo.OwnerID == UserIDFromContext(ctx)
+}
+
+// visibleTo returns the owner ID that read queries are restricted to, with
+// the same rules as canView. It is empty for viewers.
+func visibleTo(ctx context.Context) string {
+	if RoleFromContext(ctx) == model.RoleViewer {
+		return ""
+	}
+	return UserIDFromContext(ctx)
+}
+
+// serveRendition streams a photo rendition. http.ServeContent takes care of
+// Range, If-Range, If-None-Match and If-Modified-Since requests.
+func (h *PhotoHandlers) serveRendition(w http.ResponseWriter, r *http.Request, photo *model.PhotoDB, rendition string) {
+	var path string
+	switch rendition {
+	case RenditionOriginal:
+		path = photo.FilePath
+	case RenditionThumbnail:
+		path = photo.ThumbnailPath
+	default:
+		writeError(w, http.StatusNotFound, CodeNotFound, "Unknown rendition")
+		return
+	}
+
+	file, err := h.Storage.OpenFile(path)
+	if err != nil {
+		h.Log.Error("failed to open photo file", zap.String("photo_id", photo.ID.Hex()), zap.String("rendition", rendition), zap.Error(err))
+		writeError(w, http.StatusNotFound, CodeNotFound, "File not available")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		h.Log.Error("failed to stat photo file", zap.String("photo_id", photo.ID.Hex()), zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "File not available")
+		return
+	}
+
+	// stored files never change once written, so the ID and rendition are
+	// enough for a strong validator
+	w.Header().Set("ETag", `"`+photo.ID.Hex()+"-"+rendition+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	if rendition == RenditionOriginal && photo.ContentType != "" {
+		w.Header().Set("Content-Type", photo.ContentType)
+	}
+
+	http.ServeContent(w, r, path, info.ModTime(), file)
+}
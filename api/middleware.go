@@ -13,7 +13,7 @@ func RecoveryMiddleware(logger *zap.Logger) func(http.Handler) http.Handler {
 			defer func() {
 				if err := recover(); err != nil {
 					logger.Error("panic recovered", zap.Any("error", err))
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					writeError(w, http.StatusInternalServerError, CodeInternal, "Internal server error")
 				}
 			}()
 			next.ServeHTTP(w, r)
@@ -40,8 +40,8 @@ func CORSMiddleware() func(http.Handler) http.Handler {
     return func(next http.Handler) http.Handler {
         return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
             w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-            w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-            w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+            w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+            w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Device-Token")
             w.Header().Set("Access-Control-Allow-Credentials", "true")
 
             if req.Method == "OPTIONS" {
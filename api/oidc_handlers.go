@@ -0,0 +1,412 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"photo-backup/model"
+	"photo-backup/oidc"
+	"photo-backup/storage"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const (
+	oidcCookieName        = "oidc-flow"
+	oidcPendingCookieName = "oidc-pending" // a login waiting for the second factor
+	oidcFlowTimeout       = 10 * time.Minute
+	maxUserIDLength       = 100
+)
+
+var (
+	errNoUsername        = errors.New("ID token lacks a usable username claim")
+	errNoLocalUser       = errors.New("no local user for the identity")
+	errUserIDTaken       = errors.New("user ID is taken")
+	errIdentityLinked    = errors.New("identity is linked to another user")
+	errUserAlreadyLinked = errors.New("user is linked to another identity")
+)
+
+// OIDCHandlers log users in with an OpenID Connect provider, next to the
+// password login. Users are found by the provider's subject only. An
+// identity is linked to an existing user when that user connects it while
+// logged in, or by an admin with the link-identity command; otherwise a
+// new user is provisioned, named by UsernameClaim. A username claim never
+// links to an existing user, as anyone at the provider may be able to pick
+// it. Users with two-factor authentication enabled enter their code before
+// the session starts, as with the password. Now can be replaced to test
+// against a fixed clock.
+type OIDCHandlers struct {
+	Provider      *oidc.Provider // nil if OpenID Connect is not configured
+	Users         storage.UserDB
+	Sessions      storage.SessionDB
+	TwoFactor     *TwoFactorHandlers // optional, asks for a second factor on login
+	Lockout       *LoginLockout      // optional, counts wrong two-factor codes
+	UsernameClaim string
+	AutoProvision bool   // create users on first login, else only existing users may log in
+	DefaultRole   string // of provisioned users
+	AfterLogin    string // where the browser is sent once logged in
+	Now           func() time.Time
+	Log           *zap.Logger
+}
+
+func NewOIDCHandlers(provider *oidc.Provider, users storage.UserDB, sessions storage.SessionDB, logger *zap.Logger) *OIDCHandlers {
+	return &OIDCHandlers{
+		Provider:      provider,
+		Users:         users,
+		Sessions:      sessions,
+		UsernameClaim: "preferred_username",
+		AutoProvision: true,
+		DefaultRole:   model.RoleMember,
+		AfterLogin:    "/",
+		Now:           time.Now,
+		Log:           logger,
+	}
+}
+
+// LOGIN
+func (h *OIDCHandlers) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	h.startFlow(w, r, "")
+}
+
+// LINK
+// HandleOIDCLink connects the identity the current user logs in with at
+// the provider to their account, so they can log in with it from then on.
+func (h *OIDCHandlers) HandleOIDCLink(w http.ResponseWriter, r *http.Request) {
+	h.startFlow(w, r, UserIDFromContext(r.Context()))
+}
+
+// startFlow redirects to the provider. The flow logs in, or links the
+// identity to the user linkTo if set.
+func (h *OIDCHandlers) startFlow(w http.ResponseWriter, r *http.Request, linkTo string) {
+	if h.Provider == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "OpenID Connect login is not configured")
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := oidc.RandomString()
+		if err != nil {
+			h.Log.Error("failed to generate OIDC state", zap.Error(err))
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to start login")
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	target, err := h.Provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		h.Log.Error("OIDC discovery failed", zap.Error(err))
+		writeError(w, http.StatusBadGateway, CodeInternal, "Identity provider unavailable")
+		return
+	}
+
+	flow, _ := Store.Get(r, oidcCookieName)
+	flow.Options = flowCookieOptions()
+	flow.Values = map[interface{}]interface{}{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"link":     linkTo,
+		"expires":  h.Now().Add(oidcFlowTimeout).Unix(),
+	}
+	if err := flow.Save(r, w); err != nil {
+		h.Log.Error("failed to save OIDC flow", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to start login")
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// CALLBACK
+func (h *OIDCHandlers) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if h.Provider == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "OpenID Connect login is not configured")
+		return
+	}
+	ctx := r.Context()
+	query := r.URL.Query()
+	ip := ClientIPFromContext(ctx)
+
+	flow, _ := Store.Get(r, oidcCookieName)
+	state, _ := flow.Values["state"].(string)
+	nonce, _ := flow.Values["nonce"].(string)
+	verifier, _ := flow.Values["verifier"].(string)
+	linkTo, _ := flow.Values["link"].(string)
+	expires, _ := flow.Values["expires"].(int64)
+	// the flow cookie is cleared whatever the outcome
+	flow.Options = &sessions.Options{Path: BasePath + "/oidc", MaxAge: -1}
+	flow.Save(r, w)
+
+	if reason := query.Get("error"); reason != "" {
+		h.Log.Warn("OIDC login denied by the provider", zap.String("error", reason), zap.String("ip", ip))
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Login denied by the identity provider: "+reason)
+		return
+	}
+	if state == "" || h.Now().Unix() > expires {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Login expired or not started here, try again")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		h.Log.Warn("OIDC state mismatch", zap.String("ip", ip))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid state")
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Missing code")
+		return
+	}
+
+	token, err := h.Provider.Exchange(ctx, code, verifier, nonce)
+	if err != nil {
+		h.Log.Warn("OIDC token exchange failed", zap.Error(err), zap.String("ip", ip))
+		writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Login failed")
+		return
+	}
+
+	if linkTo != "" {
+		h.linkUser(w, r, linkTo, token)
+		return
+	}
+
+	userID, err := h.resolveUser(ctx, token)
+	switch {
+	case errors.Is(err, errNoUsername):
+		h.Log.Warn("OIDC ID token lacks the username claim", zap.String("claim", h.UsernameClaim), zap.String("subject", token.Subject))
+		writeError(w, http.StatusForbidden, CodeForbidden, "The identity provider did not send a username")
+		return
+	case errors.Is(err, errNoLocalUser):
+		h.Log.Warn("OIDC login without a local user", zap.String("subject", token.Subject))
+		writeError(w, http.StatusForbidden, CodeForbidden, "No account for this identity, ask an admin to create one")
+		return
+	case errors.Is(err, errUserIDTaken):
+		h.Log.Warn("OIDC username taken by an unlinked user", zap.String("subject", token.Subject))
+		writeError(w, http.StatusForbidden, CodeForbidden, "The username is taken, log in and link the identity to your account instead")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to look up user")
+		return
+	}
+
+	if h.TwoFactor != nil {
+		err := h.TwoFactor.checkLogin(ctx, userID, "")
+		if errors.Is(err, errTwoFactorRequired) {
+			h.awaitTwoFactor(w, r, userID)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to look up two-factor settings")
+			return
+		}
+	}
+
+	if err := startSession(w, r, h.Sessions, userID); err != nil {
+		h.Log.Error("failed to save session", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create session")
+		return
+	}
+
+	h.Log.Info("OIDC login successful", zap.String("user_id", userID))
+	http.Redirect(w, r, h.AfterLogin, http.StatusFound)
+}
+
+// awaitTwoFactor keeps the login pending in a cookie and redirects to
+// AfterLogin with twoFactor=required, where the code is asked for.
+func (h *OIDCHandlers) awaitTwoFactor(w http.ResponseWriter, r *http.Request, userID string) {
+	pending, _ := Store.Get(r, oidcPendingCookieName)
+	pending.Options = flowCookieOptions()
+	pending.Values = map[interface{}]interface{}{
+		"user":    userID,
+		"expires": h.Now().Add(oidcFlowTimeout).Unix(),
+	}
+	if err := pending.Save(r, w); err != nil {
+		h.Log.Error("failed to save pending OIDC login", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create session")
+		return
+	}
+
+	target, err := url.Parse(h.AfterLogin)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Invalid redirect after login")
+		return
+	}
+	query := target.Query()
+	query.Set("twoFactor", "required")
+	target.RawQuery = query.Encode()
+	h.Log.Info("OIDC login waiting for two-factor code", zap.String("user_id", userID))
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// TWO-FACTOR
+// HandleOIDCTwoFactor finishes a login the callback left pending, with a
+// TOTP or recovery code.
+func (h *OIDCHandlers) HandleOIDCTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ip := ClientIPFromContext(ctx)
+	if h.Lockout != nil {
+		if wait := h.Lockout.Check(ip); wait > 0 {
+			h.Log.Warn("two-factor attempt while locked out", zap.String("ip", ip))
+			writeTooManyRequests(w, wait, "Too many failed login attempts, try again later")
+			return
+		}
+	}
+
+	pending, _ := Store.Get(r, oidcPendingCookieName)
+	userID, _ := pending.Values["user"].(string)
+	expires, _ := pending.Values["expires"].(int64)
+	if h.TwoFactor == nil || userID == "" || h.Now().Unix() > expires {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Login expired or not started here, try again")
+		return
+	}
+	code, err := decodeCode(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	err = h.TwoFactor.checkLogin(ctx, userID, code)
+	switch {
+	case errors.Is(err, errInvalidCode):
+		h.Log.Warn("invalid two-factor code", zap.String("ip", ip))
+		if h.Lockout != nil {
+			h.Lockout.Fail(ip)
+		}
+		writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid code")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to verify two-factor code")
+		return
+	}
+	if h.Lockout != nil {
+		h.Lockout.Succeed(ip)
+	}
+
+	pending.Options = &sessions.Options{Path: BasePath + "/oidc", MaxAge: -1}
+	pending.Save(r, w)
+	if err := startSession(w, r, h.Sessions, userID); err != nil {
+		h.Log.Error("failed to save session", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create session")
+		return
+	}
+
+	h.Log.Info("OIDC login successful", zap.String("user_id", userID))
+	writeMessage(w, http.StatusOK, "Login successful")
+}
+
+// flowCookieOptions are those of the cookies of a login. The provider
+// redirects back cross-site, which the strict session cookie is not sent
+// on, so they are lax.
+func flowCookieOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     BasePath + "/oidc",
+		MaxAge:   int(oidcFlowTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   Store.Options.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// linkUser ends a link flow: the identity is linked to the user that
+// started it, who stays logged in with their session.
+func (h *OIDCHandlers) linkUser(w http.ResponseWriter, r *http.Request, userID string, token *oidc.IDToken) {
+	ctx := r.Context()
+	err := h.linkIdentity(ctx, userID, token)
+	switch {
+	case errors.Is(err, errIdentityLinked):
+		h.Log.Warn("OIDC identity linked to another user", zap.String("user_id", userID), zap.String("subject", token.Subject))
+		writeError(w, http.StatusConflict, CodeConflict, "The identity is linked to another user")
+		return
+	case errors.Is(err, errUserAlreadyLinked):
+		writeError(w, http.StatusConflict, CodeConflict, "Your account is linked to another identity")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to link identity")
+		return
+	}
+
+	h.Log.Info("OIDC identity linked", zap.String("user_id", userID), zap.String("subject", token.Subject))
+	http.Redirect(w, r, h.AfterLogin, http.StatusFound)
+}
+
+func (h *OIDCHandlers) linkIdentity(ctx context.Context, userID string, token *oidc.IDToken) error {
+	user, err := h.Users.GetUserByIdentity(ctx, token.Issuer, token.Subject)
+	if err == nil && user.ID != userID {
+		return errIdentityLinked
+	}
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	err = h.Users.LinkIdentity(ctx, userID, identityOf(token))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errUserAlreadyLinked
+	}
+	return err
+}
+
+// resolveUser returns the local user of an identity: the user linked to
+// it, else a new user if provisioning is on.
+func (h *OIDCHandlers) resolveUser(ctx context.Context, token *oidc.IDToken) (string, error) {
+	identity := identityOf(token)
+
+	user, err := h.Users.GetUserByIdentity(ctx, identity.Issuer, identity.Subject)
+	if err == nil {
+		// refreshes the email and name
+		return user.ID, h.Users.LinkIdentity(ctx, user.ID, identity)
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return "", err
+	}
+	if !h.AutoProvision {
+		return "", errNoLocalUser
+	}
+
+	userID := token.String(h.UsernameClaim)
+	// anyone can claim an unverified address
+	if h.UsernameClaim == "email" && token.Claims["email_verified"] != true {
+		userID = ""
+	}
+	if !validUserID(userID) {
+		return "", errNoUsername
+	}
+
+	err = h.Users.CreateUser(ctx, model.User{
+		ID:        userID,
+		CreatedAt: h.Now(),
+		Role:      h.DefaultRole,
+		Identity:  &identity,
+	})
+	// an existing user is never taken over by the claim
+	if mongo.IsDuplicateKeyError(err) {
+		return "", errUserIDTaken
+	}
+	if err != nil {
+		return "", err
+	}
+	h.Log.Info("user provisioned with OIDC", zap.String("user_id", userID), zap.String("role", h.DefaultRole))
+	return userID, nil
+}
+
+func identityOf(token *oidc.IDToken) model.Identity {
+	return model.Identity{
+		Issuer:  token.Issuer,
+		Subject: token.Subject,
+		Email:   token.String("email"),
+		Name:    token.String("name"),
+	}
+}
+
+func validUserID(id string) bool {
+	if id == "" || len(id) > maxUserIDLength {
+		return false
+	}
+	return strings.IndexFunc(id, func(r rune) bool { return unicode.IsControl(r) || unicode.IsSpace(r) }) < 0
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"photo-backup/model"
+	"photo-backup/oidc"
+	"photo-backup/oidc/oidctest"
+	"photo-backup/totp"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestOIDCHandlers(t *testing.T, users *fakeUserDB) (*oidctest.Server, *OIDCHandlers, *fakeSessionDB) {
+	idp := oidctest.NewServer("photos")
+	t.Cleanup(idp.Close)
+	provider := oidc.NewProvider(oidc.Config{Issuer: idp.Issuer(), ClientID: "photos", RedirectURL: "https://photos.example.com" + BasePath + "/oidc/callback"})
+	provider.Client = idp.Client()
+	sessions := &fakeSessionDB{}
+	return idp, NewOIDCHandlers(provider, users, sessions, zap.NewNop()), sessions
+}
+
+// oidcLogin starts a login, lets the provider authorize it and returns the
+// response to the callback.
+func oidcLogin(t *testing.T, idp *oidctest.Server, h *OIDCHandlers) *httptest.ResponseRecorder {
+	t.Helper()
+	return oidcFlow(t, idp, h, h.HandleOIDCLogin, httptest.NewRequest(http.MethodGet, BasePath+"/oidc/login", nil))
+}
+
+// oidcFlow starts a flow with the handler, lets the provider authorize it
+// and returns the response to the callback.
+func oidcFlow(t *testing.T, idp *oidctest.Server, h *OIDCHandlers, handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	start := serve(t, handler, r, nil)
+	if start.Code != http.StatusFound {
+		t.Fatalf("start: status %d: %s", start.Code, start.Body)
+	}
+	code, state, err := idp.Authorize(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{"code": {code}, "state": {state}}
+	callback := httptest.NewRequest(http.MethodGet, BasePath+"/oidc/callback?"+query.Encode(), nil)
+	for _, cookie := range start.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	return serve(t, h.HandleOIDCCallback, callback, nil)
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	users := newFakeUserDB()
+	idp, h, sessions := newTestOIDCHandlers(t, users)
+	h.DefaultRole = model.RoleViewer
+	idp.Claims["preferred_username"] = "dana"
+	idp.Claims["email"] = "dana@example.com"
+
+	rec := oidcLogin(t, idp, h)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+		t.Fatalf("callback: status %d: %s", rec.Code, rec.Body)
+	}
+	user := users.users["dana"]
+	if user == nil || user.Role != model.RoleViewer || user.Identity == nil || user.Identity.Subject != idp.Subject || user.Identity.Email != "dana@example.com" {
+		t.Fatalf("provisioned user %+v", user)
+	}
+	if len(sessions.sessions) != 1 || sessions.sessions[0].UserID != "dana" {
+		t.Errorf("sessions %+v", sessions.sessions)
+	}
+
+	// the next login finds the user by the subject, whatever the username
+	idp.Claims["preferred_username"] = "renamed"
+	if rec := oidcLogin(t, idp, h); rec.Code != http.StatusFound || len(users.users) != 1 || sessions.sessions[1].UserID != "dana" {
+		t.Errorf("second login: status %d, users %d", rec.Code, len(users.users))
+	}
+}
+
+func TestOIDCLoginWithoutProvisioning(t *testing.T) {
+	users := newFakeUserDB(model.User{ID: "frank"})
+	idp, h, sessions := newTestOIDCHandlers(t, users)
+	h.AutoProvision = false
+
+	for _, username := range []string{"erin", "frank"} {
+		idp.Claims["preferred_username"] = username
+		if rec := oidcLogin(t, idp, h); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", username, rec.Code)
+		}
+	}
+	if users.users["erin"] != nil || users.users["frank"].Identity != nil || len(sessions.sessions) != 0 {
+		t.Error("unlinked user was provisioned, linked or logged in")
+	}
+
+	// users linked by an admin may log in
+	users.users["frank"].Identity = &model.Identity{Issuer: idp.Issuer(), Subject: idp.Subject}
+	if rec := oidcLogin(t, idp, h); rec.Code != http.StatusFound || sessions.sessions[0].UserID != "frank" {
+		t.Errorf("linked user: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOIDCLoginDoesNotTakeOverExistingUser(t *testing.T) {
+	users := newFakeUserDB(model.User{ID: "user123", Role: model.RoleAdmin})
+	idp, h, sessions := newTestOIDCHandlers(t, users)
+	idp.Claims["preferred_username"] = "user123"
+
+	if rec := oidcLogin(t, idp, h); rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", rec.Code)
+	}
+	if users.users["user123"].Identity != nil || len(sessions.sessions) != 0 {
+		t.Error("identity was linked to the existing user")
+	}
+}
+
+func TestOIDCLinkConnectsCurrentUser(t *testing.T) {
+	users := newFakeUserDB(model.User{ID: "user123"}, model.User{ID: "grace"})
+	idp, h, sessions := newTestOIDCHandlers(t, users)
+	idp.Claims["preferred_username"] = "someone-else"
+
+	link := func(userID string) *httptest.ResponseRecorder {
+		r := asUser(httptest.NewRequest(http.MethodGet, BasePath+"/oidc/link", nil), userID, model.RoleMember)
+		return oidcFlow(t, idp, h, h.HandleOIDCLink, r)
+	}
+	if rec := link("user123"); rec.Code != http.StatusFound {
+		t.Fatalf("link: status %d: %s", rec.Code, rec.Body)
+	}
+	if identity := users.users["user123"].Identity; identity == nil || identity.Subject != idp.Subject {
+		t.Fatalf("identity %+v", identity)
+	}
+	if len(sessions.sessions) != 0 || users.users["someone-else"] != nil {
+		t.Error("link started a session or provisioned a user")
+	}
+
+	// the identity cannot be moved to another user
+	if rec := link("grace"); rec.Code != http.StatusConflict || users.users["grace"].Identity != nil {
+		t.Errorf("second link: status %d, want 409", rec.Code)
+	}
+
+	// from then on, the identity logs in to the linked user
+	if rec := oidcLogin(t, idp, h); rec.Code != http.StatusFound || sessions.sessions[0].UserID != "user123" {
+		t.Errorf("login: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOIDCCallbackChecksState(t *testing.T) {
+	idp, h, _ := newTestOIDCHandlers(t, newFakeUserDB())
+	idp.Claims["preferred_username"] = "dana"
+
+	start := serve(t, h.HandleOIDCLogin, httptest.NewRequest(http.MethodGet, BasePath+"/oidc/login", nil), nil)
+	code, _, err := idp.Authorize(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, BasePath+"/oidc/callback?code="+code+"&state=forged", nil)
+	for _, cookie := range start.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	if rec := serve(t, h.HandleOIDCCallback, r, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("forged state: status %d, want 400", rec.Code)
+	}
+}
+
+func TestOIDCLoginAsksForTwoFactorCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	users := newFakeUserDB(model.User{ID: "user123", TwoFactor: &model.TwoFactor{Secret: totp.EncodeSecret(secret), Enabled: true}})
+	idp, h, sessions := newTestOIDCHandlers(t, users)
+	users.users["user123"].Identity = &model.Identity{Issuer: idp.Issuer(), Subject: idp.Subject}
+	h.TwoFactor = NewTwoFactorHandlers(users, "Photo Backup", zap.NewNop())
+
+	rec := oidcLogin(t, idp, h)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/?twoFactor=required" {
+		t.Fatalf("callback: status %d, location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if len(sessions.sessions) != 0 {
+		t.Fatal("session started without the second factor")
+	}
+
+	submit := func(code string) *httptest.ResponseRecorder {
+		r := jsonRequest(http.MethodPost, BasePath+"/oidc/2fa", `{"code":"`+code+`"}`)
+		for _, cookie := range rec.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+		return serve(t, h.HandleOIDCTwoFactor, r, nil)
+	}
+	step := totp.Step(time.Now())
+	if res := submit(totp.Code(secret, step+5)); res.Code != http.StatusUnauthorized || len(sessions.sessions) != 0 {
+		t.Errorf("wrong code: status %d, want 401", res.Code)
+	}
+	if res := submit(totp.Code(secret, step)); res.Code != http.StatusOK || len(sessions.sessions) != 1 || sessions.sessions[0].UserID != "user123" {
+		t.Errorf("code: status %d: %s", res.Code, res.Body)
+	}
+
+	// without the pending login, a code alone does not log in
+	r := jsonRequest(http.MethodPost, BasePath+"/oidc/2fa", `{"code":"`+totp.Code(secret, step+1)+`"}`)
+	if res := serve(t, h.HandleOIDCTwoFactor, r, nil); res.Code != http.StatusBadRequest {
+		t.Errorf("no pending login: status %d, want 400", res.Code)
+	}
+}
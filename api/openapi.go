@@ -0,0 +1,382 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Operation describes one route of the API. The OpenAPI document is
+// generated from the Operations table, CheckRoutes makes sure the table and
+// the router agree.
+type Operation struct {
+	Method     string
+	Path       string // relative to BasePath, in gorilla/mux template syntax
+	Summary    string
+	Tag        string
+	Public     bool
+	Permission string              // permission the route requires, empty if only sessions may call it
+	Params     []Param             // query parameters, path parameters are taken from Path
+	Body       interface{}         // request body type, nil for none
+	Multipart  bool                // the body is a multipart form with "file" fields
+	Responses  map[int]interface{} // response type by status code, fileBody or eventStream for non-JSON content
+}
+
+type Param struct {
+	Name        string
+	Type        string // string, integer, number or boolean
+	Description string
+	Required    bool
+}
+
+// fileBody marks responses that stream a photo rendition.
+type fileBody struct{}
+
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Servers    []OpenAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+	Security    *[]map[string][]string      `json:"security,omitempty"` // empty for public operations
+	Permission  string                      `json:"x-permission,omitempty"`
+}
+
+type OpenAPIParameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*Schema           `json:"schemas"`
+	SecuritySchemes map[string]map[string]string `json:"securitySchemes"`
+}
+
+// Schema is the subset of the OpenAPI 3.0 schema object the generator
+// emits.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // false or a *Schema
+}
+
+const schemaRefPrefix = "#/components/schemas/"
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument *OpenAPIDocument
+)
+
+// OpenAPISpec returns the OpenAPI document generated from Operations.
+func OpenAPISpec() *OpenAPIDocument {
+	openAPIOnce.Do(func() {
+		openAPIDocument = buildOpenAPI(Operations)
+	})
+	return openAPIDocument
+}
+
+// OPENAPI
+func HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, OpenAPISpec())
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(?::[^}]*)?\}`)
+
+func buildOpenAPI(operations []Operation) *OpenAPIDocument {
+	schemas := schemaGenerator{schemas: map[string]*Schema{}}
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "Photo Backup API", Version: strings.TrimPrefix(BasePath, "/api/")},
+		Servers: []OpenAPIServer{{URL: BasePath}},
+		Paths:   map[string]map[string]*OpenAPIOperation{},
+		Components: OpenAPIComponents{
+			Schemas: schemas.schemas,
+			SecuritySchemes: map[string]map[string]string{
+				"session": {"type": "apiKey", "in": "cookie", "name": sessionName},
+				"apiKey":  {"type": "http", "scheme": "bearer"},
+			},
+		},
+		Security: []map[string][]string{{"session": {}}},
+	}
+
+	for _, op := range operations {
+		item := &OpenAPIOperation{
+			OperationID: operationID(op),
+			Summary:     op.Summary,
+			Responses:   map[string]*OpenAPIResponse{},
+		}
+		if op.Tag != "" {
+			item.Tags = []string{op.Tag}
+		}
+		if op.Public {
+			item.Security = &[]map[string][]string{}
+		}
+		if op.Permission != "" {
+			item.Permission = op.Permission
+			item.Security = &[]map[string][]string{{"session": {}}, {"apiKey": {}}}
+		}
+
+		for _, match := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+			item.Parameters = append(item.Parameters, OpenAPIParameter{
+				Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"},
+			})
+		}
+		for _, param := range op.Params {
+			item.Parameters = append(item.Parameters, OpenAPIParameter{
+				Name: param.Name, In: "query", Description: param.Description, Required: param.Required,
+				Schema: &Schema{Type: param.Type},
+			})
+		}
+
+		switch {
+		case op.Multipart:
+			item.RequestBody = &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+				"multipart/form-data": {Schema: &Schema{
+					Type: "object",
+					Properties: map[string]*Schema{
+						"file": {Type: "array", Items: &Schema{Type: "string", Format: "binary"}},
+					},
+					Required: []string{"file"},
+				}},
+			}}
+		case op.Body != nil:
+			item.RequestBody = &OpenAPIRequestBody{Required: true, Content: map[string]OpenAPIMediaType{
+				"application/json": {Schema: schemas.schemaFor(reflect.TypeOf(op.Body))},
+			}}
+		}
+
+		for status, body := range op.Responses {
+			item.Responses[fmt.Sprint(status)] = schemas.response(status, body)
+		}
+		item.Responses["default"] = schemas.response(0, ErrorResponse{})
+
+		path := pathParamPattern.ReplaceAllString(op.Path, "{$1}")
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*OpenAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = item
+	}
+	return doc
+}
+
+// operationID turns e.g. GET /photos/{id}/similar into getPhotosIdSimilar.
+func operationID(op Operation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return !isAlphaNumeric(r) }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func isAlphaNumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+type schemaGenerator struct {
+	schemas map[string]*Schema
+}
+
+func (g *schemaGenerator) response(status int, body interface{}) *OpenAPIResponse {
+	description := http.StatusText(status)
+	if status == 0 {
+		description = "Error"
+	}
+	response := &OpenAPIResponse{Description: description}
+	switch body.(type) {
+	case nil:
+	case fileBody:
+		response.Content = map[string]OpenAPIMediaType{
+			"image/*": {Schema: &Schema{Type: "string", Format: "binary"}},
+		}
+	case eventStream:
+		response.Content = map[string]OpenAPIMediaType{
+			"text/event-stream": {Schema: &Schema{Type: "string"}},
+		}
+	default:
+		response.Content = map[string]OpenAPIMediaType{
+			"application/json": {Schema: g.schemaFor(reflect.TypeOf(body))},
+		}
+	}
+	return response
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor reflects the JSON schema of a Go type, following encoding/json
+// rules for field names, omitempty and embedded structs. Named structs are
+// added to the components and referenced.
+func (g *schemaGenerator) schemaFor(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &Schema{} // any JSON value
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := g.schemaFor(t.Elem())
+		if schema.Ref != "" {
+			return schema
+		}
+		nullable := *schema
+		nullable.Nullable = true
+		return &nullable
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = &Schema{} // placeholder for recursive types
+			g.schemas[t.Name()] = g.structSchema(t)
+		}
+		return &Schema{Ref: schemaRefPrefix + t.Name()}
+	default:
+		return &Schema{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+	g.addFields(schema, t)
+	sort.Strings(schema.Required)
+	return schema
+}
+
+func (g *schemaGenerator) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addFields(schema, field.Type)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = g.schemaFor(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+// CheckRoutes reports routes registered on the router that are missing from
+// Operations, and operations that no route serves. CORS preflight requests
+// are answered by the middleware and don't need to be documented.
+func CheckRoutes(router *mux.Router) error {
+	documented := map[string]bool{}
+	for _, op := range Operations {
+		documented[op.Method+" "+BasePath+op.Path] = true
+	}
+
+	var missing []string
+	registered := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			key := method + " " + path
+			registered[key] = true
+			if !documented[key] {
+				missing = append(missing, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var unserved []string
+	for key := range documented {
+		if !registered[key] {
+			unserved = append(unserved, key)
+		}
+	}
+	sort.Strings(unserved)
+
+	if len(missing) > 0 || len(unserved) > 0 {
+		return fmt.Errorf("OpenAPI spec out of sync with router: undocumented routes %v, operations without route %v", missing, unserved)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package api
+
+import "net/http"
+
+var photoQueryParams = []Param{
+	{Name: "limit", Type: "integer", Description: "Page size, 50 by default, at most 500"},
+	{Name: "cursor", Type: "string", Description: "nextCursor of the previous page"},
+	{Name: "sort", Type: "string", Description: "taken_desc (default), taken_asc, size_desc or size_asc"},
+	{Name: "q", Type: "string", Description: "Full-text search over captions and tags"},
+	{Name: "tags", Type: "string", Description: "Comma separated tags that must all be present"},
+	{Name: "from", Type: "string", Description: "Taken at or after, RFC 3339 or YYYY-MM-DD"},
+	{Name: "to", Type: "string", Description: "Taken at or before, RFC 3339 or YYYY-MM-DD"},
+	{Name: "latMin", Type: "number"},
+	{Name: "latMax", Type: "number"},
+	{Name: "longMin", Type: "number"},
+	{Name: "longMax", Type: "number"},
+	{Name: "hasLocation", Type: "boolean"},
+	{Name: "contentType", Type: "string"},
+	{Name: "camera", Type: "string", Description: "Part of the camera make and model, case insensitive"},
+	{Name: "minSize", Type: "integer"},
+	{Name: "maxSize", Type: "integer"},
+	{Name: "favorite", Type: "boolean"},
+	{Name: "minRating", Type: "integer"},
+	{Name: "archived", Type: "string", Description: "exclude, include or only"},
+	{Name: "color", Type: "string", Description: "Hex color such as #3366ff"},
+	{Name: "colorDelta", Type: "number", Description: "Maximum CIELAB distance to color, 20 by default"},
+	{Name: "device", Type: "string", Description: "ID of the device that uploaded the photos"},
+}
+
+// Operations lists every route of the API. Routes registered in main.go
+// must be added here, the server refuses to start otherwise.
+var Operations = []Operation{
+	// auth
+	{Method: http.MethodPost, Path: "/login", Summary: "Log in with the password", Tag: "auth", Public: true,
+		Body: LoginRequest{}, Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodGet, Path: "/oidc/login", Summary: "Log in with the OpenID Connect provider, redirects to it", Tag: "auth", Public: true,
+		Responses: map[int]interface{}{http.StatusFound: nil}},
+	{Method: http.MethodGet, Path: "/oidc/callback", Summary: "Where the OpenID Connect provider redirects back to, starts a session", Tag: "auth", Public: true,
+		Params: []Param{
+			{Name: "code", Type: "string", Description: "Authorization code"},
+			{Name: "state", Type: "string", Description: "State of the login, checked against the flow cookie"},
+			{Name: "error", Type: "string", Description: "Set by the provider if the login failed"},
+		},
+		Responses: map[int]interface{}{http.StatusFound: nil}},
+	{Method: http.MethodPost, Path: "/oidc/2fa", Summary: "Finish a login with the OpenID Connect provider with a two-factor code, starts a session", Tag: "auth", Public: true,
+		Body: TwoFactorCodeRequest{}, Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodGet, Path: "/oidc/link", Summary: "Link an identity of the OpenID Connect provider to the current user, redirects to it", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusFound: nil}},
+	{Method: http.MethodGet, Path: "/openapi.json", Summary: "This document", Tag: "meta", Public: true,
+		Responses: map[int]interface{}{http.StatusOK: map[string]interface{}{}}},
+	{Method: http.MethodPost, Path: "/logout", Summary: "End the current session", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodGet, Path: "/sessions", Summary: "List active sessions with their device, IP and last activity", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusOK: SessionListResponse{}}},
+	{Method: http.MethodDelete, Path: "/sessions", Summary: "Revoke all other sessions", Tag: "auth",
+		Params:    []Param{{Name: "includeCurrent", Type: "boolean", Description: "Revoke the current session as well"}},
+		Responses: map[int]interface{}{http.StatusOK: RevokeSessionsResponse{}}},
+	{Method: http.MethodDelete, Path: "/sessions/{id}", Summary: "Revoke a session", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodPost, Path: "/api-keys", Summary: "Create an API key, the response contains the key", Tag: "auth",
+		Body: CreateAPIKeyRequest{}, Responses: map[int]interface{}{http.StatusCreated: APIKeyResponse{}}},
+	{Method: http.MethodGet, Path: "/api-keys", Summary: "List API keys with their scopes and last use", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusOK: APIKeyListResponse{}}},
+	{Method: http.MethodDelete, Path: "/api-keys/{id}", Summary: "Revoke an API key", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodGet, Path: "/2fa", Summary: "Two-factor authentication status", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusOK: TwoFactorStatusResponse{}}},
+	{Method: http.MethodPost, Path: "/2fa/enroll", Summary: "Start enrolling in two-factor authentication, the response contains the TOTP secret", Tag: "auth",
+		Responses: map[int]interface{}{http.StatusOK: TwoFactorEnrollResponse{}}},
+	{Method: http.MethodPost, Path: "/2fa/confirm", Summary: "Enable two-factor authentication with a first code, the response contains the recovery codes", Tag: "auth",
+		Body: TwoFactorCodeRequest{}, Responses: map[int]interface{}{http.StatusOK: RecoveryCodesResponse{}}},
+	{Method: http.MethodPost, Path: "/2fa/recovery-codes", Summary: "Replace the recovery codes", Tag: "auth",
+		Body: TwoFactorCodeRequest{}, Responses: map[int]interface{}{http.StatusOK: RecoveryCodesResponse{}}},
+	{Method: http.MethodDelete, Path: "/2fa", Summary: "Disable two-factor authentication", Tag: "auth",
+		Body: TwoFactorCodeRequest{}, Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+
+	// photos
+	{Method: http.MethodGet, Path: "/photos", Summary: "Query photos, without archived ones by default", Tag: "photos", Permission: PermPhotosRead,
+		Params: photoQueryParams, Responses: map[int]interface{}{http.StatusOK: PhotoListResponse{}}},
+	{Method: http.MethodGet, Path: "/photos/search", Summary: "Query photos, including archived ones by default", Tag: "photos", Permission: PermPhotosRead,
+		Params: photoQueryParams, Responses: map[int]interface{}{http.StatusOK: PhotoListResponse{}}},
+	{Method: http.MethodPost, Path: "/photos", Summary: "Upload photos", Tag: "photos", Permission: PermPhotosWrite, Multipart: true,
+		Responses: map[int]interface{}{http.StatusOK: UploadResponse{}, http.StatusMultiStatus: UploadResponse{}}},
+	{Method: http.MethodPost, Path: "/photos/check", Summary: "Check which files are already stored before uploading them", Tag: "photos", Permission: PermPhotosRead,
+		Body: CheckPhotosRequest{}, Responses: map[int]interface{}{http.StatusOK: CheckPhotosResponse{}}},
+	{Method: http.MethodDelete, Path: "/photos", Summary: "Delete a photo", Tag: "photos", Permission: PermPhotosDelete,
+		Params:    []Param{{Name: "id", Type: "string", Required: true}},
+		Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodDelete, Path: "/photos/bulk-delete", Summary: "Delete many photos", Tag: "photos", Permission: PermPhotosDelete,
+		Body: BulkDeleteRequest{}, Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodPost, Path: "/photos/bulk-update", Summary: "Update flags and ratings of many photos", Tag: "photos", Permission: PermPhotosWrite,
+		Body: BulkUpdateRequest{}, Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodPost, Path: "/photos/bulk-tags", Summary: "Add and remove tags on many photos", Tag: "tags", Permission: PermPhotosWrite,
+		Body: BulkTagsRequest{}, Responses: map[int]interface{}{http.StatusOK: BulkTagsResponse{}}},
+	{Method: http.MethodPatch, Path: "/photos/{id}", Summary: "Update a photo", Tag: "photos", Permission: PermPhotosWrite,
+		Body: UpdatePhotoRequest{}, Responses: map[int]interface{}{http.StatusOK: PhotoResponse{}}},
+	{Method: http.MethodGet, Path: "/photos/duplicates", Summary: "Group near-duplicate photos", Tag: "similarity", Permission: PermPhotosRead,
+		Params: []Param{
+			{Name: "distance", Type: "integer", Description: "Maximum differing hash bits, 6 by default, at most 16"},
+			{Name: "burstWindow", Type: "integer", Description: "Only group photos taken at most this many seconds apart"},
+		},
+		Responses: map[int]interface{}{http.StatusOK: DuplicateGroupListResponse{}}},
+	{Method: http.MethodGet, Path: "/photos/{id}/similar", Summary: "Find visually similar photos", Tag: "similarity", Permission: PermPhotosRead,
+		Params: []Param{
+			{Name: "limit", Type: "integer", Description: "20 by default"},
+			{Name: "distance", Type: "integer", Description: "Maximum differing hash bits, 12 by default, at most 20"},
+		},
+		Responses: map[int]interface{}{http.StatusOK: SimilarPhotoListResponse{}}},
+	{Method: http.MethodGet, Path: "/tags", Summary: "Autocomplete tags", Tag: "tags", Permission: PermPhotosRead,
+		Params: []Param{
+			{Name: "prefix", Type: "string"},
+			{Name: "limit", Type: "integer", Description: "20 by default, at most 100"},
+		},
+		Responses: map[int]interface{}{http.StatusOK: TagListResponse{}}},
+
+	{Method: http.MethodGet, Path: "/usage", Summary: "Storage used by originals and renditions, by content type and year", Tag: "usage", Permission: PermPhotosRead,
+		Responses: map[int]interface{}{http.StatusOK: UsageResponse{}}},
+
+	// sync
+	{Method: http.MethodGet, Path: "/sync/changes", Summary: "List photo additions, updates and deletions in change order", Tag: "sync", Permission: PermPhotosRead,
+		Params: []Param{
+			{Name: "since", Type: "string", Description: "since of the previous response; omit for a full sync"},
+			{Name: "limit", Type: "integer", Description: "200 by default, at most 1000"},
+		},
+		Responses: map[int]interface{}{http.StatusOK: ChangeListResponse{}}},
+
+	// files
+	{Method: http.MethodGet, Path: "/files/{id}/{rendition}", Summary: "Download a rendition (original or thumbnail)", Tag: "files", Permission: PermPhotosRead,
+		Responses: map[int]interface{}{http.StatusOK: fileBody{}, http.StatusPartialContent: fileBody{}, http.StatusNotModified: nil}},
+	{Method: http.MethodHead, Path: "/files/{id}/{rendition}", Summary: "Rendition headers", Tag: "files",
+		Responses: map[int]interface{}{http.StatusOK: nil}},
+
+	// shares
+	{Method: http.MethodPost, Path: "/shares", Summary: "Create a share link", Tag: "shares", Permission: PermLibraryManage,
+		Body: CreateShareRequest{}, Responses: map[int]interface{}{http.StatusCreated: ShareResponse{}}},
+	{Method: http.MethodGet, Path: "/shares", Summary: "List share links", Tag: "shares", Permission: PermLibraryManage,
+		Responses: map[int]interface{}{http.StatusOK: ShareListResponse{}}},
+	{Method: http.MethodDelete, Path: "/shares/{id}", Summary: "Revoke a share link", Tag: "shares", Permission: PermLibraryManage,
+		Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	// devices
+	{Method: http.MethodPost, Path: "/devices", Summary: "Register a device, the response contains its token", Tag: "devices", Permission: PermLibraryManage,
+		Body: DeviceRequest{}, Responses: map[int]interface{}{http.StatusCreated: DeviceResponse{}}},
+	{Method: http.MethodGet, Path: "/devices", Summary: "List devices with their last activity and uploads", Tag: "devices", Permission: PermLibraryManage,
+		Responses: map[int]interface{}{http.StatusOK: DeviceListResponse{}}},
+	{Method: http.MethodPatch, Path: "/devices/{id}", Summary: "Rename a device", Tag: "devices", Permission: PermLibraryManage,
+		Body: DeviceRequest{}, Responses: map[int]interface{}{http.StatusOK: DeviceResponse{}}},
+	{Method: http.MethodDelete, Path: "/devices/{id}", Summary: "Delete a device and revoke its token", Tag: "devices", Permission: PermLibraryManage,
+		Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+
+	// events
+	{Method: http.MethodGet, Path: "/events", Summary: "Stream library events as Server-Sent Events", Tag: "events", Permission: PermPhotosRead,
+		Params: []Param{
+			{Name: "lastEventId", Type: "string", Description: "Resume after this event, instead of the Last-Event-ID header"},
+		},
+		Responses: map[int]interface{}{http.StatusOK: eventStream{}}},
+
+	// webhooks
+	{Method: http.MethodPost, Path: "/webhooks", Summary: "Create a webhook, the response contains its signing secret", Tag: "webhooks", Permission: PermLibraryManage,
+		Body: CreateWebhookRequest{}, Responses: map[int]interface{}{http.StatusCreated: WebhookResponse{}}},
+	{Method: http.MethodGet, Path: "/webhooks", Summary: "List webhooks", Tag: "webhooks", Permission: PermLibraryManage,
+		Responses: map[int]interface{}{http.StatusOK: WebhookListResponse{}}},
+	{Method: http.MethodPatch, Path: "/webhooks/{id}", Summary: "Update a webhook", Tag: "webhooks", Permission: PermLibraryManage,
+		Body: UpdateWebhookRequest{}, Responses: map[int]interface{}{http.StatusOK: WebhookResponse{}}},
+	{Method: http.MethodDelete, Path: "/webhooks/{id}", Summary: "Delete a webhook and its delivery log", Tag: "webhooks", Permission: PermLibraryManage,
+		Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodGet, Path: "/webhooks/{id}/deliveries", Summary: "List deliveries of a webhook, newest first", Tag: "webhooks", Permission: PermLibraryManage,
+		Params: []Param{
+			{Name: "limit", Type: "integer", Description: "20 by default"},
+			{Name: "cursor", Type: "string", Description: "nextCursor of the previous page"},
+		},
+		Responses: map[int]interface{}{http.StatusOK: WebhookDeliveryListResponse{}}},
+
+	// users
+	{Method: http.MethodGet, Path: "/users", Summary: "List users with their roles", Tag: "users", Permission: PermUsersManage,
+		Responses: map[int]interface{}{http.StatusOK: UserListResponse{}}},
+	{Method: http.MethodPut, Path: "/users/{id}/role", Summary: "Assign a role to a user", Tag: "users", Permission: PermUsersManage,
+		Body: SetRoleRequest{}, Responses: map[int]interface{}{http.StatusOK: UserResponse{}}},
+
+	// public
+	{Method: http.MethodGet, Path: "/s/{token}", Summary: "List the photos of a share link", Tag: "public", Public: true,
+		Responses: map[int]interface{}{http.StatusOK: SharedPhotoListResponse{}}},
+	{Method: http.MethodPost, Path: "/s/{token}/unlock", Summary: "Unlock a password protected share link", Tag: "public", Public: true,
+		Body: UnlockShareRequest{}, Responses: map[int]interface{}{http.StatusOK: MessageResponse{}}},
+	{Method: http.MethodGet, Path: "/s/{token}/files/{id}/{rendition}", Summary: "Download a shared rendition", Tag: "public", Public: true,
+		Responses: map[int]interface{}{http.StatusOK: fileBody{}, http.StatusPartialContent: fileBody{}, http.StatusNotModified: nil}},
+	{Method: http.MethodHead, Path: "/s/{token}/files/{id}/{rendition}", Summary: "Shared rendition headers", Tag: "public", Public: true,
+		Responses: map[int]interface{}{http.StatusOK: nil}},
+}
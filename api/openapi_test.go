@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"photo-backup/model"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+func passthrough(next http.Handler) http.Handler { return next }
+
+func TestRoutesAreDocumented(t *testing.T) {
+	r := NewRouter(Routes{
+		Photos:      &PhotoHandlers{},
+		TwoFactor:   &TwoFactorHandlers{},
+		Shares:      &ShareHandlers{},
+		Webhooks:    &WebhookHandlers{},
+		Events:      &EventHandlers{},
+		Devices:     &DeviceHandlers{},
+		Sessions:    &SessionHandlers{},
+		APIKeys:     &APIKeyHandlers{},
+		Users:       &UserHandlers{},
+		OIDC:        &OIDCHandlers{},
+		Auth:        passthrough,
+		Device:      passthrough,
+		LoginLimit:  passthrough,
+		UploadLimit: passthrough,
+		APILimit:    passthrough,
+	})
+	if err := CheckRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newSpecRouter builds the router on in-memory stores, with every
+// protected request made by the admin alice over a session.
+func newSpecRouter(t *testing.T, photos *fakePhotoDB) *mux.Router {
+	logger := zap.NewNop()
+	users := newFakeUserDB(model.User{ID: "alice", Role: model.RoleAdmin, CreatedAt: time.Now()})
+	sessions := &fakeSessionDB{}
+	session, _ := sessions.SaveSession(context.Background(), model.Session{UserID: "alice", CreatedAt: time.Now(), LastSeenAt: time.Now()})
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), sessionKey, session)
+			next.ServeHTTP(w, asUser(r.WithContext(ctx), "alice", model.RoleAdmin))
+		})
+	}
+
+	h := newTestPhotoHandlers(photos)
+	h.Sessions = sessions
+	h.Usage = &fakeUsageDB{}
+	h.TwoFactor = NewTwoFactorHandlers(users, "Photo Backup", logger)
+	r := NewRouter(Routes{
+		Photos:      h,
+		TwoFactor:   h.TwoFactor,
+		Shares:      NewShareHandlers(h, &fakeShareDB{}, logger),
+		Webhooks:    NewWebhookHandlers(&fakeWebhookDB{}, logger),
+		Events:      &EventHandlers{},
+		Devices:     NewDeviceHandlers(&fakeDeviceDB{}, photos, logger),
+		Sessions:    NewSessionHandlers(sessions, logger),
+		APIKeys:     NewAPIKeyHandlers(&fakeAPIKeyDB{}, logger),
+		Users:       NewUserHandlers(users, logger),
+		OIDC:        NewOIDCHandlers(nil, users, sessions, logger),
+		Auth:        auth,
+		Device:      passthrough,
+		LoginLimit:  passthrough,
+		UploadLimit: passthrough,
+		APILimit:    passthrough,
+	})
+	r.Use(validateResponses(func(op Operation, status int, problems []string) {
+		t.Errorf("%s %s returned %d not matching the spec: %s", op.Method, op.Path, status, strings.Join(problems, "; "))
+	}))
+	return r
+}
+
+func TestResponsesMatchSpec(t *testing.T) {
+	photo := model.PhotoDB{
+		ID:          primitive.NewObjectID(),
+		OwnerID:     "alice",
+		FilePath:    "photo.jpg",
+		Size:        1000,
+		ContentType: "image/jpeg",
+		Caption:     "beach",
+		Tags:        []string{"holiday"},
+		TakenAt:     time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC),
+		ImageFeatures: model.ImageFeatures{
+			Hash:    strings.Repeat("ab", 32),
+			Width:   640,
+			Height:  480,
+			Palette: []model.PaletteColor{{Hex: "#336699", L: 40, A: -5, B: -30, Weight: 1}},
+		},
+		LonLat: &model.GeoPoint{Type: "Point", Coordinates: []float64{13.4, 52.5}},
+	}
+	id := photo.ID.Hex()
+	router := newSpecRouter(t, newFakePhotoDB(photo))
+
+	requests := []struct {
+		method, target, body string
+		status               int
+	}{
+		{http.MethodGet, "/openapi.json", "", http.StatusOK},
+		{http.MethodPost, "/login", `{"password":"wrong"}`, http.StatusUnauthorized},
+		{http.MethodGet, "/oidc/login", "", http.StatusNotFound},
+		{http.MethodGet, "/photos/search", "", http.StatusOK},
+		{http.MethodPatch, "/photos/" + id, `{"caption":"sunset","favorite":true}`, http.StatusOK},
+		{http.MethodPatch, "/photos/000000000000000000000000", `{"caption":"sunset"}`, http.StatusNotFound},
+		{http.MethodGet, "/photos/duplicates", "", http.StatusOK},
+		{http.MethodPost, "/photos/check", `{"files":[{"hash":"` + photo.Hash + `","size":1000},{"hash":"` + strings.Repeat("cd", 32) + `"}]}`, http.StatusOK},
+		{http.MethodGet, "/tags", "", http.StatusOK},
+		{http.MethodGet, "/sync/changes", "", http.StatusOK},
+		{http.MethodGet, "/usage", "", http.StatusOK},
+		{http.MethodPost, "/shares", `{"photoIds":["` + id + `"],"password":"secret"}`, http.StatusCreated},
+		{http.MethodGet, "/shares", "", http.StatusOK},
+		{http.MethodPost, "/devices", `{"name":"phone"}`, http.StatusCreated},
+		{http.MethodGet, "/devices", "", http.StatusOK},
+		{http.MethodPost, "/webhooks", `{"url":"https://93.184.216.34/hook","events":["photo.uploaded"]}`, http.StatusCreated},
+		{http.MethodPost, "/webhooks", `{"url":"http://169.254.169.254/latest/meta-data"}`, http.StatusBadRequest},
+		{http.MethodGet, "/webhooks", "", http.StatusOK},
+		{http.MethodGet, "/sessions", "", http.StatusOK},
+		{http.MethodPost, "/api-keys", `{"name":"backup","scopes":["photos:read"]}`, http.StatusCreated},
+		{http.MethodGet, "/api-keys", "", http.StatusOK},
+		{http.MethodGet, "/2fa", "", http.StatusOK},
+		{http.MethodPost, "/2fa/enroll", "", http.StatusOK},
+		{http.MethodGet, "/users", "", http.StatusOK},
+		{http.MethodPut, "/users/bob/role", `{"role":"viewer"}`, http.StatusOK},
+		{http.MethodPut, "/users/alice/role", `{"role":"viewer"}`, http.StatusConflict},
+		{http.MethodGet, "/nothing", "", http.StatusNotFound},
+	}
+	for _, req := range requests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, jsonRequest(req.method, BasePath+req.target, req.body))
+		if rec.Code != req.status {
+			t.Errorf("%s %s: got %d, want %d: %s", req.method, req.target, rec.Code, req.status, rec.Body)
+		}
+	}
+
+	// the unauthenticated share routes
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, jsonRequest(http.MethodGet, BasePath+"/shares", ""))
+	var shares ShareListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&shares); err != nil || len(shares.Shares) != 1 {
+		t.Fatalf("listing shares: %v", err)
+	}
+	token := shares.Shares[0].Token
+	for _, req := range []struct {
+		method, target, body string
+		status               int
+	}{
+		{http.MethodGet, "/s/" + token, "", http.StatusUnauthorized},
+		{http.MethodPost, "/s/" + token + "/unlock", `{"password":"wrong"}`, http.StatusUnauthorized},
+		{http.MethodPost, "/s/" + token + "/unlock", `{"password":"secret"}`, http.StatusOK},
+		{http.MethodGet, "/s/unknown", "", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, jsonRequest(req.method, BasePath+req.target, req.body))
+		if rec.Code != req.status {
+			t.Errorf("%s %s: got %d, want %d: %s", req.method, req.target, rec.Code, req.status, rec.Body)
+		}
+	}
+}
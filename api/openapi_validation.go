@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ResponseValidationMiddleware checks JSON responses against the schema
+// declared in Operations and logs every difference, so drift between the
+// handlers and the spec shows up while developing and in CI. It buffers
+// response bodies and is meant to be enabled with OPENAPI_VALIDATE=true
+// outside of production.
+func ResponseValidationMiddleware(logger *zap.Logger) func(http.Handler) http.Handler {
+	return validateResponses(func(op Operation, status int, problems []string) {
+		logger.Warn("response does not match the OpenAPI spec",
+			zap.String("operation", operationID(op)),
+			zap.Int("status", status),
+			zap.Strings("problems", problems),
+		)
+	})
+}
+
+// validateResponses passes the differences of every JSON response from its
+// schema to report, which tests use to fail on drift.
+func validateResponses(report func(op Operation, status int, problems []string)) func(http.Handler) http.Handler {
+	operations := map[string]Operation{}
+	for _, op := range Operations {
+		operations[op.Method+" "+BasePath+op.Path] = op
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			path, err := route.GetPathTemplate()
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			op, ok := operations[r.Method+" "+path]
+			if _, stream := op.Responses[http.StatusOK].(eventStream); !ok || stream {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			if problems := validateResponse(op, recorder); len(problems) > 0 {
+				report(op, recorder.status, problems)
+			}
+		})
+	}
+}
+
+// responseRecorder passes the response through while keeping a copy of the
+// body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func validateResponse(op Operation, recorder *responseRecorder) []string {
+	spec := OpenAPISpec()
+	path := pathParamPattern.ReplaceAllString(op.Path, "{$1}")
+	declared := spec.Paths[path][strings.ToLower(op.Method)]
+
+	response, ok := declared.Responses[fmt.Sprint(recorder.status)]
+	if !ok {
+		if recorder.status < 400 {
+			return []string{fmt.Sprintf("undeclared status %d", recorder.status)}
+		}
+		response = declared.Responses["default"]
+	}
+
+	contentType := recorder.Header().Get("Content-Type")
+	media, ok := response.Content["application/json"]
+	if !ok {
+		if strings.HasPrefix(contentType, "application/json") {
+			return []string{"unexpected JSON body"}
+		}
+		return nil
+	}
+	if !strings.HasPrefix(contentType, "application/json") {
+		return []string{"expected a JSON body, got " + contentType}
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(recorder.body.Bytes(), &body); err != nil {
+		return []string{"invalid JSON body: " + err.Error()}
+	}
+	var problems []string
+	validateValue(spec.Components.Schemas, media.Schema, body, "$", &problems)
+	return problems
+}
+
+// validateValue checks a decoded JSON value against a generated schema.
+// Objects of named types don't allow properties beyond the declared ones.
+func validateValue(schemas map[string]*Schema, schema *Schema, value interface{}, at string, problems *[]string) {
+	if schema.Ref != "" {
+		schema = schemas[strings.TrimPrefix(schema.Ref, schemaRefPrefix)]
+	}
+	if value == nil {
+		if !schema.Nullable && schema.Type != "" {
+			*problems = append(*problems, at+": null, expected "+schema.Type)
+		}
+		return
+	}
+
+	fail := func() {
+		*problems = append(*problems, fmt.Sprintf("%s: expected %s, got %T", at, schema.Type, value))
+	}
+	switch schema.Type {
+	case "string":
+		if _, ok := value.(string); !ok {
+			fail()
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail()
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			fail()
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			fail()
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			fail()
+			return
+		}
+		for i, item := range items {
+			validateValue(schemas, schema.Items, item, fmt.Sprintf("%s[%d]", at, i), problems)
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			fail()
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				*problems = append(*problems, at+"."+name+": missing")
+			}
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := schema.Properties[key]; ok {
+				validateValue(schemas, property, object[key], at+"."+key, problems)
+				continue
+			}
+			switch additional := schema.AdditionalProperties.(type) {
+			case bool:
+				if !additional {
+					*problems = append(*problems, at+"."+key+": not declared")
+				}
+			case *Schema:
+				validateValue(schemas, additional, object[key], at+"."+key, problems)
+			}
+		}
+	}
+}
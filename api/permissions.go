@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"photo-backup/events"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"slices"
+)
+
+// Permissions are what routes require. A request has the permissions of
+// the user's role, narrowed down to the scopes of its API key if it has one.
+const (
+	PermPhotosRead    = "photos:read"
+	PermPhotosWrite   = "photos:write"   // upload and edit
+	PermPhotosDelete  = "photos:delete"  // delete
+	PermLibraryManage = "library:manage" // shares, devices and webhooks
+	PermUsersManage   = "users:manage"   // role assignments
+)
+
+var rolePermissions = map[string][]string{
+	model.RoleAdmin:  {PermPhotosRead, PermPhotosWrite, PermPhotosDelete, PermLibraryManage, PermUsersManage},
+	model.RoleMember: {PermPhotosRead, PermPhotosWrite, PermPhotosDelete, PermLibraryManage},
+	model.RoleViewer: {PermPhotosRead},
+}
+
+// scopePermissions lists what each API key scope grants. The admin scope
+// grants everything the key owner's role allows.
+var scopePermissions = map[string][]string{
+	ScopePhotosRead:   {PermPhotosRead},
+	ScopePhotosWrite:  {PermPhotosWrite},
+	ScopePhotosDelete: {PermPhotosDelete},
+	ScopeAdmin:        {PermPhotosRead, PermPhotosWrite, PermPhotosDelete, PermLibraryManage, PermUsersManage},
+}
+
+const roleKey contextKey = "role"
+
+// RoleFromContext returns the role of the user authenticated by
+// AuthMiddleware.
+func RoleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(roleKey).(string)
+	return role
+}
+
+// HasPermission reports whether the request's role, and its API key if it
+// has one, allow the permission.
+func HasPermission(ctx context.Context, permission string) bool {
+	if !slices.Contains(rolePermissions[RoleFromContext(ctx)], permission) {
+		return false
+	}
+	key := APIKeyFromContext(ctx)
+	if key == nil {
+		return true
+	}
+	for _, scope := range key.Scopes {
+		if slices.Contains(scopePermissions[scope], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission rejects requests without the permission.
+func RequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !HasPermission(ctx, permission) {
+			if key := APIKeyFromContext(ctx); key != nil && slices.Contains(rolePermissions[RoleFromContext(ctx)], permission) {
+				writeError(w, http.StatusForbidden, CodeForbidden, "API key lacks a scope granting "+permission)
+				return
+			}
+			writeError(w, http.StatusForbidden, CodeForbidden, "Your role does not allow "+permission)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireSession rejects requests with an API key, for routes that manage
+// the account's credentials.
+func RequireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if APIKeyFromContext(r.Context()) != nil {
+			writeError(w, http.StatusForbidden, CodeForbidden, "Not available with an API key, log in instead")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// roleAllowsScope reports whether the role allows everything the scope
+// grants. The admin scope always fits, as keys never exceed their owner's
+// role.
+func roleAllowsScope(role string, scope string) bool {
+	if scope == ScopeAdmin {
+		return true
+	}
+	for _, permission := range scopePermissions[scope] {
+		if !slices.Contains(rolePermissions[role], permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanReceiveEvent returns the check of webhooks.Dispatcher: the owner of a
+// webhook must still be allowed to manage webhooks and to see the photo
+// the event is about.
+func CanReceiveEvent(users storage.UserDB) func(ctx context.Context, userID string, event events.Event) bool {
+	return func(ctx context.Context, userID string, event events.Event) bool {
+		user, err := users.GetUser(ctx, userID)
+		if err != nil {
+			return false
+		}
+		role := user.EffectiveRole()
+		ctx = context.WithValue(context.WithValue(ctx, userIDKey, userID), roleKey, role)
+		return slices.Contains(rolePermissions[role], PermLibraryManage) && canView(ctx, &model.PhotoDB{OwnerID: event.OwnerID})
+	}
+}
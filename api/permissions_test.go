@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+	"photo-backup/events"
+	"photo-backup/model"
+	"testing"
+)
+
+func TestCanReceiveEvent(t *testing.T) {
+	canReceive := CanReceiveEvent(newFakeUserDB(
+		model.User{ID: "alice"},
+		model.User{ID: "carol", Role: model.RoleViewer},
+	))
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		userID, ownerID string
+		want            bool
+	}{
+		{"alice", "alice", true},
+		{"alice", "", true},
+		{"alice", "bob", false},
+		// viewers can no longer manage their webhooks
+		{"carol", "", false},
+		{"carol", "bob", false},
+	} {
+		event := events.New(events.PhotoUploaded, test.ownerID, events.Data{PhotoID: "p1"})
+		if got := canReceive(ctx, test.userID, event); got != test.want {
+			t.Errorf("%s receiving an event of %q's photo: %v, want %v", test.userID, test.ownerID, got, test.want)
+		}
+	}
+}
@@ -3,22 +3,38 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"mime/multipart"
-	"sync"
+	"io"
 
 	"net/http"
+	"photo-backup/events"
+	"photo-backup/model"
 	"photo-backup/storage"
-	"strconv"
 
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
+const maxCaptionLength = 2000
+
+const (
+	maxUploadFileSize    = 200 << 20 // 200 MB per file
+	maxUploadRequestSize = 1 << 30   // 1 GB per request
+	maxClientPathLength  = 1024
+)
+
 type PhotoHandlers struct {
 	Storage   storage.PhotoStorage
 	Db        storage.PhotoDB
 	Log       *zap.Logger
+	Events    events.Publisher // optional, notified when photos are modified
+	Usage     storage.UsageDB  // optional, enforces storage quotas on upload
+	Sessions  storage.SessionDB // sessions created on login
+	Lockout   *LoginLockout    // optional, slows down password guessing on login
+	TwoFactor *TwoFactorHandlers // optional, asks for a second factor on login
 }
 
 func NewPhotoHandlers(storage storage.PhotoStorage, db storage.PhotoDB, logger *zap.Logger) *PhotoHandlers {
@@ -31,167 +47,202 @@ func NewPhotoHandlers(storage storage.PhotoStorage, db storage.PhotoDB, logger *
 
 // GET
 func (h *PhotoHandlers) HandleGetPhoto(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	vars := mux.Vars(r)
-
-	lastId := vars["lastId"]
-	limitStr := vars["limit"]
+	h.queryPhotos(w, r, storage.ArchivedExclude)
+}
 
-	if limitStr == "" {
-		h.Log.Error("missing necessary parameters", zap.String("path", r.URL.Path))
-		http.Error(w, "Missing necessary parameters", http.StatusBadRequest)
-		return
-	}
+// UPLOAD
+func (h *PhotoHandlers) HandleUploadPhoto(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := UserIDFromContext(ctx)
 
-	limit, err := strconv.Atoi(limitStr)
+	// parts are processed one at a time as they arrive, so the limits are
+	// enforced on the bytes read rather than on Content-Length
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadRequestSize)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		h.Log.Error("invalid limit value", zap.String("limit", limitStr), zap.Error(err))
-		http.Error(w, "Invalid limit value", http.StatusBadRequest)
+		h.Log.Error("failed to read multipart form", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid multipart form")
 		return
 	}
 
-	photos, err := h.Db.GetPhotos(ctx, lastId, int64(limit))
+	quota, err := h.remainingQuota(ctx)
 	if err != nil {
-		h.Log.Info("failed to fetch photos", zap.String("last_id", lastId), zap.Int64("limit", int64(limit)), zap.Error(err))
-		http.Error(w, "Failed to fetch photos: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to check storage quota")
 		return
 	}
 
-	if len(photos) == 0 {
-		h.Log.Warn("no photos found", zap.String("last_id", lastId), zap.Int64("limit", int64(limit)))
-		http.Error(w, "No photos found", http.StatusNotFound)
-		return
+	var deviceID primitive.ObjectID
+	if device := DeviceFromContext(ctx); device != nil {
+		deviceID = device.ID
 	}
 
-	h.Log.Info("retrieved photos", zap.Int("count", len(photos)), zap.String("last_id", lastId), zap.Int64("limit", int64(limit)))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(photos)
-}
-
-// UPLOAD
-func (h *PhotoHandlers) HandleUploadPhoto(w http.ResponseWriter, r *http.Request) {
-    const maxSize = 200 * 1024 * 1024 // 200 MB
-    const maxConcurrentUploads = 10
-
-    if r.ContentLength > maxSize {
-        h.Log.Error("file size exceeds limit", zap.Int64("content_length", r.ContentLength), zap.Int64("max_size", maxSize))
-        http.Error(w, "File size exceeds limit", http.StatusRequestEntityTooLarge)
-        return
-    }
-
-    err := r.ParseMultipartForm(maxSize)
-    if err != nil {
-        h.Log.Error("failed to parse multipart form", zap.Error(err))
-        http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    fileHeaders := r.MultipartForm.File["file"]
-    if len(fileHeaders) == 0 {
-        h.Log.Error("no file found in request", zap.String("path", r.URL.Path))
-        http.Error(w, "No file found in the request", http.StatusBadRequest)
-        return
-    }
-
-    type uploadResult struct {
-        Filename string
-        Error    error
-    }
-
-    var wg sync.WaitGroup
-    results := make(chan uploadResult, len(fileHeaders))
-    sem := make(chan struct{}, maxConcurrentUploads)
-    ctx := r.Context()
-
-    for _, fileHeader := range fileHeaders {
-        sem <- struct{}{} // Acquire semaphore
-        wg.Add(1)
-        go func(fileHeader *multipart.FileHeader) {
-            defer wg.Done()
-            defer func() { <-sem }() // Release semaphore
-
-            select {
-            case <-ctx.Done():
-                h.Log.Warn("upload canceled", zap.String("filename", fileHeader.Filename), zap.Error(ctx.Err()))
-                results <- uploadResult{Filename: fileHeader.Filename, Error: ctx.Err()}
-                return
-            default:
-                if err := h.Storage.SavePhoto(ctx, fileHeader); err != nil {
-                    h.Log.Error("failed to save photo", zap.String("filename", fileHeader.Filename), zap.Error(err))
-                    results <- uploadResult{Filename: fileHeader.Filename, Error: err}
-                    return
-                }
-                h.Log.Info("photo uploaded successfully", zap.String("filename", fileHeader.Filename))
-                results <- uploadResult{Filename: fileHeader.Filename}
-            }
-        }(fileHeader)
-    }
-
-    wg.Wait()
-    close(results)
+	successList, failedList := []string{}, []string{}
+	var clientPath string
+	var tooLarge, overQuota bool
+parts:
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				tooLarge = true
+			}
+			h.Log.Error("failed to read multipart part", zap.Error(err))
+			if len(successList) == 0 && len(failedList) == 0 && !tooLarge {
+				writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid multipart form")
+				return
+			}
+			break
+		}
+
+		switch part.FormName() {
+		case "path":
+			// the client path of the file part that follows
+			value, err := io.ReadAll(io.LimitReader(part, maxClientPathLength+1))
+			part.Close()
+			if err != nil || len(value) > maxClientPathLength {
+				clientPath = ""
+				continue
+			}
+			clientPath = string(value)
+			continue
+		case "file":
+		default:
+			part.Close()
+			continue
+		}
+
+		filename := part.FileName()
+		limit := int64(maxUploadFileSize)
+		limitedByQuota := quota >= 0 && quota < limit
+		if limitedByQuota {
+			limit = quota
+		}
+
+		photo, err := h.Storage.SavePhoto(ctx, storage.Upload{
+			Body:        part,
+			Filename:    filename,
+			ContentType: part.Header.Get("Content-Type"),
+			OwnerID:     userID,
+			MaxSize:     limit,
+			Info:        model.UploadInfo{DeviceID: deviceID, ClientPath: clientPath},
+		})
+		part.Close()
+		clientPath = ""
+		if err != nil {
+			h.Log.Error("failed to save photo", zap.String("filename", filename), zap.Error(err))
+			failedList = append(failedList, filename)
+
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesErr):
+				// the rest of the request can't be read
+				tooLarge = true
+				break parts
+			case errors.Is(err, storage.ErrFileTooLarge) && limitedByQuota:
+				overQuota = true
+			case errors.Is(err, storage.ErrFileTooLarge):
+				tooLarge = true
+			}
+			continue
+		}
+
+		if quota >= 0 {
+			quota = max(quota-photo.Size-photo.ThumbnailSize, 0)
+		}
+		h.Log.Info("photo uploaded successfully", zap.String("filename", filename))
+		successList = append(successList, filename)
+	}
 
-    var successList, failedList []string
-    for result := range results {
-        if result.Error != nil {
-            failedList = append(failedList, result.Filename)
-            continue
-        }
-        successList = append(successList, result.Filename)
-    }
+	if len(successList) == 0 && len(failedList) == 0 {
+		if tooLarge {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, "Request exceeds the upload size limit")
+			return
+		}
+		h.Log.Error("no file found in request", zap.String("path", r.URL.Path))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No file found in the request")
+		return
+	}
 
-    response := map[string]interface{}{
-        "message":    "Photo upload completed",
-        "successful": successList,
-        "failed":     failedList,
-        "count":      len(successList),
-    }
+	response := UploadResponse{
+		Message:    "Photo upload completed",
+		Successful: successList,
+		Failed:     failedList,
+		Count:      len(successList),
+	}
 
-    w.Header().Set("Content-Type", "application/json")
-    if len(failedList) > 0 && len(successList) > 0 {
-        w.WriteHeader(http.StatusMultiStatus)
-    } else if len(failedList) > 0 {
-        w.WriteHeader(http.StatusInternalServerError)
-    } else {
-        w.WriteHeader(http.StatusOK)
-    }
-    json.NewEncoder(w).Encode(response)
+	switch {
+	case len(failedList) == 0:
+		writeJSON(w, http.StatusOK, response)
+	case len(successList) > 0:
+		writeJSON(w, http.StatusMultiStatus, response)
+	case overQuota:
+		writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: ErrorBody{
+			Code:    CodeQuotaExceeded,
+			Message: "Storage quota exceeded",
+			Failed:  failedList,
+		}})
+	case tooLarge:
+		writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: ErrorBody{
+			Code:    CodeTooLarge,
+			Message: fmt.Sprintf("Files may be at most %s and requests %s", formatBytes(maxUploadFileSize), formatBytes(maxUploadRequestSize)),
+			Failed:  failedList,
+		}})
+	default:
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: ErrorBody{
+			Code:    CodeInternal,
+			Message: "Photo upload failed",
+			Failed:  failedList,
+		}})
+	}
 }
 
 // DELETE SINGLE
 func (h *PhotoHandlers) HandleDeletePhoto(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	vars := mux.Vars(r)
-	id := vars["id"]
-	
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		h.Log.Error("missing photo ID parameter")
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Missing id parameter")
+		return
+	}
+
 	err := h.deletePhoto(ctx, id)
 	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Photo not found")
+			return
+		}
 		h.Log.Error("failed to delete photo", zap.String("photo_id", id), zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to delete photo")
 		return
 	}
 
 	h.Log.Info("photo deleted successfully", zap.String("photo_id", id))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Photo deleted successfully"})
+	writeMessage(w, http.StatusOK, "Photo deleted successfully")
 }
 
 // DELETE MULTIPLE
+type BulkDeleteRequest struct {
+	IDs []string `json:"ids"`
+}
+
 func (h *PhotoHandlers) HandleDeleteMultiplePhotos(w http.ResponseWriter, r *http.Request) {
     ctx := r.Context()
 
-    var req struct {
-        IDs []string `json:"ids"`
-    }
+    var req BulkDeleteRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         h.Log.Error("failed to decode delete multiple request", zap.Error(err))
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
         return
     }
     if len(req.IDs) == 0 {
         h.Log.Error("no photo IDs provided for bulk delete")
-        http.Error(w, "No photo IDs provided", http.StatusBadRequest)
+        writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No photo IDs provided")
         return
     }
 
@@ -204,103 +255,203 @@ func (h *PhotoHandlers) HandleDeleteMultiplePhotos(w http.ResponseWriter, r *htt
     }
 
     if len(failed) > 0 {
-        http.Error(w, "Failed to delete some photos: "+fmt.Sprint(failed), http.StatusInternalServerError)
+        writePartialFailure(w, "Failed to delete some photos", failed)
         return
     }
 
     h.Log.Info("deleted multiple photos", zap.Int("count", len(req.IDs)))
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Photos deleted successfully"})
+    writeMessage(w, http.StatusOK, "Photos deleted successfully")
 }
 
-func (h *PhotoHandlers) deletePhoto(ctx context.Context, id string) error {
-	if id == "" {
-		h.Log.Error("missing photo ID parameter")
-		return fmt.Errorf("missing photo ID parameter")
+// UPDATE
+type UpdatePhotoRequest struct {
+	Caption  *string   `json:"caption"`
+	Tags     *[]string `json:"tags"`
+	Favorite *bool     `json:"favorite"`
+	Rating   *int      `json:"rating"`
+	Archived *bool     `json:"archived"`
+}
+
+func (req UpdatePhotoRequest) toUpdate() (storage.PhotoUpdate, error) {
+	if req.Caption != nil && len(*req.Caption) > maxCaptionLength {
+		return storage.PhotoUpdate{}, fmt.Errorf("Caption is too long")
+	}
+	if req.Rating != nil && (*req.Rating < 0 || *req.Rating > 5) {
+		return storage.PhotoUpdate{}, fmt.Errorf("Rating must be between 0 and 5")
 	}
 
-	err := h.Storage.DeletePhoto(ctx, id)
-	if err != nil {
-		h.Log.Error("failed to delete photo", zap.String("photo_id", id), zap.Error(err))
-		return err
+	update := storage.PhotoUpdate{
+		Caption:  req.Caption,
+		Favorite: req.Favorite,
+		Rating:   req.Rating,
+		Archived: req.Archived,
 	}
-	return nil
+	if req.Tags != nil {
+		tags := normalizeTags(*req.Tags)
+		update.Tags = &tags
+	}
+	return update, nil
 }
 
-// SEARCH
-func (h *PhotoHandlers) HandleSearchPhoto(w http.ResponseWriter, r *http.Request) {
+func (h *PhotoHandlers) HandleUpdatePhoto(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	vars := mux.Vars(r)
-
-	lastId := vars["lastId"]
-	limitStr := vars["limit"]
-	latMin := vars["latMin"]
-	latMax := vars["latMax"]
-	longMin := vars["longMin"]
-	longMax := vars["longMax"]
-
-	if limitStr == "" {
-		h.Log.Error("missing necessary parameters", zap.String("path", r.URL.Path))
-		http.Error(w, "Missing necessary parameters", http.StatusBadRequest)
+	id := mux.Vars(r)["id"]
+
+	var req UpdatePhotoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.Log.Error("failed to decode update photo request", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
 		return
 	}
-
-	limit, err := strconv.Atoi(limitStr)
+	update, err := req.toUpdate()
 	if err != nil {
-		h.Log.Error("invalid limit value", zap.String("limit", limitStr), zap.Error(err))
-		http.Error(w, "Invalid limit value", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 		return
 	}
 
-	if longMin == "" || latMin == "" || longMax == "" || latMax == "" {
-		h.Log.Error("missing search parameters", zap.String("latMin", latMin), zap.String("latMax", latMax), zap.String("longMin", longMin), zap.String("longMax", longMax))
-		http.Error(w, "Missing parameter", http.StatusBadRequest)
+	photo, err := h.updatePhoto(ctx, id, update)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Photo not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to update photo")
 		return
 	}
 
-	latMinf, err := strconv.ParseFloat(latMin, 64)
+	h.Log.Info("photo updated", zap.String("photo_id", id))
+	writeJSON(w, http.StatusOK, newPhotoResponse(photo))
+}
+
+// UPDATE MULTIPLE
+type BulkUpdateRequest struct {
+	IDs []string `json:"ids"`
+	UpdatePhotoRequest
+}
+
+func (h *PhotoHandlers) HandleUpdateMultiplePhotos(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req BulkUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.Log.Error("failed to decode update multiple request", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(req.IDs) == 0 {
+		h.Log.Error("no photo IDs provided for bulk update")
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No photo IDs provided")
+		return
+	}
+	update, err := req.toUpdate()
 	if err != nil {
-		h.Log.Info("invalid latitude value", zap.String("lat", latMin), zap.Error(err))
-		http.Error(w, "Invalid latitude value", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 		return
 	}
 
-	latMaxf, err := strconv.ParseFloat(latMax, 64)
-	if err != nil {
-		h.Log.Info("invalid latitude value", zap.String("lat", latMax), zap.Error(err))
-		http.Error(w, "Invalid latitude value", http.StatusBadRequest)
+	var failed []string
+	for _, id := range req.IDs {
+		if _, err := h.updatePhoto(ctx, id, update); err != nil {
+			failed = append(failed, id)
+			h.Log.Error("failed to update photo in bulk", zap.String("photo_id", id), zap.Error(err))
+		}
+	}
+
+	if len(failed) > 0 {
+		writePartialFailure(w, "Failed to update some photos", failed)
 		return
 	}
 
-	longMinf, err := strconv.ParseFloat(longMin, 64)
+	h.Log.Info("updated multiple photos", zap.Int("count", len(req.IDs)))
+	writeMessage(w, http.StatusOK, "Photos updated successfully")
+}
+
+// updatePhoto applies the update if the user may edit the photo. Photos of
+// other users are reported as not found.
+func (h *PhotoHandlers) updatePhoto(ctx context.Context, id string, update storage.PhotoUpdate) (*model.PhotoDB, error) {
+	photo, err := h.Db.GetPhoto(ctx, id)
 	if err != nil {
-		h.Log.Info("invalid longitude value", zap.String("long", longMin), zap.Error(err))
-		http.Error(w, "Invalid longitude value", http.StatusBadRequest)
-		return
+		return nil, err
+	}
+	if !canEdit(ctx, photo) {
+		return nil, mongo.ErrNoDocuments
+	}
+	updated, err := h.Db.UpdatePhoto(ctx, id, update)
+	if err != nil {
+		return nil, err
+	}
+	if fields := update.Fields(); len(fields) > 0 {
+		h.publish(ctx, events.PhotoUpdated, updated, fields)
+	}
+	return updated, nil
+}
+
+func (h *PhotoHandlers) publish(ctx context.Context, eventType string, photo *model.PhotoDB, fields []string) {
+	if h.Events != nil {
+		h.Events.Publish(ctx, events.New(eventType, photo.OwnerID, events.Data{PhotoID: photo.ID.Hex(), Fields: fields}))
+	}
+}
+
+func (h *PhotoHandlers) deletePhoto(ctx context.Context, id string) error {
+	if id == "" {
+		h.Log.Error("missing photo ID parameter")
+		return fmt.Errorf("missing photo ID parameter")
 	}
 
-	longMaxf, err := strconv.ParseFloat(longMax, 64)
+	// like updates, photos of other users are reported as not found
+	photo, err := h.Db.GetPhoto(ctx, id)
 	if err != nil {
-		h.Log.Info("invalid longitude value", zap.String("long", longMax), zap.Error(err))
-		http.Error(w, "Invalid longitude value", http.StatusBadRequest)
-		return
+		return err
+	}
+	if !canEdit(ctx, photo) {
+		h.Log.Warn("photo delete denied", zap.String("photo_id", id), zap.String("user_id", UserIDFromContext(ctx)))
+		return mongo.ErrNoDocuments
 	}
 
-	photos, err := h.Db.SearchPhotosByLocation(ctx, lastId, int64(limit), latMinf, latMaxf, longMinf, longMaxf)
+	err = h.Storage.DeletePhoto(ctx, id)
 	if err != nil {
-		h.Log.Error("failed to search photos by location", zap.Error(err))
-		http.Error(w, "Failed to fetch photos: "+err.Error(), http.StatusInternalServerError)
+		h.Log.Error("failed to delete photo", zap.String("photo_id", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// SEARCH
+// Same as GET, except that archived photos are included by default, so they
+// can still be found.
+func (h *PhotoHandlers) HandleSearchPhoto(w http.ResponseWriter, r *http.Request) {
+	h.queryPhotos(w, r, storage.ArchivedInclude)
+}
+
+func (h *PhotoHandlers) queryPhotos(w http.ResponseWriter, r *http.Request, archived string) {
+	ctx := r.Context()
+
+	query, err := parsePhotoQuery(r.URL.Query(), archived)
+	if err != nil {
+		h.Log.Info("invalid query parameters", zap.String("query", r.URL.RawQuery), zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 		return
 	}
+	query.Filter.OwnerID = visibleTo(ctx)
 
-	if len(photos) == 0 {
-		h.Log.Info("no photos found for location search")
-		http.Error(w, "No photos found", http.StatusNotFound)
+	page, err := h.Db.QueryPhotos(ctx, query.Filter, query.Sort, query.Cursor, query.Limit)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			writeError(w, http.StatusBadRequest, CodeInvalidCursor, "Invalid cursor")
+			return
+		}
+		h.Log.Error("failed to query photos", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch photos")
 		return
 	}
 
-	h.Log.Info("retrieved photos by location", zap.Int("count", len(photos)))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(photos)
+	h.Log.Info("retrieved photos", zap.Int("count", len(page.Photos)), zap.Int64("total", page.Total))
+	writeJSON(w, http.StatusOK, PhotoListResponse{
+		Photos: newPhotoResponses(page.Photos),
+		Pagination: Pagination{
+			Total:      page.Total,
+			Limit:      query.Limit,
+			NextCursor: page.NextCursor,
+		},
+	})
 }
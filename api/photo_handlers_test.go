@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"photo-backup/model"
+	"testing"
+)
+
+func TestDeletePhotoOfOtherUser(t *testing.T) {
+	db := newFakePhotoDB(model.PhotoDB{OwnerID: "alice"}, model.PhotoDB{OwnerID: "bob"})
+	var alices, bobs string
+	for id, photo := range db.photos {
+		if photo.OwnerID == "alice" {
+			alices = id
+		} else {
+			bobs = id
+		}
+	}
+	h := newTestPhotoHandlers(db)
+
+	r := asUser(httptest.NewRequest(http.MethodDelete, "/photos?id="+bobs, nil), "alice", model.RoleMember)
+	if rec := serve(t, h.HandleDeletePhoto, r, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("deleting another user's photo: status %d, want 404", rec.Code)
+	}
+
+	r = asUser(jsonRequest(http.MethodDelete, "/photos/bulk-delete", `{"ids": ["`+alices+`", "`+bobs+`"]}`), "alice", model.RoleMember)
+	rec := serve(t, h.HandleDeleteMultiplePhotos, r, nil)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("bulk delete: status %d, want partial failure", rec.Code)
+	}
+	if _, ok := db.photos[bobs]; !ok {
+		t.Error("bulk delete removed another user's photo")
+	}
+	if _, ok := db.photos[alices]; ok {
+		t.Error("bulk delete kept the user's own photo")
+	}
+}
+
+func TestViewerBrowsesLibrary(t *testing.T) {
+	db := newFakePhotoDB(model.PhotoDB{OwnerID: "alice"}, model.PhotoDB{OwnerID: "bob"}, model.PhotoDB{})
+	h := newTestPhotoHandlers(db)
+
+	for _, test := range []struct {
+		userID, role string
+		want         int
+	}{
+		{"alice", model.RoleMember, 2},
+		{"carol", model.RoleViewer, 3},
+	} {
+		r := asUser(httptest.NewRequest(http.MethodGet, "/photos", nil), test.userID, test.role)
+		rec := serve(t, h.HandleGetPhoto, r, nil)
+		var list PhotoListResponse
+		if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Photos) != test.want {
+			t.Errorf("%s sees %d photos, want %d", test.role, len(list.Photos), test.want)
+		}
+	}
+
+	// viewers lack the permission, but the handlers don't rely on it
+	for id, photo := range db.photos {
+		if photo.OwnerID == "" {
+			continue
+		}
+		r := asUser(jsonRequest(http.MethodPatch, "/photos/"+id, `{"caption": "mine"}`), "carol", model.RoleViewer)
+		if rec := serve(t, h.HandleUpdatePhoto, r, map[string]string{"id": id}); rec.Code != http.StatusNotFound {
+			t.Errorf("viewer updating a photo of %s: status %d, want 404", photo.OwnerID, rec.Code)
+		}
+	}
+}
+
+func TestGetTagsLimit(t *testing.T) {
+	h := newTestPhotoHandlers(newFakePhotoDB(model.PhotoDB{OwnerID: "alice", Tags: []string{"beach"}}))
+	for _, test := range []struct {
+		limit  string
+		status int
+	}{
+		{"100", http.StatusOK},
+		{"101", http.StatusBadRequest},
+		{"100000000", http.StatusBadRequest},
+		{"0", http.StatusBadRequest},
+	} {
+		r := asUser(httptest.NewRequest(http.MethodGet, "/tags?limit="+test.limit, nil), "alice", model.RoleMember)
+		if rec := serve(t, h.HandleGetTags, r, nil); rec.Code != test.status {
+			t.Errorf("limit %s: status %d, want %d", test.limit, rec.Code, test.status)
+		}
+	}
+}
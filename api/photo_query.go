@@ -0,0 +1,199 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+	"photo-backup/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageLimit  = 50
+	maxPageLimit      = 500
+	defaultColorDelta = 20
+	maxColorDelta     = 100
+)
+
+type photoQuery struct {
+	Filter storage.PhotoFilter
+	Sort   string
+	Cursor string
+	Limit  int64
+}
+
+// parsePhotoQuery reads the photo query parameters. Every parameter is
+// optional; invalid values are reported with a message meant for the client.
+//
+//	limit, cursor, sort
+//	q, tags, from, to
+//	latMin, latMax, longMin, longMax, hasLocation
+//	contentType, camera, minSize, maxSize
+//	favorite, minRating, archived
+//	color, colorDelta
+//	device
+func parsePhotoQuery(query url.Values, archived string) (photoQuery, error) {
+	q := photoQuery{
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+		Limit:  defaultPageLimit,
+		Filter: storage.PhotoFilter{
+			Text:        strings.TrimSpace(query.Get("q")),
+			Tags:        normalizeTags(strings.Split(query.Get("tags"), ",")),
+			ContentType: query.Get("contentType"),
+			Camera:      strings.TrimSpace(query.Get("camera")),
+			Archived:    archived,
+		},
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return q, errors.New("Invalid limit value, must be between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+		q.Limit = int64(limit)
+	}
+	if q.Sort != "" && !storage.ValidSort(q.Sort) {
+		return q, errors.New("Invalid sort value")
+	}
+
+	var err error
+	if q.Filter.From, err = parseTimeParam(query.Get("from"), false); err != nil {
+		return q, errors.New("Invalid from value")
+	}
+	if q.Filter.To, err = parseTimeParam(query.Get("to"), true); err != nil {
+		return q, errors.New("Invalid to value")
+	}
+	if q.Filter.MinSize, err = parseSizeParam(query.Get("minSize")); err != nil {
+		return q, errors.New("Invalid minSize value")
+	}
+	if q.Filter.MaxSize, err = parseSizeParam(query.Get("maxSize")); err != nil {
+		return q, errors.New("Invalid maxSize value")
+	}
+	if q.Filter.HasLocation, err = parseBoolParam(query.Get("hasLocation")); err != nil {
+		return q, errors.New("Invalid hasLocation value")
+	}
+	if q.Filter.Favorite, err = parseBoolParam(query.Get("favorite")); err != nil {
+		return q, errors.New("Invalid favorite value")
+	}
+
+	if minRating := query.Get("minRating"); minRating != "" {
+		value, err := strconv.Atoi(minRating)
+		if err != nil || value < 0 || value > 5 {
+			return q, errors.New("Invalid minRating value")
+		}
+		q.Filter.MinRating = value
+	}
+
+	switch value := query.Get("archived"); value {
+	case "":
+	case storage.ArchivedInclude, storage.ArchivedExclude, storage.ArchivedOnly:
+		q.Filter.Archived = value
+	default:
+		return q, errors.New("Invalid archived value")
+	}
+
+	if color := query.Get("color"); color != "" {
+		lab, err := storage.ParseHexColor(color)
+		if err != nil {
+			return q, errors.New("Invalid color value, expected a hex color like #3366ff")
+		}
+		q.Filter.Color = &lab
+		q.Filter.ColorDelta = defaultColorDelta
+		if delta := query.Get("colorDelta"); delta != "" {
+			value, err := strconv.ParseFloat(delta, 64)
+			if err != nil || value <= 0 || value > maxColorDelta {
+				return q, errors.New("Invalid colorDelta value, must be between 0 and " + strconv.Itoa(maxColorDelta))
+			}
+			q.Filter.ColorDelta = value
+		}
+	}
+
+	if device := query.Get("device"); device != "" {
+		if !primitive.IsValidObjectID(device) {
+			return q, errors.New("Invalid device value")
+		}
+		q.Filter.DeviceID = device
+	}
+
+	q.Filter.Box, err = parseBoundingBox(query)
+	return q, err
+}
+
+// parseBoundingBox returns nil when no coordinate is given and an error when
+// only some of them are.
+func parseBoundingBox(query url.Values) (*storage.BoundingBox, error) {
+	latMin := query.Get("latMin")
+	latMax := query.Get("latMax")
+	longMin := query.Get("longMin")
+	longMax := query.Get("longMax")
+
+	if latMin == "" && latMax == "" && longMin == "" && longMax == "" {
+		return nil, nil
+	}
+	if longMin == "" || latMin == "" || longMax == "" || latMax == "" {
+		return nil, errors.New("Missing parameter, latMin, latMax, longMin and longMax must be given together")
+	}
+
+	box := &storage.BoundingBox{}
+	var err error
+	if box.LatMin, err = strconv.ParseFloat(latMin, 64); err != nil {
+		return nil, errors.New("Invalid latitude value")
+	}
+	if box.LatMax, err = strconv.ParseFloat(latMax, 64); err != nil {
+		return nil, errors.New("Invalid latitude value")
+	}
+	if box.LongMin, err = strconv.ParseFloat(longMin, 64); err != nil {
+		return nil, errors.New("Invalid longitude value")
+	}
+	if box.LongMax, err = strconv.ParseFloat(longMax, 64); err != nil {
+		return nil, errors.New("Invalid longitude value")
+	}
+	return box, nil
+}
+
+// parseTimeParam accepts RFC 3339 timestamps or plain dates. A plain date
+// is the start of the day, or its last millisecond with endOfDay, so that
+// a range to a date includes that day.
+func parseTimeParam(value string, endOfDay bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		// dates are stored with millisecond precision
+		t = t.AddDate(0, 0, 1).Add(-time.Millisecond)
+	}
+	return &t, nil
+}
+
+func parseBoolParam(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func parseSizeParam(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return size, nil
+}
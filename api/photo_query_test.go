@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParsePhotoQueryDateRange(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		from, to string
+	}{
+		// a plain to date includes the whole day
+		{"from=2024-06-01&to=2024-06-30", "2024-06-01T00:00:00Z", "2024-06-30T23:59:59.999Z"},
+		{"to=2024-12-31", "", "2024-12-31T23:59:59.999Z"},
+		{"from=2024-06-01T08:00:00Z&to=2024-06-30T12:00:00Z", "2024-06-01T08:00:00Z", "2024-06-30T12:00:00Z"},
+	} {
+		values, _ := url.ParseQuery(test.query)
+		q, err := parsePhotoQuery(values, "")
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got := formatTime(q.Filter.From); got != test.from {
+			t.Errorf("%s: from %s, want %s", test.query, got, test.from)
+		}
+		if got := formatTime(q.Filter.To); got != test.to {
+			t.Errorf("%s: to %s, want %s", test.query, got, test.to)
+		}
+	}
+
+	// a photo taken on the last day is in the range
+	values, _ := url.ParseQuery("to=2024-06-30")
+	q, _ := parsePhotoQuery(values, "")
+	if takenAt := time.Date(2024, 6, 30, 18, 30, 0, 0, time.UTC); takenAt.After(*q.Filter.To) {
+		t.Errorf("photo taken %s is after to %s", takenAt, q.Filter.To)
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"photo-backup/model"
+	"photo-backup/storage"
+	"time"
+)
+
+// PhotoResponse is the API representation of a photo. Files are referenced
+// by URL, server paths and internal features are never exposed.
+type PhotoResponse struct {
+	ID           string         `json:"id"`
+	TakenAt      time.Time      `json:"takenAt"`
+	Location     *Location      `json:"location,omitempty"`
+	ContentType  string         `json:"contentType"`
+	Size         int64          `json:"size"`
+	Hash         string         `json:"hash,omitempty"` // SHA-256 of the original
+	Width        int            `json:"width,omitempty"`
+	Height       int            `json:"height,omitempty"`
+	BlurHash     string         `json:"blurHash,omitempty"`
+	Palette      []PaletteColor `json:"palette"`
+	Camera       string         `json:"camera,omitempty"`
+	Caption      string         `json:"caption,omitempty"`
+	Tags         []string       `json:"tags"`
+	Favorite     bool           `json:"favorite"`
+	Rating       int            `json:"rating"`
+	Archived     bool           `json:"archived"`
+	DeviceID     string         `json:"deviceId,omitempty"`
+	ClientPath   string         `json:"clientPath,omitempty"`
+	UploadedAt   *time.Time     `json:"uploadedAt,omitempty"`
+	ThumbnailURL string         `json:"thumbnailUrl"`
+	OriginalURL  string         `json:"originalUrl"`
+}
+
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type PaletteColor struct {
+	Hex    string  `json:"hex"`
+	Weight float64 `json:"weight"`
+}
+
+type PhotoListResponse struct {
+	Photos     []PhotoResponse `json:"photos"`
+	Pagination Pagination      `json:"pagination"`
+}
+
+type SimilarPhotoResponse struct {
+	PhotoResponse
+	Distance   int     `json:"distance"`
+	Similarity float64 `json:"similarity"`
+}
+
+type SimilarPhotoListResponse struct {
+	Photos     []SimilarPhotoResponse `json:"photos"`
+	Pagination Pagination             `json:"pagination"`
+}
+
+type DuplicateGroup struct {
+	Keep   string          `json:"keep"`
+	Photos []PhotoResponse `json:"photos"`
+}
+
+type DuplicateGroupListResponse struct {
+	Groups     []DuplicateGroup `json:"groups"`
+	Pagination Pagination       `json:"pagination"`
+}
+
+type UploadResponse struct {
+	Message    string   `json:"message"`
+	Successful []string `json:"successful"`
+	Failed     []string `json:"failed"`
+	Count      int      `json:"count"`
+}
+
+func fileURL(photo *model.PhotoDB, rendition string) string {
+	return BasePath + "/files/" + photo.ID.Hex() + "/" + rendition
+}
+
+func newPhotoResponse(photo *model.PhotoDB) PhotoResponse {
+	response := PhotoResponse{
+		ID:           photo.ID.Hex(),
+		TakenAt:      photo.TakenAt,
+		ContentType:  photo.ContentType,
+		Size:         photo.Size,
+		Hash:         photo.Hash,
+		Width:        photo.Width,
+		Height:       photo.Height,
+		BlurHash:     photo.BlurHash,
+		Palette:      make([]PaletteColor, len(photo.Palette)),
+		Camera:       photo.Camera,
+		Caption:      photo.Caption,
+		Tags:         photo.Tags,
+		Favorite:     photo.Favorite,
+		Rating:       photo.Rating,
+		Archived:     photo.Archived,
+		ClientPath:   photo.ClientPath,
+		ThumbnailURL: fileURL(photo, RenditionThumbnail),
+		OriginalURL:  fileURL(photo, RenditionOriginal),
+	}
+	if photo.LonLat != nil && len(photo.LonLat.Coordinates) == 2 {
+		response.Location = &Location{Lon: photo.LonLat.Coordinates[0], Lat: photo.LonLat.Coordinates[1]}
+	}
+	for i, color := range photo.Palette {
+		response.Palette[i] = PaletteColor{Hex: color.Hex, Weight: color.Weight}
+	}
+	if !photo.DeviceID.IsZero() {
+		response.DeviceID = photo.DeviceID.Hex()
+	}
+	if !photo.UploadedAt.IsZero() {
+		response.UploadedAt = &photo.UploadedAt
+	}
+	if response.Tags == nil {
+		response.Tags = []string{}
+	}
+	return response
+}
+
+func newPhotoResponses(photos []model.PhotoDB) []PhotoResponse {
+	responses := make([]PhotoResponse, len(photos))
+	for i := range photos {
+		responses[i] = newPhotoResponse(&photos[i])
+	}
+	return responses
+}
+
+func newSimilarPhotoResponse(photo *storage.SimilarPhoto) SimilarPhotoResponse {
+	return SimilarPhotoResponse{
+		PhotoResponse: newPhotoResponse(&photo.PhotoDB),
+		Distance:      photo.Distance,
+		Similarity:    photo.Similarity,
+	}
+}
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const clientIPKey contextKey = "clientIP"
+
+// TrustedProxies lists the networks of the reverse proxies whose
+// X-Forwarded-For header is believed.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and
+// CIDR ranges, e.g. "127.0.0.1,10.0.0.0/8".
+func ParseTrustedProxies(spec string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p TrustedProxies) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only
+// followed while the hops are trusted proxies, read from the right, so
+// clients cannot spoof their address by sending the header themselves.
+func (p TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !p.contains(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !p.contains(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// ClientIPMiddleware resolves the client address once for the rate limiters
+// and handlers further down.
+func ClientIPMiddleware(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey, proxies.ClientIP(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ClientIPFromContext returns the address resolved by ClientIPMiddleware.
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// RateLimit allows Requests per Per, in bursts of up to Requests.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRateLimit parses limits such as "10/m", "600/h" or "5/s".
+func ParseRateLimit(spec string) (RateLimit, error) {
+	count, unit, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	requests, err := strconv.Atoi(count)
+	if !ok || err != nil || requests <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected e.g. 10/m", spec)
+	}
+	per, ok := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected e.g. 10/m", spec)
+	}
+	return RateLimit{Requests: requests, Per: per}, nil
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is a token bucket per key. Buckets that have refilled are
+// forgotten, so memory stays proportional to the recently active clients.
+type RateLimiter struct {
+	Limit RateLimit
+	Now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		Limit:   limit,
+		Now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the key's bucket. If the bucket is empty, it
+// returns false and how long until the next token.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	capacity := float64(l.Limit.Requests)
+	perToken := l.Limit.Per / time.Duration(l.Limit.Requests)
+	l.sweep(now)
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+float64(elapsed)/float64(perToken))
+		b.updated = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Limit.Per {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= l.Limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// writeTooManyRequests rejects a request with a Retry-After header rounded
+// up to whole seconds.
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	writeError(w, http.StatusTooManyRequests, CodeTooManyRequests, message)
+}
+
+// RateLimitMiddleware limits requests per client IP and, behind
+// AuthMiddleware, per user as well. Each route group gets its own limiter.
+func RateLimitMiddleware(limiter *RateLimiter, logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			keys := []string{"ip:" + ClientIPFromContext(ctx)}
+			if userID := UserIDFromContext(ctx); userID != "" {
+				keys = append(keys, "user:"+userID)
+			}
+			for _, key := range keys {
+				if ok, retryAfter := limiter.Allow(key); !ok {
+					logger.Warn("rate limit exceeded", zap.String("key", key), zap.String("path", r.URL.Path))
+					writeTooManyRequests(w, retryAfter, "Too many requests")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LoginLockout slows down password guessing. After FreeAttempts failed
+// logins from an address, every further failure locks the address out for
+// twice as long as the one before, up to MaxBackoff. Failures are forgotten
+// after a successful login, or after Reset without one.
+type LoginLockout struct {
+	FreeAttempts int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	Reset        time.Duration
+	Now          func() time.Time
+
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	lastSweep time.Time
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginLockout() *LoginLockout {
+	return &LoginLockout{
+		FreeAttempts: 5,
+		BaseBackoff:  time.Second,
+		MaxBackoff:   15 * time.Minute,
+		Reset:        time.Hour,
+		Now:          time.Now,
+		failures:     map[string]*loginFailures{},
+	}
+}
+
+// Check returns how long the address is still locked out, 0 if it may try.
+func (l *LoginLockout) Check(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	f := l.current(ip, now)
+	if f == nil {
+		return 0
+	}
+	return max(f.lockedUntil.Sub(now), 0)
+}
+
+// Fail records a failed login and returns the resulting lockout.
+func (l *LoginLockout) Fail(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	f := l.current(ip, now)
+	if f == nil {
+		f = &loginFailures{}
+		l.failures[ip] = f
+	}
+	f.count++
+	f.last = now
+	if f.count <= l.FreeAttempts {
+		return 0
+	}
+
+	backoff := l.MaxBackoff
+	if shift := f.count - l.FreeAttempts - 1; shift < 20 {
+		backoff = min(l.BaseBackoff<<shift, l.MaxBackoff)
+	}
+	f.lockedUntil = now.Add(backoff)
+	return backoff
+}
+
+// Succeed forgets the failures of the address.
+func (l *LoginLockout) Succeed(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, ip)
+}
+
+func (f *loginFailures) expired(now time.Time, reset time.Duration) bool {
+	return now.Sub(f.last) > reset && now.After(f.lockedUntil)
+}
+
+// current returns the failures of the address unless they have expired.
+// Expired entries of other addresses are dropped every so often.
+func (l *LoginLockout) current(ip string, now time.Time) *loginFailures {
+	if now.Sub(l.lastSweep) > l.Reset {
+		for key, f := range l.failures {
+			if f.expired(now, l.Reset) {
+				delete(l.failures, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	if f := l.failures[ip]; f != nil && !f.expired(now, l.Reset) {
+		return f
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// BasePath is the prefix every API route is mounted under. Breaking changes
+// to the response types below go into a new version.
+const BasePath = "/api/v1"
+
+// Error codes of the error envelope. Clients should branch on the code, the
+// message is meant for humans and may change.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeInvalidCursor      = "invalid_cursor"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeSessionExpired     = "session_expired"
+	CodeTwoFactorRequired  = "two_factor_required"
+	CodeAPIKeyExpired      = "api_key_expired"
+	CodePasswordRequired   = "password_required"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeGone               = "gone"
+	CodeConflict           = "conflict"
+	CodeTooLarge           = "payload_too_large"
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeTooManyRequests    = "too_many_requests"
+	CodePartialFailure     = "partial_failure"
+	CodeInternal           = "internal_error"
+)
+
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Failed  []string `json:"failed,omitempty"` // IDs that failed in bulk operations
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+// Pagination is included in every list response. NextCursor is only set
+// when there are more results; lists that aren't paged return everything
+// and report its size as Total.
+type Pagination struct {
+	Total      int64  `json:"total"`
+	Limit      int64  `json:"limit,omitempty"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, MessageResponse{Message: message})
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ErrorResponse{Error: ErrorBody{Code: code, Message: message}})
+}
+
+// writePartialFailure reports a bulk operation in which some items failed.
+// The other items were processed.
+func writePartialFailure(w http.ResponseWriter, message string, failed []string) {
+	writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: ErrorBody{
+		Code:    CodePartialFailure,
+		Message: message,
+		Failed:  failed,
+	}})
+}
+
+// NotFoundHandler and MethodNotAllowedHandler answer unmatched routes with
+// the error envelope instead of the router's plain text defaults.
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Not found")
+	})
+}
+
+func MethodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+	})
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Routes are the handlers and the middleware of the route groups the
+// router is built from.
+type Routes struct {
+	Photos    *PhotoHandlers
+	TwoFactor *TwoFactorHandlers
+	Shares    *ShareHandlers
+	Webhooks  *WebhookHandlers
+	Events    *EventHandlers
+	Devices   *DeviceHandlers
+	Sessions  *SessionHandlers
+	APIKeys   *APIKeyHandlers
+	Users     *UserHandlers
+	OIDC      *OIDCHandlers
+
+	Auth        mux.MiddlewareFunc // authenticates the protected routes
+	Device      mux.MiddlewareFunc // records the device of protected requests
+	LoginLimit  mux.MiddlewareFunc // rate limits password and code checks
+	UploadLimit mux.MiddlewareFunc
+	APILimit    mux.MiddlewareFunc // rate limits every protected request
+}
+
+// NewRouter registers every route of the API. Routes must also be listed
+// in Operations, see CheckRoutes.
+func NewRouter(routes Routes) *mux.Router {
+	r := mux.NewRouter()
+	r.NotFoundHandler = NotFoundHandler()
+	r.MethodNotAllowedHandler = MethodNotAllowedHandler()
+	v1 := r.PathPrefix(BasePath).Subrouter()
+
+	// PUBLIC ROUTES
+	passwords := v1.NewRoute().Subrouter()
+	passwords.HandleFunc("/login", routes.Photos.HandleLogin).Methods(http.MethodPost, http.MethodOptions)
+	passwords.HandleFunc("/s/{token}/unlock", routes.Shares.HandleUnlockShare).Methods(http.MethodPost, http.MethodOptions)
+	passwords.HandleFunc("/oidc/login", routes.OIDC.HandleOIDCLogin).Methods(http.MethodGet, http.MethodOptions)
+	passwords.HandleFunc("/oidc/callback", routes.OIDC.HandleOIDCCallback).Methods(http.MethodGet, http.MethodOptions)
+	passwords.HandleFunc("/oidc/2fa", routes.OIDC.HandleOIDCTwoFactor).Methods(http.MethodPost, http.MethodOptions)
+	v1.HandleFunc("/openapi.json", HandleOpenAPI).Methods(http.MethodGet, http.MethodOptions)
+	v1.HandleFunc("/s/{token}", routes.Shares.HandleGetShared).Methods(http.MethodGet, http.MethodOptions)
+	v1.HandleFunc("/s/{token}/files/{id}/{rendition}", routes.Shares.HandleGetSharedFile).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+
+	// PROTECTED ROUTES
+	protected := v1.NewRoute().Subrouter()
+	protected.HandleFunc("/photos", RequirePermission(PermPhotosRead, routes.Photos.HandleGetPhoto)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/photos/search", RequirePermission(PermPhotosRead, routes.Photos.HandleSearchPhoto)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/photos/duplicates", RequirePermission(PermPhotosRead, routes.Photos.HandleGetDuplicates)).Methods(http.MethodGet, http.MethodOptions)
+	uploads := protected.NewRoute().Subrouter()
+	uploads.HandleFunc("/photos", RequirePermission(PermPhotosWrite, routes.Photos.HandleUploadPhoto)).Methods(http.MethodPost)
+	protected.HandleFunc("/photos/check", RequirePermission(PermPhotosRead, routes.Photos.HandleCheckPhotos)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/photos", RequirePermission(PermPhotosDelete, routes.Photos.HandleDeletePhoto)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/photos/bulk-delete", RequirePermission(PermPhotosDelete, routes.Photos.HandleDeleteMultiplePhotos)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/photos/bulk-update", RequirePermission(PermPhotosWrite, routes.Photos.HandleUpdateMultiplePhotos)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/photos/bulk-tags", RequirePermission(PermPhotosWrite, routes.Photos.HandleBulkTags)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/photos/{id}/similar", RequirePermission(PermPhotosRead, routes.Photos.HandleGetSimilar)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/photos/{id}", RequirePermission(PermPhotosWrite, routes.Photos.HandleUpdatePhoto)).Methods(http.MethodPatch, http.MethodOptions)
+	protected.HandleFunc("/logout", RequireSession(routes.Sessions.HandleLogout)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/sessions", RequireSession(routes.Sessions.HandleGetSessions)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/sessions", RequireSession(routes.Sessions.HandleRevokeSessions)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/sessions/{id}", RequireSession(routes.Sessions.HandleRevokeSession)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/api-keys", RequireSession(routes.APIKeys.HandleCreateAPIKey)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/api-keys", RequireSession(routes.APIKeys.HandleGetAPIKeys)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/api-keys/{id}", RequireSession(routes.APIKeys.HandleDeleteAPIKey)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/oidc/link", RequireSession(routes.OIDC.HandleOIDCLink)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/2fa", RequireSession(routes.TwoFactor.HandleGetTwoFactor)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/2fa/enroll", RequireSession(routes.TwoFactor.HandleEnrollTwoFactor)).Methods(http.MethodPost, http.MethodOptions)
+	codes := protected.NewRoute().Subrouter()
+	codes.HandleFunc("/2fa/confirm", RequireSession(routes.TwoFactor.HandleConfirmTwoFactor)).Methods(http.MethodPost, http.MethodOptions)
+	codes.HandleFunc("/2fa/recovery-codes", RequireSession(routes.TwoFactor.HandleRegenerateRecoveryCodes)).Methods(http.MethodPost, http.MethodOptions)
+	codes.HandleFunc("/2fa", RequireSession(routes.TwoFactor.HandleDisableTwoFactor)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/usage", RequirePermission(PermPhotosRead, routes.Photos.HandleGetUsage)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/sync/changes", RequirePermission(PermPhotosRead, routes.Photos.HandleGetChanges)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/tags", RequirePermission(PermPhotosRead, routes.Photos.HandleGetTags)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/files/{id}/{rendition}", RequirePermission(PermPhotosRead, routes.Photos.HandleGetFile)).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	protected.HandleFunc("/shares", RequirePermission(PermLibraryManage, routes.Shares.HandleCreateShare)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/shares", RequirePermission(PermLibraryManage, routes.Shares.HandleGetShares)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/shares/{id}", RequirePermission(PermLibraryManage, routes.Shares.HandleRevokeShare)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/devices", RequirePermission(PermLibraryManage, routes.Devices.HandleCreateDevice)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/devices", RequirePermission(PermLibraryManage, routes.Devices.HandleGetDevices)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/devices/{id}", RequirePermission(PermLibraryManage, routes.Devices.HandleUpdateDevice)).Methods(http.MethodPatch, http.MethodOptions)
+	protected.HandleFunc("/devices/{id}", RequirePermission(PermLibraryManage, routes.Devices.HandleDeleteDevice)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/events", RequirePermission(PermPhotosRead, routes.Events.HandleEvents)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/webhooks", RequirePermission(PermLibraryManage, routes.Webhooks.HandleCreateWebhook)).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/webhooks", RequirePermission(PermLibraryManage, routes.Webhooks.HandleGetWebhooks)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/webhooks/{id}", RequirePermission(PermLibraryManage, routes.Webhooks.HandleUpdateWebhook)).Methods(http.MethodPatch, http.MethodOptions)
+	protected.HandleFunc("/webhooks/{id}", RequirePermission(PermLibraryManage, routes.Webhooks.HandleDeleteWebhook)).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/webhooks/{id}/deliveries", RequirePermission(PermLibraryManage, routes.Webhooks.HandleGetDeliveries)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/users", RequirePermission(PermUsersManage, routes.Users.HandleGetUsers)).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/users/{id}/role", RequirePermission(PermUsersManage, routes.Users.HandleSetRole)).Methods(http.MethodPut, http.MethodOptions)
+
+	// MIDDLEWARE
+	passwords.Use(routes.LoginLimit)
+	protected.Use(routes.Auth)
+	protected.Use(routes.Device)
+	protected.Use(routes.APILimit)
+	uploads.Use(routes.UploadLimit)
+	codes.Use(routes.LoginLimit)
+
+	return r
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const (
+	sessionKey      contextKey = "session"
+	sessionTokenKey            = "token" // key of the session token in the cookie
+
+	// sessions expire after a day without activity, and a month after login
+	sessionIdleTimeout = 24 * time.Hour
+	sessionMaxLifetime = 30 * 24 * time.Hour
+
+	// activity is recorded at most this often, not on every request
+	sessionTouchInterval = time.Minute
+)
+
+// SessionFromContext returns the session authenticated by AuthMiddleware.
+func SessionFromContext(ctx context.Context) *model.Session {
+	session, _ := ctx.Value(sessionKey).(*model.Session)
+	return session
+}
+
+// sessionExpiry slides the expiry of a session on activity, but never past
+// its maximum lifetime.
+func sessionExpiry(createdAt, lastSeenAt time.Time) time.Time {
+	expiresAt := lastSeenAt.Add(sessionIdleTimeout)
+	if limit := createdAt.Add(sessionMaxLifetime); expiresAt.After(limit) {
+		return limit
+	}
+	return expiresAt
+}
+
+// startSession creates a session for the user and stores its token in the
+// cookie. A session the cookie carried before is ended.
+func startSession(w http.ResponseWriter, r *http.Request, sessions storage.SessionDB, userID string) error {
+	ctx := r.Context()
+	cookie, _ := Store.Get(r, sessionName)
+	if old, ok := cookie.Values[sessionTokenKey].(string); ok {
+		if previous, err := sessions.GetSessionByTokenHash(ctx, hashToken(old)); err == nil {
+			sessions.DeleteSession(ctx, previous.ID.Hex(), previous.UserID)
+		}
+	}
+
+	token, err := newToken("")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = sessions.SaveSession(ctx, model.Session{
+		UserID:     userID,
+		TokenHash:  hashToken(token),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  sessionExpiry(now, now),
+		IP:         ClientIPFromContext(ctx),
+		UserAgent:  r.UserAgent(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the cookie only carries the token, expiry is decided by the server
+	cookie.Values = map[interface{}]interface{}{sessionTokenKey: token}
+	return cookie.Save(r, w)
+}
+
+// describeUserAgent turns a User-Agent header into something like
+// "Firefox on macOS".
+func describeUserAgent(userAgent string) string {
+	var browser, system string
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"},
+		{"Safari/", "Safari"}, {"curl/", "curl"}, {"okhttp/", "Android app"}, {"CFNetwork/", "iOS app"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+type SessionHandlers struct {
+	Sessions storage.SessionDB
+	Log      *zap.Logger
+}
+
+func NewSessionHandlers(sessions storage.SessionDB, logger *zap.Logger) *SessionHandlers {
+	return &SessionHandlers{
+		Sessions: sessions,
+		Log:      logger,
+	}
+}
+
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	Current    bool      `json:"current"` // the session making the request
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type SessionListResponse struct {
+	Sessions   []SessionResponse `json:"sessions"`
+	Pagination Pagination        `json:"pagination"`
+}
+
+type RevokeSessionsResponse struct {
+	Revoked int64 `json:"revoked"`
+}
+
+// LOGOUT
+func (h *SessionHandlers) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current := SessionFromContext(ctx)
+
+	if err := h.Sessions.DeleteSession(ctx, current.ID.Hex(), current.UserID); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to log out")
+		return
+	}
+
+	cookie, _ := Store.Get(r, sessionName)
+	cookie.Options.MaxAge = -1
+	if err := cookie.Save(r, w); err != nil {
+		h.Log.Error("failed to clear session cookie", zap.Error(err))
+	}
+
+	h.Log.Info("logout successful", zap.String("session_id", current.ID.Hex()))
+	writeMessage(w, http.StatusOK, "Logout successful")
+}
+
+// LIST
+func (h *SessionHandlers) HandleGetSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current := SessionFromContext(ctx)
+
+	sessions, err := h.Sessions.GetSessions(ctx, UserIDFromContext(ctx))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch sessions")
+		return
+	}
+
+	response := SessionListResponse{
+		Sessions:   make([]SessionResponse, len(sessions)),
+		Pagination: Pagination{Total: int64(len(sessions))},
+	}
+	for i, session := range sessions {
+		response.Sessions[i] = SessionResponse{
+			ID:         session.ID.Hex(),
+			Current:    session.ID == current.ID,
+			Device:     describeUserAgent(session.UserAgent),
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// REVOKE
+func (h *SessionHandlers) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	if err := h.Sessions.DeleteSession(ctx, id, UserIDFromContext(ctx)); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Session not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to revoke session")
+		return
+	}
+
+	h.Log.Info("session revoked", zap.String("session_id", id))
+	writeMessage(w, http.StatusOK, "Session revoked successfully")
+}
+
+// REVOKE ALL
+func (h *SessionHandlers) HandleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// the current session is kept unless asked for, use logout to end it
+	except := SessionFromContext(ctx).ID
+	if r.URL.Query().Get("includeCurrent") == "true" {
+		except = primitive.NilObjectID
+	}
+	revoked, err := h.Sessions.DeleteSessions(ctx, UserIDFromContext(ctx), except)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to revoke sessions")
+		return
+	}
+
+	h.Log.Info("sessions revoked", zap.String("user_id", UserIDFromContext(ctx)), zap.Int64("count", revoked))
+	writeJSON(w, http.StatusOK, RevokeSessionsResponse{Revoked: revoked})
+}
@@ -0,0 +1,369 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const shareSessionName = "share-session"
+
+type ShareHandlers struct {
+	Photos *PhotoHandlers
+	Shares storage.ShareDB
+	Log    *zap.Logger
+}
+
+func NewShareHandlers(photos *PhotoHandlers, shares storage.ShareDB, logger *zap.Logger) *ShareHandlers {
+	return &ShareHandlers{
+		Photos: photos,
+		Shares: shares,
+		Log:    logger,
+	}
+}
+
+type CreateShareRequest struct {
+	PhotoIDs      []string   `json:"photoIds"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	Password      string     `json:"password"`
+	AllowDownload bool       `json:"allowDownload"`
+}
+
+type ShareResponse struct {
+	ID               string     `json:"id"`
+	Token            string     `json:"token"`
+	PhotoIDs         []string   `json:"photoIds"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	PasswordRequired bool       `json:"passwordRequired"`
+	AllowDownload    bool       `json:"allowDownload"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	Revoked          bool       `json:"revoked"`
+}
+
+type ShareListResponse struct {
+	Shares     []ShareResponse `json:"shares"`
+	Pagination Pagination      `json:"pagination"`
+}
+
+// SharedPhoto is the public view of a photo, without the owner's caption,
+// tags and other metadata.
+type SharedPhoto struct {
+	ID           string    `json:"id"`
+	TakenAt      time.Time `json:"takenAt"`
+	ContentType  string    `json:"contentType"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	BlurHash     string    `json:"blurHash,omitempty"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
+	OriginalURL  string    `json:"originalUrl,omitempty"`
+}
+
+type SharedPhotoListResponse struct {
+	Photos        []SharedPhoto `json:"photos"`
+	Pagination    Pagination    `json:"pagination"`
+	ExpiresAt     *time.Time    `json:"expiresAt,omitempty"`
+	AllowDownload bool          `json:"allowDownload"`
+}
+
+func newShareResponse(share *model.ShareLink) ShareResponse {
+	ids := make([]string, len(share.PhotoIDs))
+	for i, id := range share.PhotoIDs {
+		ids[i] = id.Hex()
+	}
+	return ShareResponse{
+		ID:               share.ID.Hex(),
+		Token:            share.Token,
+		PhotoIDs:         ids,
+		ExpiresAt:        share.ExpiresAt,
+		PasswordRequired: share.PasswordHash != "",
+		AllowDownload:    share.AllowDownload,
+		CreatedAt:        share.CreatedAt,
+		Revoked:          share.RevokedAt != nil,
+	}
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CREATE
+func (h *ShareHandlers) HandleCreateShare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := UserIDFromContext(ctx)
+
+	var req CreateShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.Log.Error("failed to decode create share request", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(req.PhotoIDs) == 0 {
+		h.Log.Error("no photo IDs provided for share")
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No photo IDs provided")
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Expiry must be in the future")
+		return
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(req.PhotoIDs))
+	seen := map[primitive.ObjectID]bool{}
+	for _, id := range req.PhotoIDs {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid photo ID: "+id)
+			return
+		}
+		if !seen[oid] {
+			seen[oid] = true
+			ids = append(ids, oid)
+		}
+	}
+
+	photos, err := h.Photos.Db.GetPhotosByIDs(ctx, ids)
+	if err != nil {
+		h.Log.Error("failed to fetch photos for share", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create share")
+		return
+	}
+	owned := 0
+	for i := range photos {
+		if canEdit(ctx, &photos[i]) {
+			owned++
+		}
+	}
+	if owned != len(ids) {
+		h.Log.Warn("share requested for unknown photos", zap.String("user_id", userID), zap.Int("requested", len(ids)), zap.Int("found", owned))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Some photos were not found")
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		h.Log.Error("failed to generate share token", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create share")
+		return
+	}
+
+	share := model.ShareLink{
+		Token:         token,
+		OwnerID:       userID,
+		PhotoIDs:      ids,
+		AllowDownload: req.AllowDownload,
+		ExpiresAt:     req.ExpiresAt,
+		CreatedAt:     time.Now(),
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			h.Log.Error("failed to hash share password", zap.Error(err))
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create share")
+			return
+		}
+		share.PasswordHash = string(hash)
+	}
+
+	saved, err := h.Shares.SaveShare(ctx, share)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create share")
+		return
+	}
+
+	h.Log.Info("share link created", zap.String("share_id", saved.ID.Hex()), zap.Int("photos", len(ids)))
+	writeJSON(w, http.StatusCreated, newShareResponse(saved))
+}
+
+// LIST
+func (h *ShareHandlers) HandleGetShares(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	shares, err := h.Shares.GetShares(ctx, UserIDFromContext(ctx))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch shares")
+		return
+	}
+
+	response := ShareListResponse{
+		Shares:     make([]ShareResponse, len(shares)),
+		Pagination: Pagination{Total: int64(len(shares))},
+	}
+	for i := range shares {
+		response.Shares[i] = newShareResponse(&shares[i])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// REVOKE
+func (h *ShareHandlers) HandleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	if err := h.Shares.RevokeShare(ctx, id, UserIDFromContext(ctx)); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Share not found")
+			return
+		}
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Failed to revoke share")
+		return
+	}
+
+	h.Log.Info("share link revoked", zap.String("share_id", id))
+	writeMessage(w, http.StatusOK, "Share revoked successfully")
+}
+
+// PUBLIC: UNLOCK
+type UnlockShareRequest struct {
+	Password string `json:"password"`
+}
+
+func (h *ShareHandlers) HandleUnlockShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.activeShare(w, r)
+	if !ok {
+		return
+	}
+
+	var req UnlockShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if share.PasswordHash != "" && !CheckPasswordHash(req.Password, share.PasswordHash) {
+		h.Log.Warn("invalid share password", zap.String("share_id", share.ID.Hex()))
+		writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid password")
+		return
+	}
+
+	session, _ := Store.Get(r, shareSessionName)
+	session.Values["share:"+share.Token] = time.Now().Unix()
+	if err := session.Save(r, w); err != nil {
+		h.Log.Error("failed to save share session", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to unlock share")
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "Share unlocked")
+}
+
+// PUBLIC: GET
+func (h *ShareHandlers) HandleGetShared(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	share, ok := h.unlockedShare(w, r)
+	if !ok {
+		return
+	}
+
+	photos, err := h.Photos.Db.GetPhotosByIDs(ctx, share.PhotoIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch photos")
+		return
+	}
+
+	base := BasePath + "/s/" + share.Token + "/files/"
+	items := make([]SharedPhoto, 0, len(photos))
+	for _, photo := range photos {
+		item := SharedPhoto{
+			ID:           photo.ID.Hex(),
+			TakenAt:      photo.TakenAt,
+			ContentType:  photo.ContentType,
+			Size:         photo.Size,
+			Width:        photo.Width,
+			Height:       photo.Height,
+			BlurHash:     photo.BlurHash,
+			ThumbnailURL: base + photo.ID.Hex() + "/" + RenditionThumbnail,
+		}
+		if share.AllowDownload {
+			item.OriginalURL = base + photo.ID.Hex() + "/" + RenditionOriginal
+		}
+		items = append(items, item)
+	}
+
+	writeJSON(w, http.StatusOK, SharedPhotoListResponse{
+		Photos:        items,
+		Pagination:    Pagination{Total: int64(len(items))},
+		ExpiresAt:     share.ExpiresAt,
+		AllowDownload: share.AllowDownload,
+	})
+}
+
+// PUBLIC: FILES
+func (h *ShareHandlers) HandleGetSharedFile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	rendition := vars["rendition"]
+
+	share, ok := h.unlockedShare(w, r)
+	if !ok {
+		return
+	}
+
+	oid, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil || !share.Contains(oid) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Photo not found")
+		return
+	}
+	if rendition == RenditionOriginal && !share.AllowDownload {
+		writeError(w, http.StatusForbidden, CodeForbidden, "Download not allowed")
+		return
+	}
+
+	photo, err := h.Photos.Db.GetPhoto(ctx, oid.Hex())
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Photo not found")
+		return
+	}
+
+	h.Photos.serveRendition(w, r, photo, rendition)
+}
+
+// activeShare resolves the token in the URL and rejects revoked or expired
+// links.
+func (h *ShareHandlers) activeShare(w http.ResponseWriter, r *http.Request) (*model.ShareLink, bool) {
+	token := mux.Vars(r)["token"]
+
+	share, err := h.Shares.GetShareByToken(r.Context(), token)
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Share not found")
+		return nil, false
+	}
+	if !share.Active(time.Now()) {
+		h.Log.Info("inactive share link accessed", zap.String("share_id", share.ID.Hex()))
+		writeError(w, http.StatusGone, CodeGone, "Share link is no longer available")
+		return nil, false
+	}
+	return share, true
+}
+
+// unlockedShare is like activeShare, but additionally requires password
+// protected links to have been unlocked earlier in this browser session.
+// Passwords are only checked by HandleUnlockShare, which is rate limited.
+func (h *ShareHandlers) unlockedShare(w http.ResponseWriter, r *http.Request) (*model.ShareLink, bool) {
+	share, ok := h.activeShare(w, r)
+	if !ok || share.PasswordHash == "" {
+		return share, ok
+	}
+
+	session, _ := Store.Get(r, shareSessionName)
+	if _, unlocked := session.Values["share:"+share.Token].(int64); unlocked {
+		return share, true
+	}
+
+	writeError(w, http.StatusUnauthorized, CodePasswordRequired, "Password required")
+	return nil, false
+}
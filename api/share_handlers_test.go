@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"photo-backup/model"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSharePasswordOnlyCheckedByUnlock(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	shares := &fakeShareDB{shares: []*model.ShareLink{{ID: primitive.NewObjectID(), Token: "tok", PasswordHash: string(hash)}}}
+	h := NewShareHandlers(newTestPhotoHandlers(newFakePhotoDB()), shares, zap.NewNop())
+
+	// the header would get around the rate limit of the unlock route
+	r := httptest.NewRequest(http.MethodGet, "/s/tok", nil)
+	r.Header.Set("X-Share-Password", "secret")
+	if rec := serve(t, h.HandleGetShared, r, map[string]string{"token": "tok"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("password header: status %d, want 401", rec.Code)
+	}
+
+	rec := serve(t, h.HandleUnlockShare, jsonRequest(http.MethodPost, "/s/tok/unlock", `{"password": "secret"}`), map[string]string{"token": "tok"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unlock: status %d", rec.Code)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/s/tok", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	if rec := serve(t, h.HandleGetShared, r, map[string]string{"token": "tok"}); rec.Code == http.StatusUnauthorized {
+		t.Error("unlocked share still asks for the password")
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"photo-backup/storage"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ChangeAdd    = "add"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+
+	defaultChangeLimit = 200
+	maxChangeLimit     = 1000
+)
+
+// ChangeResponse is one entry of the change feed. Photo is set for adds and
+// updates and holds the current state of the photo, DeletedAt for deletes.
+type ChangeResponse struct {
+	Type      string         `json:"type"`
+	Seq       int64          `json:"seq"`
+	PhotoID   string         `json:"photoId"`
+	Photo     *PhotoResponse `json:"photo,omitempty"`
+	DeletedAt *time.Time     `json:"deletedAt,omitempty"`
+}
+
+type ChangeListResponse struct {
+	Changes    []ChangeResponse `json:"changes"`
+	Since      string           `json:"since"`
+	HasMore    bool             `json:"hasMore"`
+	Pagination Pagination       `json:"pagination"`
+}
+
+func newChangeResponse(change storage.Change) ChangeResponse {
+	if change.Deleted != nil {
+		return ChangeResponse{
+			Type:      ChangeDelete,
+			Seq:       change.Seq,
+			PhotoID:   change.Deleted.ID.Hex(),
+			DeletedAt: &change.Deleted.DeletedAt,
+		}
+	}
+
+	photo := newPhotoResponse(change.Photo)
+	response := ChangeResponse{Type: ChangeUpdate, Seq: change.Seq, PhotoID: photo.ID, Photo: &photo}
+	if change.Created {
+		response.Type = ChangeAdd
+	}
+	return response
+}
+
+// SYNC CHANGES
+func (h *PhotoHandlers) HandleGetChanges(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	limit := defaultChangeLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxChangeLimit {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid limit value, must be between 1 and "+strconv.Itoa(maxChangeLimit))
+			return
+		}
+	}
+
+	page, err := h.Db.GetChanges(ctx, visibleTo(ctx), query.Get("since"), int64(limit))
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			writeError(w, http.StatusBadRequest, CodeInvalidCursor, "Invalid since value")
+			return
+		}
+		h.Log.Error("failed to fetch changes", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch changes")
+		return
+	}
+
+	response := ChangeListResponse{
+		Changes:    make([]ChangeResponse, len(page.Changes)),
+		Since:      page.Since,
+		HasMore:    page.HasMore,
+		Pagination: Pagination{Total: int64(len(page.Changes)), Limit: int64(limit)},
+	}
+	for i, change := range page.Changes {
+		response.Changes[i] = newChangeResponse(change)
+	}
+	if page.HasMore {
+		response.Pagination.NextCursor = page.Since
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"photo-backup/events"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	maxTagLength    = 64
+	defaultTagLimit = 20
+	maxTagLimit     = 100
+)
+
+type BulkTagsRequest struct {
+	IDs    []string `json:"ids"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+type BulkTagsResponse struct {
+	Message  string `json:"message"`
+	Modified int64  `json:"modified"`
+}
+
+type TagResponse struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+type TagListResponse struct {
+	Tags       []TagResponse `json:"tags"`
+	Pagination Pagination    `json:"pagination"`
+}
+
+// normalizeTags lowercases and trims tags and drops empty and duplicate ones.
+func normalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if runes := []rune(tag); len(runes) > maxTagLength {
+			tag = string(runes[:maxTagLength])
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// BULK TAGS
+func (h *PhotoHandlers) HandleBulkTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req BulkTagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.Log.Error("failed to decode bulk tags request", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(req.IDs) == 0 {
+		h.Log.Error("no photo IDs provided for bulk tags")
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No photo IDs provided")
+		return
+	}
+
+	add := normalizeTags(req.Add)
+	remove := normalizeTags(req.Remove)
+	if len(add) == 0 && len(remove) == 0 {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No tags provided")
+		return
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid photo ID: "+id)
+			return
+		}
+		ids = append(ids, oid)
+	}
+
+	modified, err := h.Db.UpdateTags(ctx, UserIDFromContext(ctx), ids, add, remove)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to update tags")
+		return
+	}
+
+	if modified > 0 && h.Events != nil {
+		if photos, err := h.Db.GetPhotosByIDs(ctx, ids); err == nil {
+			for i := range photos {
+				if canEdit(ctx, &photos[i]) {
+					h.publish(ctx, events.PhotoUpdated, &photos[i], []string{"tags"})
+				}
+			}
+		}
+	}
+
+	h.Log.Info("updated tags on multiple photos", zap.Int("count", len(ids)), zap.Int64("modified", modified))
+	writeJSON(w, http.StatusOK, BulkTagsResponse{
+		Message:  "Tags updated successfully",
+		Modified: modified,
+	})
+}
+
+// TAG AUTOCOMPLETE
+func (h *PhotoHandlers) HandleGetTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	limit := defaultTagLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxTagLimit {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid limit value, must be between 1 and "+strconv.Itoa(maxTagLimit))
+			return
+		}
+	}
+	prefix := strings.ToLower(strings.TrimSpace(query.Get("prefix")))
+
+	tags, err := h.Db.GetTags(ctx, visibleTo(ctx), prefix, int64(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch tags")
+		return
+	}
+
+	response := TagListResponse{
+		Tags:       make([]TagResponse, len(tags)),
+		Pagination: Pagination{Total: int64(len(tags)), Limit: int64(limit)},
+	}
+	for i, tag := range tags {
+		response.Tags[i] = TagResponse{Tag: tag.Tag, Count: tag.Count}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,321 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"photo-backup/totp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	errTwoFactorRequired = errors.New("two-factor code required")
+	errInvalidCode       = errors.New("invalid two-factor code")
+)
+
+// TwoFactorHandlers manage TOTP two-factor authentication. Now can be
+// replaced to test against a fixed clock.
+type TwoFactorHandlers struct {
+	Users  storage.UserDB
+	Issuer string // shown in authenticator apps
+	Now    func() time.Time
+	Log    *zap.Logger
+}
+
+func NewTwoFactorHandlers(users storage.UserDB, issuer string, logger *zap.Logger) *TwoFactorHandlers {
+	return &TwoFactorHandlers{
+		Users:  users,
+		Issuer: issuer,
+		Now:    time.Now,
+		Log:    logger,
+	}
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"` // a TOTP code, or a recovery code where noted
+}
+
+type TwoFactorStatusResponse struct {
+	Enabled                bool       `json:"enabled"`
+	Pending                bool       `json:"pending"` // enrolled but not confirmed yet
+	EnabledAt              *time.Time `json:"enabledAt,omitempty"`
+	RecoveryCodesRemaining int        `json:"recoveryCodesRemaining"`
+}
+
+type TwoFactorEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// newRecoveryCodes returns codes such as "k3j9-x2mq" and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, so codes can be typed
+// as they are read.
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// verify accepts a TOTP code or a recovery code of a user with two-factor
+// authentication enabled. Both can only be used once.
+func (h *TwoFactorHandlers) verify(ctx context.Context, user *model.User, code string) error {
+	secret, err := totp.DecodeSecret(user.TwoFactor.Secret)
+	if err != nil {
+		h.Log.Error("invalid TOTP secret", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	if step, ok := totp.Verify(secret, code, h.Now()); ok {
+		err = h.Users.UseTOTPStep(ctx, user.ID, step)
+	} else {
+		err = h.Users.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(code))
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errInvalidCode
+	}
+	return err
+}
+
+// checkLogin is called once the password was accepted. It requires a code
+// if the user enabled two-factor authentication.
+func (h *TwoFactorHandlers) checkLogin(ctx context.Context, userID string, code string) error {
+	user, err := h.Users.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		return nil
+	}
+	if strings.TrimSpace(code) == "" {
+		return errTwoFactorRequired
+	}
+	return h.verify(ctx, user, code)
+}
+
+// decodeCode reads the code of the request body.
+func decodeCode(r *http.Request) (string, error) {
+	var req TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+		return "", errors.New("Invalid request body, a code is required")
+	}
+	return req.Code, nil
+}
+
+// getUser loads the current user, answering the request if that fails.
+func (h *TwoFactorHandlers) getUser(w http.ResponseWriter, r *http.Request) (*model.User, bool) {
+	user, err := h.Users.GetUser(r.Context(), UserIDFromContext(r.Context()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch two-factor settings")
+		return nil, false
+	}
+	return user, true
+}
+
+// writeVerifyError answers a request whose code was not accepted.
+func writeVerifyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidCode) {
+		writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid code")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to verify code")
+}
+
+// STATUS
+func (h *TwoFactorHandlers) HandleGetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	var response TwoFactorStatusResponse
+	if tf := user.TwoFactor; tf != nil {
+		response.Enabled = tf.Enabled
+		response.Pending = !tf.Enabled
+		response.EnabledAt = tf.EnabledAt
+		response.RecoveryCodesRemaining = len(tf.RecoveryCodes)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ENROLL
+func (h *TwoFactorHandlers) HandleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := h.getUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		h.Log.Error("failed to generate TOTP secret", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to enroll")
+		return
+	}
+	// enrolling again replaces a pending secret, e.g. when the QR code was
+	// never scanned
+	if err := h.Users.SetTwoFactor(ctx, user.ID, &model.TwoFactor{Secret: totp.EncodeSecret(secret)}); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to enroll")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TwoFactorEnrollResponse{
+		Secret:          totp.EncodeSecret(secret),
+		ProvisioningURI: totp.ProvisioningURI(h.Issuer, user.ID, secret),
+	})
+}
+
+// CONFIRM
+func (h *TwoFactorHandlers) HandleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code, err := decodeCode(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	user, ok := h.getUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactor == nil || user.TwoFactor.Enabled {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "No pending two-factor enrollment")
+		return
+	}
+
+	secret, err := totp.DecodeSecret(user.TwoFactor.Secret)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to confirm two-factor authentication")
+		return
+	}
+	now := h.Now()
+	step, ok := totp.Verify(secret, code, now)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid code")
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		h.Log.Error("failed to generate recovery codes", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to confirm two-factor authentication")
+		return
+	}
+
+	twoFactor := &model.TwoFactor{
+		Secret:        user.TwoFactor.Secret,
+		Enabled:       true,
+		EnabledAt:     &now,
+		LastStep:      step,
+		RecoveryCodes: hashes,
+	}
+	if err := h.Users.SetTwoFactor(ctx, user.ID, twoFactor); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to confirm two-factor authentication")
+		return
+	}
+
+	h.Log.Info("two-factor authentication enabled", zap.String("user_id", user.ID))
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// REGENERATE RECOVERY CODES
+func (h *TwoFactorHandlers) HandleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code, err := decodeCode(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	user, ok := h.getUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Two-factor authentication is not enabled")
+		return
+	}
+	if err := h.verify(ctx, user, code); err != nil {
+		writeVerifyError(w, err)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		h.Log.Error("failed to generate recovery codes", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to generate recovery codes")
+		return
+	}
+	if err := h.Users.SetRecoveryCodes(ctx, user.ID, hashes); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to generate recovery codes")
+		return
+	}
+
+	h.Log.Info("recovery codes regenerated", zap.String("user_id", user.ID))
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DISABLE
+func (h *TwoFactorHandlers) HandleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := h.getUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactor == nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Two-factor authentication is not enabled")
+		return
+	}
+	// a pending enrollment can be cancelled without a code
+	if user.TwoFactor.Enabled {
+		code, err := decodeCode(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if err := h.verify(ctx, user, code); err != nil {
+			writeVerifyError(w, err)
+			return
+		}
+	}
+
+	if err := h.Users.SetTwoFactor(ctx, user.ID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to disable two-factor authentication")
+		return
+	}
+
+	h.Log.Info("two-factor authentication disabled", zap.String("user_id", user.ID))
+	writeMessage(w, http.StatusOK, "Two-factor authentication disabled")
+}
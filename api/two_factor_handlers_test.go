@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/totp"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTwoFactorLogin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PW", string(hash))
+
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := totp.Step(now)
+	users := newFakeUserDB(model.User{ID: "user123", TwoFactor: &model.TwoFactor{
+		Secret:        totp.EncodeSecret(secret),
+		Enabled:       true,
+		RecoveryCodes: []string{hashRecoveryCode("abcd-efgh")},
+	}})
+	h := newTestPhotoHandlers(newFakePhotoDB())
+	h.Sessions = &fakeSessionDB{}
+	h.TwoFactor = NewTwoFactorHandlers(users, "Photo Backup", zap.NewNop())
+	h.TwoFactor.Now = func() time.Time { return now }
+
+	// the steps run in order, later ones depend on the codes used before
+	for _, test := range []struct {
+		name, password, code string
+		status               int
+		errorCode            string
+	}{
+		{"no code", "hunter2", "", http.StatusUnauthorized, CodeTwoFactorRequired},
+		{"wrong password", "hunter3", totp.Code(secret, step), http.StatusUnauthorized, CodeInvalidCredentials},
+		{"code too old", "hunter2", totp.Code(secret, step-2), http.StatusUnauthorized, CodeInvalidCredentials},
+		{"code too new", "hunter2", totp.Code(secret, step+2), http.StatusUnauthorized, CodeInvalidCredentials},
+		{"previous period", "hunter2", totp.Code(secret, step-1), http.StatusOK, ""},
+		{"code reused", "hunter2", totp.Code(secret, step-1), http.StatusUnauthorized, CodeInvalidCredentials},
+		{"current period", "hunter2", totp.Code(secret, step), http.StatusOK, ""},
+		{"code older than the last used", "hunter2", totp.Code(secret, step-1), http.StatusUnauthorized, CodeInvalidCredentials},
+		{"recovery code", "hunter2", "ABCD EFGH", http.StatusOK, ""},
+		{"recovery code reused", "hunter2", "abcd-efgh", http.StatusUnauthorized, CodeInvalidCredentials},
+	} {
+		body, _ := json.Marshal(LoginRequest{Password: test.password, Code: test.code})
+		rec := serve(t, h.HandleLogin, jsonRequest(http.MethodPost, BasePath+"/login", string(body)), nil)
+		var response ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&response)
+		if rec.Code != test.status || response.Error.Code != test.errorCode {
+			t.Errorf("%s: status %d, error %q, want %d, %q", test.name, rec.Code, response.Error.Code, test.status, test.errorCode)
+		}
+	}
+	if remaining := len(users.users["user123"].TwoFactor.RecoveryCodes); remaining != 0 {
+		t.Errorf("%d recovery codes left, want 0", remaining)
+	}
+}
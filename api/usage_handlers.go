@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"photo-backup/storage"
+	"sort"
+	"strconv"
+)
+
+type UsageTotals struct {
+	Photos         int64 `json:"photos"`
+	OriginalBytes  int64 `json:"originalBytes"`
+	RenditionBytes int64 `json:"renditionBytes"`
+	Bytes          int64 `json:"bytes"`
+}
+
+func (t *UsageTotals) add(bucket storage.UsageBucket) {
+	t.Photos += bucket.Photos
+	t.OriginalBytes += bucket.OriginalBytes
+	t.RenditionBytes += bucket.RenditionBytes
+	t.Bytes += bucket.OriginalBytes + bucket.RenditionBytes
+}
+
+type ContentTypeUsage struct {
+	ContentType string `json:"contentType"`
+	UsageTotals
+}
+
+type YearUsage struct {
+	Year int `json:"year"`
+	UsageTotals
+}
+
+// QuotaResponse describes the storage quota. Bytes and Remaining are
+// omitted when storage is unlimited.
+type QuotaResponse struct {
+	Bytes     *int64 `json:"bytes,omitempty"`
+	Used      int64  `json:"used"`
+	Remaining *int64 `json:"remaining,omitempty"`
+	Unlimited bool   `json:"unlimited"`
+}
+
+type UsageResponse struct {
+	Quota         QuotaResponse      `json:"quota"`
+	Total         UsageTotals        `json:"total"`
+	ByContentType []ContentTypeUsage `json:"byContentType"`
+	ByYear        []YearUsage        `json:"byYear"`
+}
+
+// formatBytes renders a byte count for error messages, e.g. 1.5 GB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// remainingQuota returns how many more bytes the user may store, or -1 if
+// storage is unlimited.
+func (h *PhotoHandlers) remainingQuota(ctx context.Context) (int64, error) {
+	if h.Usage == nil {
+		return -1, nil
+	}
+	userID := UserIDFromContext(ctx)
+
+	quota, err := h.Usage.GetQuota(ctx, userID)
+	if err != nil || quota == 0 {
+		return -1, err
+	}
+	buckets, err := h.Usage.GetUsage(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	return max(quota-storage.TotalBytes(buckets), 0), nil
+}
+
+// USAGE
+func (h *PhotoHandlers) HandleGetUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := UserIDFromContext(ctx)
+
+	if h.Usage == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Usage accounting is not enabled")
+		return
+	}
+	buckets, err := h.Usage.GetUsage(ctx, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch usage")
+		return
+	}
+	quota, err := h.Usage.GetQuota(ctx, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch usage")
+		return
+	}
+
+	response := UsageResponse{ByContentType: []ContentTypeUsage{}, ByYear: []YearUsage{}}
+	byContentType := map[string]*UsageTotals{}
+	byYear := map[int]*UsageTotals{}
+	for _, bucket := range buckets {
+		response.Total.add(bucket)
+		if byContentType[bucket.Key.ContentType] == nil {
+			byContentType[bucket.Key.ContentType] = &UsageTotals{}
+		}
+		byContentType[bucket.Key.ContentType].add(bucket)
+		if byYear[bucket.Key.Year] == nil {
+			byYear[bucket.Key.Year] = &UsageTotals{}
+		}
+		byYear[bucket.Key.Year].add(bucket)
+	}
+	for contentType, totals := range byContentType {
+		response.ByContentType = append(response.ByContentType, ContentTypeUsage{ContentType: contentType, UsageTotals: *totals})
+	}
+	for year, totals := range byYear {
+		response.ByYear = append(response.ByYear, YearUsage{Year: year, UsageTotals: *totals})
+	}
+	sort.Slice(response.ByContentType, func(i, j int) bool {
+		return response.ByContentType[i].Bytes > response.ByContentType[j].Bytes
+	})
+	sort.Slice(response.ByYear, func(i, j int) bool {
+		return response.ByYear[i].Year > response.ByYear[j].Year
+	})
+
+	response.Quota = QuotaResponse{Used: response.Total.Bytes, Unlimited: quota == 0}
+	if quota > 0 {
+		remaining := max(quota-response.Total.Bytes, 0)
+		response.Quota.Bytes = &quota
+		response.Quota.Remaining = &remaining
+	}
+	writeJSON(w, http.StatusOK, response)
+}
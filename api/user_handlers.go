@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+type UserHandlers struct {
+	Users storage.UserDB
+	Log   *zap.Logger
+}
+
+func NewUserHandlers(users storage.UserDB, logger *zap.Logger) *UserHandlers {
+	return &UserHandlers{
+		Users: users,
+		Log:   logger,
+	}
+}
+
+type UserResponse struct {
+	ID               string    `json:"id"`
+	Role             string    `json:"role"`
+	CreatedAt        time.Time `json:"createdAt"`
+	TwoFactorEnabled bool      `json:"twoFactorEnabled"`
+	Email            string    `json:"email,omitempty"` // from the OpenID Connect provider
+	Name             string    `json:"name,omitempty"`
+}
+
+type UserListResponse struct {
+	Users      []UserResponse `json:"users"`
+	Pagination Pagination     `json:"pagination"`
+}
+
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+func newUserResponse(user *model.User) UserResponse {
+	response := UserResponse{
+		ID:               user.ID,
+		Role:             user.EffectiveRole(),
+		CreatedAt:        user.CreatedAt,
+		TwoFactorEnabled: user.TwoFactor != nil && user.TwoFactor.Enabled,
+	}
+	if user.Identity != nil {
+		response.Email = user.Identity.Email
+		response.Name = user.Identity.Name
+	}
+	return response
+}
+
+// LIST
+func (h *UserHandlers) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.Users.GetUsers(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch users")
+		return
+	}
+
+	response := UserListResponse{
+		Users:      make([]UserResponse, len(users)),
+		Pagination: Pagination{Total: int64(len(users))},
+	}
+	for i := range users {
+		response.Users[i] = newUserResponse(&users[i])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// SET ROLE
+func (h *UserHandlers) HandleSetRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	var req SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if !slices.Contains(model.Roles, req.Role) {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown role "+req.Role+", must be one of "+strings.Join(model.Roles, ", "))
+		return
+	}
+
+	user, err := h.Users.GetUser(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch user")
+		return
+	}
+	// the server must keep an admin, or roles could only be fixed in the
+	// database
+	if user.Role == model.RoleAdmin && req.Role != model.RoleAdmin {
+		admins, err := h.Users.CountRole(ctx, model.RoleAdmin)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to count admins")
+			return
+		}
+		if admins <= 1 {
+			writeError(w, http.StatusConflict, CodeConflict, "Cannot remove the role of the last admin")
+			return
+		}
+	}
+
+	if err := h.Users.SetRole(ctx, id, req.Role); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to set role")
+		return
+	}
+	// re-read for the creation time of users the role created
+	if user, err = h.Users.GetUser(ctx, id); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch user")
+		return
+	}
+
+	h.Log.Info("role assigned", zap.String("user_id", id), zap.String("role", req.Role), zap.String("by", UserIDFromContext(ctx)))
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
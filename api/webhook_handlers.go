@@ -0,0 +1,311 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"photo-backup/events"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"photo-backup/webhooks"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const defaultDeliveryLimit = 20
+
+type WebhookHandlers struct {
+	Webhooks storage.WebhookDB
+	Log      *zap.Logger
+}
+
+func NewWebhookHandlers(webhooks storage.WebhookDB, logger *zap.Logger) *WebhookHandlers {
+	return &WebhookHandlers{
+		Webhooks: webhooks,
+		Log:      logger,
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL         string   `json:"url"`
+	Description string   `json:"description"`
+	Events      []string `json:"events"`
+}
+
+type UpdateWebhookRequest struct {
+	URL         *string   `json:"url"`
+	Description *string   `json:"description"`
+	Events      *[]string `json:"events"`
+	Active      *bool     `json:"active"`
+}
+
+type WebhookResponse struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Description string    `json:"description,omitempty"`
+	Events      []string  `json:"events"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Secret      string    `json:"secret,omitempty"` // only returned on creation
+}
+
+type WebhookListResponse struct {
+	Webhooks   []WebhookResponse `json:"webhooks"`
+	Pagination Pagination        `json:"pagination"`
+}
+
+type DeliveryAttemptResponse struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+type WebhookDeliveryResponse struct {
+	ID            string                    `json:"id"`
+	EventID       string                    `json:"eventId"`
+	EventType     string                    `json:"eventType"`
+	Status        string                    `json:"status"`
+	Payload       json.RawMessage           `json:"payload"`
+	Attempts      []DeliveryAttemptResponse `json:"attempts"`
+	NextAttemptAt *time.Time                `json:"nextAttemptAt,omitempty"`
+	CreatedAt     time.Time                 `json:"createdAt"`
+}
+
+type WebhookDeliveryListResponse struct {
+	Deliveries []WebhookDeliveryResponse `json:"deliveries"`
+	Pagination Pagination                `json:"pagination"`
+}
+
+func newWebhookResponse(webhook *model.Webhook) WebhookResponse {
+	response := WebhookResponse{
+		ID:          webhook.ID.Hex(),
+		URL:         webhook.URL,
+		Description: webhook.Description,
+		Events:      webhook.Events,
+		Active:      webhook.Active,
+		CreatedAt:   webhook.CreatedAt,
+	}
+	if response.Events == nil {
+		response.Events = []string{}
+	}
+	return response
+}
+
+func newWebhookDeliveryResponse(delivery *model.WebhookDelivery) WebhookDeliveryResponse {
+	response := WebhookDeliveryResponse{
+		ID:            delivery.ID.Hex(),
+		EventID:       delivery.EventID,
+		EventType:     delivery.EventType,
+		Status:        delivery.Status,
+		Payload:       json.RawMessage(delivery.Payload),
+		Attempts:      make([]DeliveryAttemptResponse, len(delivery.Attempts)),
+		NextAttemptAt: delivery.NextAttemptAt,
+		CreatedAt:     delivery.CreatedAt,
+	}
+	for i, attempt := range delivery.Attempts {
+		response.Attempts[i] = DeliveryAttemptResponse{
+			At:         attempt.At,
+			StatusCode: attempt.StatusCode,
+			Error:      attempt.Error,
+			DurationMs: attempt.Duration.Milliseconds(),
+		}
+	}
+	return response
+}
+
+// validEvents reports whether all event types are known. An empty list
+// subscribes to every event.
+func validEvents(types []string) bool {
+	for _, t := range types {
+		if !events.ValidType(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// CREATE
+func (h *WebhookHandlers) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.Log.Error("failed to decode create webhook request", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if err := webhooks.CheckURL(ctx, req.URL); err != nil {
+		h.Log.Warn("webhook URL rejected", zap.String("url", req.URL), zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid url: "+err.Error())
+		return
+	}
+	if !validEvents(req.Events) {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown event type")
+		return
+	}
+
+	secret, err := webhooks.NewSecret()
+	if err != nil {
+		h.Log.Error("failed to generate webhook secret", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create webhook")
+		return
+	}
+
+	saved, err := h.Webhooks.SaveWebhook(ctx, model.Webhook{
+		OwnerID:     UserIDFromContext(ctx),
+		URL:         req.URL,
+		Description: req.Description,
+		Events:      req.Events,
+		Secret:      secret,
+		Active:      true,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to create webhook")
+		return
+	}
+
+	response := newWebhookResponse(saved)
+	response.Secret = saved.Secret
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// LIST
+func (h *WebhookHandlers) HandleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	list, err := h.Webhooks.GetWebhooks(ctx, UserIDFromContext(ctx))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch webhooks")
+		return
+	}
+
+	response := WebhookListResponse{
+		Webhooks:   make([]WebhookResponse, len(list)),
+		Pagination: Pagination{Total: int64(len(list))},
+	}
+	for i := range list {
+		response.Webhooks[i] = newWebhookResponse(&list[i])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// UPDATE
+func (h *WebhookHandlers) HandleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	var req UpdateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.Log.Error("failed to decode update webhook request", zap.Error(err))
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.URL != nil {
+		if err := webhooks.CheckURL(ctx, *req.URL); err != nil {
+			h.Log.Warn("webhook URL rejected", zap.String("url", *req.URL), zap.Error(err))
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid url: "+err.Error())
+			return
+		}
+	}
+	if req.Events != nil && !validEvents(*req.Events) {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown event type")
+		return
+	}
+
+	webhook, err := h.Webhooks.UpdateWebhook(ctx, id, UserIDFromContext(ctx), storage.WebhookUpdate{
+		URL:         req.URL,
+		Description: req.Description,
+		Events:      req.Events,
+		Active:      req.Active,
+	})
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Webhook not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to update webhook")
+		return
+	}
+
+	h.Log.Info("webhook updated", zap.String("webhook_id", id))
+	writeJSON(w, http.StatusOK, newWebhookResponse(webhook))
+}
+
+// DELETE
+func (h *WebhookHandlers) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	if err := h.Webhooks.DeleteWebhook(ctx, id, UserIDFromContext(ctx)); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Webhook not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to delete webhook")
+		return
+	}
+
+	h.Log.Info("webhook deleted", zap.String("webhook_id", id))
+	writeMessage(w, http.StatusOK, "Webhook deleted successfully")
+}
+
+// DELIVERIES
+func (h *WebhookHandlers) HandleGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	limit := defaultDeliveryLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxPageLimit {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid limit value")
+			return
+		}
+	}
+	var before primitive.ObjectID
+	if cursor := query.Get("cursor"); cursor != "" {
+		var err error
+		if before, err = primitive.ObjectIDFromHex(cursor); err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidCursor, "Invalid cursor")
+			return
+		}
+	}
+
+	webhook, err := h.Webhooks.GetWebhook(ctx, id, UserIDFromContext(ctx))
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Webhook not found")
+		return
+	}
+
+	deliveries, err := h.Webhooks.GetDeliveries(ctx, webhook.ID, before, int64(limit)+1)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch deliveries")
+		return
+	}
+	total, err := h.Webhooks.CountDeliveries(ctx, webhook.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Failed to fetch deliveries")
+		return
+	}
+
+	response := WebhookDeliveryListResponse{
+		Deliveries: []WebhookDeliveryResponse{},
+		Pagination: Pagination{Total: total, Limit: int64(limit)},
+	}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		response.Pagination.NextCursor = deliveries[limit-1].ID.Hex()
+	}
+	for i := range deliveries {
+		response.Deliveries = append(response.Deliveries, newWebhookDeliveryResponse(&deliveries[i]))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+func runCommand(ctx context.Context, name string, args []string, localStorage *storage.LocalPhotoStorage, db storage.PhotoDB, users storage.UserDB, logger *zap.Logger) error {
+	switch name {
+	case "rotate-keys":
+		return rotateKeys(localStorage, logger)
+	case "backfill":
+		return backfill(ctx, localStorage, db, logger)
+	case "recount":
+		return recount(ctx, localStorage, db, logger)
+	case "set-quota":
+		return setQuota(ctx, localStorage, args, logger)
+	case "set-role":
+		return setRole(ctx, users, args, logger)
+	case "link-identity":
+		return linkIdentity(ctx, users, args, logger)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// rotateKeys re-wraps the data key of every encrypted file with the current
+// master key. Old keys must stay configured until the command has finished.
+func rotateKeys(localStorage *storage.LocalPhotoStorage, logger *zap.Logger) error {
+	if localStorage.Keys == nil {
+		return fmt.Errorf("ENCRYPTION_KEYS is not configured")
+	}
+
+	var rotated, failed int
+	err := filepath.WalkDir(localStorage.Directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		ok, err := localStorage.RotateFile(path)
+		if err != nil {
+			failed++
+			logger.Error("failed to rotate file key", zap.String("file_path", path), zap.Error(err))
+			return nil
+		}
+		if ok {
+			rotated++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("key rotation finished", zap.Int("rotated", rotated), zap.Int("failed", failed), zap.String("key_id", localStorage.Keys.CurrentID()))
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be rotated", failed)
+	}
+	return nil
+}
+
+const backfillBatchSize = 100
+
+// backfill assigns change sequences to, and computes the image features
+// (hashes, palette, dimensions and placeholder) of photos uploaded before
+// those were added. It can be re-run safely; photos that already have them
+// are skipped.
+func backfill(ctx context.Context, localStorage *storage.LocalPhotoStorage, db storage.PhotoDB, logger *zap.Logger) error {
+	assigned, err := db.AssignSequences(ctx)
+	if err != nil {
+		return err
+	}
+	logger.Info("assigned change sequences", zap.Int("photos", assigned))
+
+	var updated, failed int
+	var after primitive.ObjectID
+	for {
+		photos, err := db.GetPhotosMissingFeatures(ctx, after, backfillBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(photos) == 0 {
+			break
+		}
+
+		for _, photo := range photos {
+			after = photo.ID
+			if err := backfillPhoto(ctx, localStorage, db, photo.ID, photo.FilePath); err != nil {
+				failed++
+				logger.Error("failed to backfill photo", zap.String("photo_id", photo.ID.Hex()), zap.Error(err))
+				continue
+			}
+			updated++
+		}
+		logger.Info("backfill progress", zap.Int("updated", updated), zap.Int("failed", failed))
+	}
+
+	logger.Info("backfill finished", zap.Int("updated", updated), zap.Int("failed", failed))
+	if failed > 0 {
+		return fmt.Errorf("%d photos could not be backfilled", failed)
+	}
+	return nil
+}
+
+func backfillPhoto(ctx context.Context, localStorage *storage.LocalPhotoStorage, db storage.PhotoDB, id primitive.ObjectID, path string) error {
+	file, err := localStorage.OpenFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	features, err := storage.ComputeFeatures(file)
+	if err != nil {
+		return err
+	}
+	return db.UpdateImageFeatures(ctx, id, features)
+}
+
+// recount rebuilds the storage usage counters from the photos, e.g. after
+// they drifted because of a crash between saving a photo and counting it.
+// Thumbnail sizes not recorded at upload are measured first.
+func recount(ctx context.Context, localStorage *storage.LocalPhotoStorage, db storage.PhotoDB, logger *zap.Logger) error {
+	var measured, failed int
+	var after primitive.ObjectID
+	for {
+		photos, err := db.GetPhotosMissingThumbnailSize(ctx, after, backfillBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(photos) == 0 {
+			break
+		}
+
+		for _, photo := range photos {
+			after = photo.ID
+			file, err := localStorage.OpenFile(photo.ThumbnailPath)
+			if err != nil {
+				failed++
+				logger.Error("failed to open thumbnail", zap.String("photo_id", photo.ID.Hex()), zap.Error(err))
+				continue
+			}
+			size := file.Size()
+			file.Close()
+			if err := db.SetThumbnailSize(ctx, photo.ID, size); err != nil {
+				return err
+			}
+			measured++
+		}
+	}
+	logger.Info("measured thumbnails", zap.Int("measured", measured), zap.Int("failed", failed))
+
+	return db.RecountUsage(ctx)
+}
+
+// setQuota sets the storage quota of a user:
+//
+//	set-quota <user-id> <size>     e.g. 50GB, 500MB or 0 for unlimited
+//	set-quota <user-id> default    reverts to DEFAULT_QUOTA
+func setQuota(ctx context.Context, localStorage *storage.LocalPhotoStorage, args []string, logger *zap.Logger) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set-quota <user-id> <size|default>")
+	}
+	if localStorage.Usage == nil {
+		return fmt.Errorf("usage accounting is not configured")
+	}
+
+	var quota *int64
+	if args[1] != "default" {
+		size, err := parseSize(args[1])
+		if err != nil {
+			return err
+		}
+		quota = &size
+	}
+	if err := localStorage.Usage.SetQuota(ctx, args[0], quota); err != nil {
+		return err
+	}
+	logger.Info("quota set", zap.String("user_id", args[0]), zap.String("quota", args[1]))
+	return nil
+}
+
+// setRole assigns a role to a user, which is how the first admin is made:
+//
+//	set-role <user-id> <admin|member|viewer>
+func setRole(ctx context.Context, users storage.UserDB, args []string, logger *zap.Logger) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set-role <user-id> <%s>", strings.Join(model.Roles, "|"))
+	}
+	if !slices.Contains(model.Roles, args[1]) {
+		return fmt.Errorf("unknown role %q", args[1])
+	}
+	if err := users.SetRole(ctx, args[0], args[1]); err != nil {
+		return err
+	}
+	logger.Info("role set", zap.String("user_id", args[0]), zap.String("role", args[1]))
+	return nil
+}
+
+// linkIdentity links a user to the account of the OpenID Connect provider
+// with the given subject, so users given a role beforehand can log in:
+//
+//	link-identity <user-id> <subject>
+func linkIdentity(ctx context.Context, users storage.UserDB, args []string, logger *zap.Logger) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: link-identity <user-id> <subject>")
+	}
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return fmt.Errorf("OIDC_ISSUER is not configured")
+	}
+	if user, err := users.GetUserByIdentity(ctx, issuer, args[1]); err == nil {
+		return fmt.Errorf("subject %q is linked to user %q", args[1], user.ID)
+	}
+	err := users.LinkIdentity(ctx, args[0], model.Identity{Issuer: issuer, Subject: args[1]})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("user %q does not exist or is linked to another identity", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("identity linked", zap.String("user_id", args[0]), zap.String("subject", args[1]))
+	return nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a byte size such as 512MB or 1.5GB. Units are binary,
+// 1GB is 1024MB.
+func parseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
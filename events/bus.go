@@ -0,0 +1,123 @@
+package events
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const subscriberBuffer = 64
+
+// Publishers fans an event out to several publishers.
+type Publishers []Publisher
+
+func (p Publishers) Publish(ctx context.Context, event Event) {
+	for _, publisher := range p {
+		publisher.Publish(ctx, event)
+	}
+}
+
+// Record is an event as numbered by a Bus.
+type Record struct {
+	ID    string // "<epoch>-<sequence>", unique across restarts
+	Event Event
+}
+
+// Bus is an in-process publisher that live subscribers can listen to. It
+// keeps the most recent events so that reconnecting subscribers can resume
+// after the last event they saw.
+type Bus struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	history     []Record // ring buffer of the last len(history) events
+	next        int      // position of the next record in history
+	size        int      // number of records in history
+	subscribers map[*Subscription]struct{}
+}
+
+func NewBus(historySize int) *Bus {
+	return &Bus{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		history:     make([]Record, historySize),
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Subscription receives the events published after it was created. C is
+// closed when the subscriber falls too far behind; it should reconnect
+// and resume from the last event it received.
+type Subscription struct {
+	C   <-chan Record
+	c   chan Record
+	bus *Bus
+}
+
+func (b *Bus) Publish(ctx context.Context, event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	record := Record{ID: b.epoch + "-" + strconv.FormatUint(b.seq, 10), Event: event}
+	if len(b.history) > 0 {
+		b.history[b.next] = record
+		b.next = (b.next + 1) % len(b.history)
+		if b.size < len(b.history) {
+			b.size++
+		}
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.c <- record:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// Subscribe starts a subscription. When lastID is set, the events published
+// after it are returned for replay; complete is false if some of them are
+// no longer available, because they were dropped from the history or were
+// published before a restart.
+func (b *Bus) Subscribe(lastID string) (sub *Subscription, replay []Record, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan Record, subscriberBuffer)
+	sub = &Subscription{C: c, c: c, bus: b}
+	b.subscribers[sub] = struct{}{}
+
+	if lastID == "" {
+		return sub, nil, true
+	}
+	epoch, seqStr, _ := strings.Cut(lastID, "-")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || epoch != b.epoch || seq > b.seq {
+		return sub, nil, false
+	}
+
+	oldest := b.seq - uint64(b.size) + 1
+	complete = seq+1 >= oldest
+	for i := 0; i < b.size; i++ {
+		record := b.history[(b.next-b.size+i+len(b.history))%len(b.history)]
+		if recordSeq := b.seq - uint64(b.size-1-i); recordSeq > seq {
+			replay = append(replay, record)
+		}
+	}
+	return sub, replay, complete
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,64 @@
+// Package events describes changes to the photo library. The storage layer
+// and the API publish them; webhooks and other consumers subscribe.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	PhotoUploaded  = "photo.uploaded"  // the photo is stored and listed
+	PhotoProcessed = "photo.processed" // thumbnail and image features are ready
+	PhotoUpdated   = "photo.updated"   // user editable metadata changed
+	PhotoDeleted   = "photo.deleted"
+)
+
+// Types lists every event type, e.g. for validating subscriptions.
+var Types = []string{PhotoUploaded, PhotoProcessed, PhotoUpdated, PhotoDeleted}
+
+func ValidType(eventType string) bool {
+	for _, t := range Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	OwnerID   string    `json:"-"` // empty for photos uploaded before ownership was recorded
+	CreatedAt time.Time `json:"createdAt"`
+	Data      Data      `json:"data"`
+}
+
+type Data struct {
+	PhotoID string   `json:"photoId"`
+	Fields  []string `json:"fields,omitempty"` // changed fields of photo.updated
+}
+
+func New(eventType string, ownerID string, data Data) Event {
+	return Event{
+		ID:        newID(),
+		Type:      eventType,
+		OwnerID:   ownerID,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Publisher receives events. Publish must not block on slow consumers and
+// must not fail the change that caused the event.
+type Publisher interface {
+	Publish(ctx context.Context, event Event)
+}
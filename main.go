@@ -6,11 +6,15 @@ import (
 	"net/http"
 	"os"
 	"photo-backup/api"
+	"photo-backup/events"
+	"photo-backup/model"
+	"photo-backup/oidc"
 	"photo-backup/storage"
+	"photo-backup/webhooks"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
 )
@@ -57,35 +61,167 @@ func main() {
 		Log:       logger,
 	}
 
+	// ENCRYPTION
+	if keys := os.Getenv("ENCRYPTION_KEYS"); keys != "" {
+		localStorage.Keys, err = storage.ParseKeyRing(keys, os.Getenv("ENCRYPTION_KEY_ID"))
+		if err != nil {
+			logger.Fatal("Failed to load encryption keys:",
+				zap.String("action", "load_keys"),
+				zap.Error(err),
+			)
+		}
+		logger.Info("encryption at rest enabled", zap.String("key_id", localStorage.Keys.CurrentID()))
+	}
+
+	// USAGE
+	var defaultQuota int64
+	if quota := os.Getenv("DEFAULT_QUOTA"); quota != "" {
+		defaultQuota, err = parseSize(quota)
+		if err != nil {
+			logger.Fatal("Invalid DEFAULT_QUOTA:",
+				zap.String("action", "load_quota"),
+				zap.Error(err),
+			)
+		}
+	}
+	usageDb := storage.NewMongoUsageDB(mongodb.Database(), defaultQuota, logger)
+	localStorage.Usage = usageDb
+
+	// USERS
+	userDb := storage.NewMongoUserDB(mongodb.Database(), logger)
+
+	// COMMANDS
+	if len(os.Args) > 1 {
+		if err := runCommand(context.Background(), os.Args[1], os.Args[2:], localStorage, mongodb, userDb, logger); err != nil {
+			logger.Fatal("Command failed:",
+				zap.String("command", os.Args[1]),
+				zap.Error(err),
+			)
+		}
+		return
+	}
+
+	// SIMILARITY INDEX
+	localStorage.Index = storage.NewSimilarityIndex()
+	indexCtx, indexCancel := context.WithTimeout(context.Background(), time.Minute)
+	if err := localStorage.Index.Load(indexCtx, mongodb); err != nil {
+		logger.Error("failed to load similarity index", zap.Error(err))
+	}
+	indexCancel()
+
 	// COOKIE STORE
-	api.Store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
+	api.Store = api.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
+
+	// WEBHOOKS
+	webhookDb := storage.NewMongoWebhookDB(mongodb.Database(), logger)
+	dispatcher := webhooks.NewDispatcher(webhookDb, logger)
+	dispatcher.CanReceive = api.CanReceiveEvent(userDb)
+	go dispatcher.Run(context.Background())
+
+	// EVENTS
+	bus := events.NewBus(1000)
+	publisher := events.Publishers{bus, dispatcher}
+	localStorage.Events = publisher
+
+	// RATE LIMITS
+	proxies, err := api.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		logger.Fatal("Invalid TRUSTED_PROXIES:",
+			zap.String("action", "load_rate_limits"),
+			zap.Error(err),
+		)
+	}
+	loginLimiter := newRateLimiter(logger, "RATE_LIMIT_LOGIN", "10/m")
+	uploadLimiter := newRateLimiter(logger, "RATE_LIMIT_UPLOAD", "1000/h")
+	apiLimiter := newRateLimiter(logger, "RATE_LIMIT_API", "1200/m")
+
+	// OPENID CONNECT
+	var provider *oidc.Provider
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		provider = oidc.NewProvider(oidc.Config{
+			Issuer:       issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+		})
+		discoverCtx, discoverCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, err := provider.Discover(discoverCtx); err != nil {
+			logger.Error("OIDC discovery failed, retrying on first login", zap.Error(err))
+		}
+		discoverCancel()
+	}
 
 	// HANDLERS
+	sessionDb := storage.NewMongoSessionDB(mongodb.Database(), logger)
 	h := api.NewPhotoHandlers(localStorage, mongodb, logger)
-	r := mux.NewRouter()
-
-	// PUBLIC ROUTES
-	r.HandleFunc("/login", h.HandleLogin).Methods(http.MethodPost, http.MethodOptions)
-
-	// PROTECTED ROUTES
-	protected := r.NewRoute().Subrouter()
-	protected.HandleFunc("/photos", h.HandleGetPhoto).Queries("lastId", "{lastId}", "limit", "{limit}").Methods(http.MethodGet, http.MethodOptions)
-	protected.HandleFunc("/photos/search", h.HandleSearchPhoto).
-		Queries("lastId", "{lastId}", "limit", "{limit}",
-		"latMin", "{latMin}", "latMax", "{latMax}",
-		"longMin", "{longMin}", "longMax", "{longMax}").
-		Methods(http.MethodGet, http.MethodOptions)
-	protected.HandleFunc("/photos", h.HandleUploadPhoto).Methods(http.MethodPost)
-	protected.HandleFunc("/photos", h.HandleDeletePhoto).Queries("id", "{id}").Methods(http.MethodDelete, http.MethodOptions)
-	protected.HandleFunc("/photos/bulk-delete", h.HandleDeleteMultiplePhotos).Methods(http.MethodDelete, http.MethodOptions)
-	protected.PathPrefix("/files/").Handler(http.StripPrefix("/files/", http.FileServer(http.Dir("./.uploads"))))
+	h.Sessions = sessionDb
+	h.Events = publisher
+	h.Usage = usageDb
+	h.Lockout = api.NewLoginLockout()
+	h.TwoFactor = api.NewTwoFactorHandlers(userDb, "Photo Backup", logger)
+	sh := api.NewShareHandlers(h, storage.NewMongoShareDB(mongodb.Database(), logger), logger)
+	wh := api.NewWebhookHandlers(webhookDb, logger)
+	eh := api.NewEventHandlers(bus, logger)
+	deviceDb := storage.NewMongoDeviceDB(mongodb.Database(), logger)
+	dh := api.NewDeviceHandlers(deviceDb, mongodb, logger)
+	ah := api.NewSessionHandlers(sessionDb, logger)
+	apiKeyDb := storage.NewMongoAPIKeyDB(mongodb.Database(), logger)
+	kh := api.NewAPIKeyHandlers(apiKeyDb, logger)
+	uh := api.NewUserHandlers(userDb, logger)
+	oh := api.NewOIDCHandlers(provider, userDb, sessionDb, logger)
+	oh.TwoFactor = h.TwoFactor
+	oh.Lockout = h.Lockout
+	if claim := os.Getenv("OIDC_USERNAME_CLAIM"); claim != "" {
+		oh.UsernameClaim = claim
+	}
+	if role := os.Getenv("OIDC_DEFAULT_ROLE"); role != "" {
+		if !slices.Contains(model.Roles, role) {
+			logger.Fatal("Invalid OIDC_DEFAULT_ROLE:",
+				zap.String("action", "load_oidc"),
+				zap.String("role", role),
+			)
+		}
+		oh.DefaultRole = role
+	}
+	oh.AutoProvision = os.Getenv("OIDC_AUTO_PROVISION") != "false"
+	if url := os.Getenv("OIDC_AFTER_LOGIN_URL"); url != "" {
+		oh.AfterLogin = url
+	}
+	r := api.NewRouter(api.Routes{
+		Photos:      h,
+		TwoFactor:   h.TwoFactor,
+		Shares:      sh,
+		Webhooks:    wh,
+		Events:      eh,
+		Devices:     dh,
+		Sessions:    ah,
+		APIKeys:     kh,
+		Users:       uh,
+		OIDC:        oh,
+		Auth:        api.AuthMiddleware(sessionDb, apiKeyDb, userDb, logger),
+		Device:      api.DeviceMiddleware(deviceDb, logger),
+		LoginLimit:  api.RateLimitMiddleware(loginLimiter, logger),
+		UploadLimit: api.RateLimitMiddleware(uploadLimiter, logger),
+		APILimit:    api.RateLimitMiddleware(apiLimiter, logger),
+	})
 
 	// MIDDLEWARE
-	protected.Use(api.AuthMiddleware(logger))
-
 	r.Use(api.CORSMiddleware())
+	r.Use(api.ClientIPMiddleware(proxies))
 	r.Use(api.RecoveryMiddleware(logger))
 	r.Use(api.RequestLoggerMiddleware(logger))
+	if os.Getenv("OPENAPI_VALIDATE") == "true" {
+		r.Use(api.ResponseValidationMiddleware(logger))
+	}
+
+	// OPENAPI CHECK
+	if err := api.CheckRoutes(r); err != nil {
+		logger.Fatal("Routes are not documented:",
+			zap.String("action", "check_routes"),
+			zap.Error(err),
+		)
+	}
 
 	// START SERVER
 	logger.Info("Starting server on :8080")
@@ -94,3 +230,20 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// newRateLimiter reads the limit of a route group from the environment,
+// e.g. RATE_LIMIT_LOGIN=10/m.
+func newRateLimiter(logger *zap.Logger, env string, fallback string) *api.RateLimiter {
+	spec := os.Getenv(env)
+	if spec == "" {
+		spec = fallback
+	}
+	limit, err := api.ParseRateLimit(spec)
+	if err != nil {
+		logger.Fatal("Invalid "+env+":",
+			zap.String("action", "load_rate_limits"),
+			zap.Error(err),
+		)
+	}
+	return api.NewRateLimiter(limit)
+}
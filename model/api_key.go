@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKey is a credential for scripts, limited to its scopes. Only the hash
+// of the key is stored; Prefix helps users tell their keys apart.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	OwnerID    string             `bson:"owner_id"`
+	Name       string             `bson:"name"`
+	Prefix     string             `bson:"prefix"`
+	TokenHash  string             `bson:"token_hash" json:"-"`
+	Scopes     []string           `bson:"scopes"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty"`
+	LastUsedIP string             `bson:"last_used_ip,omitempty"`
+}
@@ -0,0 +1,25 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Device is a registered backup client, such as a phone or a laptop. It
+// identifies itself with a token, of which only the hash is stored.
+type Device struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	OwnerID    string             `bson:"owner_id"`
+	Name       string             `bson:"name"`
+	TokenHash  string             `bson:"token_hash" json:"-"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	LastSeenAt *time.Time         `bson:"last_seen_at,omitempty"`
+}
+
+// UploadInfo records how a photo reached the server.
+type UploadInfo struct {
+	DeviceID   primitive.ObjectID `bson:"device_id,omitempty"`
+	ClientPath string             `bson:"client_path,omitempty"` // path of the file on the device
+	UploadedAt time.Time          `bson:"uploaded_at,omitempty"`
+}
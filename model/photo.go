@@ -8,13 +8,55 @@ import (
 
 type PhotoDB struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty"`
-	LonLat        *GeoPoint           `bson:"lonlat,omitempty"`
+	OwnerID       string             `bson:"owner_id,omitempty"`
+	LonLat        *GeoPoint          `bson:"lonlat,omitempty"`
 	TakenAt       time.Time          `bson:"taken_at,omitempty"`
 	FilePath      string             `bson:"file_path"`
 	ThumbnailPath string             `bson:"thumbnail_path,omitempty"`
+	ThumbnailSize int64              `bson:"thumbnail_size,omitempty"`
 	Metadata      map[string]any     `bson:"metadata,omitempty"`
 	Size          int64              `bson:"size"`
 	ContentType   string             `bson:"content_type"`
+	Camera        string             `bson:"camera,omitempty"`
+	Caption       string             `bson:"caption,omitempty"`
+	Tags          []string           `bson:"tags,omitempty"`
+	Favorite      bool               `bson:"favorite,omitempty"`
+	Rating        int                `bson:"rating,omitempty"` // 1-5 stars, 0 when unrated
+	Archived      bool               `bson:"archived,omitempty"`
+	Seq           int64              `bson:"seq,omitempty"`         // change sequence of the last modification
+	CreatedSeq    int64              `bson:"created_seq,omitempty"` // change sequence of the upload
+	ImageFeatures `bson:",inline"`
+	UploadInfo    `bson:",inline"`
+}
+
+// Tombstone records a deleted photo, so that syncing clients learn about
+// the deletion.
+type Tombstone struct {
+	ID        primitive.ObjectID `bson:"_id"` // ID of the deleted photo
+	OwnerID   string             `bson:"owner_id,omitempty"`
+	Seq       int64              `bson:"seq"`
+	DeletedAt time.Time          `bson:"deleted_at"`
+}
+
+// ImageFeatures are computed from the image content during ingest.
+type ImageFeatures struct {
+	Hash      string         `bson:"hash,omitempty"`   // SHA-256 of the original file, hex encoded
+	Width     int            `bson:"width,omitempty"`  // pixels, after applying the EXIF orientation
+	Height    int            `bson:"height,omitempty"` // pixels, after applying the EXIF orientation
+	BlurHash  string         `bson:"blurhash,omitempty"`
+	PHash     string         `bson:"phash,omitempty"`              // 64-bit difference hash, hex encoded
+	Histogram []float64      `bson:"histogram,omitempty" json:"-"` // 4x4x4 RGB color histogram
+	Palette   []PaletteColor `bson:"palette,omitempty"`            // dominant colors, most common first
+}
+
+// PaletteColor is a dominant color of a photo with its CIELAB coordinates
+// and the share of the thumbnail it covers.
+type PaletteColor struct {
+	Hex    string  `bson:"hex"`
+	L      float64 `bson:"l"`
+	A      float64 `bson:"a"`
+	B      float64 `bson:"b"`
+	Weight float64 `bson:"weight"`
 }
 
 type GeoPoint struct {
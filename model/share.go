@@ -0,0 +1,37 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ShareLink struct {
+	ID            primitive.ObjectID   `bson:"_id,omitempty"`
+	Token         string               `bson:"token"`
+	OwnerID       string               `bson:"owner_id"`
+	PhotoIDs      []primitive.ObjectID `bson:"photo_ids"`
+	PasswordHash  string               `bson:"password_hash,omitempty" json:"-"`
+	AllowDownload bool                 `bson:"allow_download"`
+	ExpiresAt     *time.Time           `bson:"expires_at,omitempty"`
+	CreatedAt     time.Time            `bson:"created_at"`
+	RevokedAt     *time.Time           `bson:"revoked_at,omitempty"`
+}
+
+// Active reports whether the link can still be used at the given time.
+func (s *ShareLink) Active(now time.Time) bool {
+	if s.RevokedAt != nil {
+		return false
+	}
+	return s.ExpiresAt == nil || now.Before(*s.ExpiresAt)
+}
+
+// Contains reports whether the photo is part of the share.
+func (s *ShareLink) Contains(photoID primitive.ObjectID) bool {
+	for _, id := range s.PhotoIDs {
+		if id == photoID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package model
+
+import "time"
+
+// Roles of users. Admins manage users, members own and upload photos and
+// viewers may only browse.
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleViewer = "viewer"
+)
+
+var Roles = []string{RoleAdmin, RoleMember, RoleViewer}
+
+// User holds the settings of an account that are stored in the database.
+type User struct {
+	ID        string     `bson:"_id"`
+	CreatedAt time.Time  `bson:"created_at"`
+	Role      string     `bson:"role,omitempty"` // RoleMember if not set
+	TwoFactor *TwoFactor `bson:"two_factor,omitempty"`
+	Identity  *Identity  `bson:"identity,omitempty"` // set once the user logged in with OpenID Connect
+}
+
+// Identity links a user to an account of an OpenID Connect provider. Email
+// and Name are copied from the ID token on every login.
+type Identity struct {
+	Issuer  string `bson:"issuer"`
+	Subject string `bson:"subject"`
+	Email   string `bson:"email,omitempty"`
+	Name    string `bson:"name,omitempty"`
+}
+
+// EffectiveRole returns the role of the user, members being the default.
+func (u *User) EffectiveRole() string {
+	if u.Role == "" {
+		return RoleMember
+	}
+	return u.Role
+}
+
+// TwoFactor is the TOTP configuration of a user. It is pending until the
+// user confirms it with a first code.
+type TwoFactor struct {
+	Secret        string     `bson:"secret"` // base32
+	Enabled       bool       `bson:"enabled"`
+	EnabledAt     *time.Time `bson:"enabled_at,omitempty"`
+	LastStep      int64      `bson:"last_step"`      // step of the last accepted code, to reject replays
+	RecoveryCodes []string   `bson:"recovery_codes"` // SHA-256 hashes of the unused codes
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Webhook struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	OwnerID     string             `bson:"owner_id"`
+	URL         string             `bson:"url"`
+	Description string             `bson:"description,omitempty"`
+	Events      []string           `bson:"events,omitempty"` // all events when empty
+	Secret      string             `bson:"secret" json:"-"`
+	Active      bool               `bson:"active"`
+	CreatedAt   time.Time          `bson:"created_at"`
+}
+
+// Subscribes reports whether the webhook wants events of the given type.
+func (w *Webhook) Subscribes(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event sent to one webhook, with every attempt made
+// so far. The payload is stored so that retries send the same body.
+type WebhookDelivery struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	WebhookID     primitive.ObjectID `bson:"webhook_id"`
+	OwnerID       string             `bson:"owner_id"`
+	EventID       string             `bson:"event_id"`
+	EventType     string             `bson:"event_type"`
+	Payload       string             `bson:"payload"`
+	Status        string             `bson:"status"`
+	Attempts      []DeliveryAttempt  `bson:"attempts"`
+	NextAttemptAt *time.Time         `bson:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at"`
+}
+
+type DeliveryAttempt struct {
+	At         time.Time     `bson:"at"`
+	StatusCode int           `bson:"status_code,omitempty"`
+	Error      string        `bson:"error,omitempty"`
+	Duration   time.Duration `bson:"duration"`
+}
@@ -0,0 +1,128 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"photo-backup/oidc/oidctest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProvider returns a fake provider and a client of it with a clock
+// that tests can move.
+func newTestProvider(t *testing.T) (*oidctest.Server, *Provider, *time.Time) {
+	idp := oidctest.NewServer("photos")
+	t.Cleanup(idp.Close)
+	now := time.Now()
+	idp.Now = func() time.Time { return now }
+
+	p := NewProvider(Config{Issuer: idp.Issuer(), ClientID: "photos", RedirectURL: "https://photos.example.com/callback"})
+	p.Client = idp.Client()
+	p.Now = func() time.Time { return now }
+	return idp, p, &now
+}
+
+// login runs the flow up to the token exchange, which uses verifier and
+// nonce as given.
+func login(t *testing.T, idp *oidctest.Server, p *Provider, verifier, nonce string) (*IDToken, error) {
+	t.Helper()
+	ctx := context.Background()
+	authURL, err := p.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state, err := idp.Authorize(authURL)
+	if err != nil || state != "state" {
+		t.Fatalf("authorize: %v, state %q", err, state)
+	}
+	return p.Exchange(ctx, code, verifier, nonce)
+}
+
+func TestExchange(t *testing.T) {
+	idp, p, _ := newTestProvider(t)
+	idp.Claims["preferred_username"] = "alice"
+
+	token, err := login(t, idp, p, "verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Issuer != idp.Issuer() || token.Subject != idp.Subject || token.String("preferred_username") != "alice" {
+		t.Errorf("token %+v", token)
+	}
+}
+
+func TestExchangeChecksPKCE(t *testing.T) {
+	idp, p, _ := newTestProvider(t)
+	if _, err := login(t, idp, p, "another verifier", "nonce"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("exchange with the wrong verifier: %v", err)
+	}
+}
+
+func TestVerifyRejectsTokens(t *testing.T) {
+	for name, test := range map[string]struct {
+		claims  map[string]interface{}
+		nonce   string
+		advance time.Duration // of the clock between issuing and verifying
+		want    string
+	}{
+		"wrong issuer":     {claims: map[string]interface{}{"iss": "https://evil.example.com"}, want: "invalid issuer"},
+		"wrong audience":   {claims: map[string]interface{}{"aud": "another-client"}, want: "invalid audience"},
+		"foreign azp":      {claims: map[string]interface{}{"aud": []string{"photos", "other"}, "azp": "other"}, want: "authorized party mismatch"},
+		"wrong nonce":      {nonce: "another nonce", want: "nonce mismatch"},
+		"expired":          {advance: time.Hour + 2*Leeway, want: "token is expired"},
+		"without expiry":   {claims: map[string]interface{}{"exp": nil}, want: "exp claim is required"},
+		"issued in future": {claims: map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()}, want: "used before issued"},
+		"without subject":  {claims: map[string]interface{}{"sub": nil}, want: "no subject"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			idp, p, now := newTestProvider(t)
+			for claim, value := range test.claims {
+				idp.Claims[claim] = value
+			}
+			if test.nonce == "" {
+				test.nonce = "nonce"
+			}
+			p.Now = func() time.Time { return now.Add(test.advance) }
+			_, err := login(t, idp, p, "verifier", test.nonce)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestUnknownKeyRefreshesJWKS(t *testing.T) {
+	idp, p, now := newTestProvider(t)
+	if _, err := login(t, idp, p, "verifier", "nonce"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rotation right after the keys were fetched waits for the
+	// refresh interval, so that tokens can't make the server fetch them
+	// on every request
+	idp.RotateKey()
+	if _, err := login(t, idp, p, "verifier", "nonce"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token of a new key within the refresh interval: %v", err)
+	}
+	if fetches := idp.JWKSFetches(); fetches != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", fetches)
+	}
+
+	*now = now.Add(keyRefreshInterval)
+	if _, err := login(t, idp, p, "verifier", "nonce"); err != nil {
+		t.Errorf("token of a new key: %v", err)
+	}
+	if fetches := idp.JWKSFetches(); fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", fetches)
+	}
+}
+
+func TestDiscoverChecksIssuer(t *testing.T) {
+	idp, _, _ := newTestProvider(t)
+	p := NewProvider(Config{Issuer: idp.Issuer() + "/", ClientID: "photos"})
+	p.Client = idp.Client()
+	if _, err := p.Discover(context.Background()); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("discovery of another issuer: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type APIKeyDB interface {
+	SaveAPIKey(ctx context.Context, key model.APIKey) (*model.APIKey, error)
+	GetAPIKeys(ctx context.Context, ownerID string) ([]model.APIKey, error)
+	GetAPIKeyByTokenHash(ctx context.Context, tokenHash string) (*model.APIKey, error)
+	DeleteAPIKey(ctx context.Context, id string, ownerID string) error
+	TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time, ip string) error
+}
+
+type MongoAPIKeyDB struct {
+	collection *mongo.Collection
+	Log        *zap.Logger
+}
+
+func NewMongoAPIKeyDB(database *mongo.Database, logger *zap.Logger) *MongoAPIKeyDB {
+	return &MongoAPIKeyDB{
+		collection: database.Collection("api_keys"),
+		Log:        logger,
+	}
+}
+
+func (db *MongoAPIKeyDB) SaveAPIKey(ctx context.Context, key model.APIKey) (*model.APIKey, error) {
+	result, err := db.collection.InsertOne(ctx, key)
+	if err != nil {
+		db.Log.Error("failed to save API key to MongoDB", zap.Error(err), zap.String("owner_id", key.OwnerID))
+		return nil, err
+	}
+	oid, ok := result.InsertedID.(primitive.ObjectID)
+	if !ok {
+		db.Log.Error("invalid ObjectID returned from MongoDB insert", zap.Any("inserted_id", result.InsertedID))
+		return nil, mongo.ErrInvalidIndexValue
+	}
+	key.ID = oid
+	db.Log.Info("API key saved to MongoDB", zap.String("api_key_id", oid.Hex()))
+	return &key, nil
+}
+
+// GetAPIKeys returns the keys of the owner, expired ones included, newest
+// first.
+func (db *MongoAPIKeyDB) GetAPIKeys(ctx context.Context, ownerID string) ([]model.APIKey, error) {
+	keys := []model.APIKey{}
+
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	output, err := db.collection.Find(ctx, bson.M{"owner_id": ownerID}, opts)
+	if err != nil {
+		db.Log.Error("failed to query API keys from MongoDB", zap.Error(err), zap.String("owner_id", ownerID))
+		return nil, err
+	}
+	if err = output.All(ctx, &keys); err != nil {
+		db.Log.Error("failed to decode API keys from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (db *MongoAPIKeyDB) GetAPIKeyByTokenHash(ctx context.Context, tokenHash string) (*model.APIKey, error) {
+	var key model.APIKey
+
+	if err := db.collection.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&key); err != nil {
+		db.Log.Info("failed to get API key from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (db *MongoAPIKeyDB) DeleteAPIKey(ctx context.Context, id string, ownerID string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+
+	result, err := db.collection.DeleteOne(ctx, bson.M{"_id": oid, "owner_id": ownerID})
+	if err != nil {
+		db.Log.Error("failed to delete API key from MongoDB", zap.Error(err), zap.String("api_key_id", id))
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	db.Log.Info("API key deleted from MongoDB", zap.String("api_key_id", id))
+	return nil
+}
+
+func (db *MongoAPIKeyDB) TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time, ip string) error {
+	update := bson.M{"$set": bson.M{"last_used_at": usedAt, "last_used_ip": ip}}
+	if _, err := db.collection.UpdateByID(ctx, id, update); err != nil {
+		db.Log.Error("failed to update API key last used time in MongoDB", zap.Error(err), zap.String("api_key_id", id.Hex()))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"photo-backup/model"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// LabColor is a color in CIELAB (D65), where the Euclidean distance roughly
+// matches perceived color difference (ΔE76). A distance below ~2 is hardly
+// visible, around 10 colors are similar and above ~40 clearly different.
+type LabColor struct {
+	L float64 `json:"l"`
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+}
+
+func (c LabColor) Distance(other LabColor) float64 {
+	return math.Sqrt((c.L-other.L)*(c.L-other.L) + (c.A-other.A)*(c.A-other.A) + (c.B-other.B)*(c.B-other.B))
+}
+
+// ParseHexColor parses "#rrggbb" or "rrggbb" into CIELAB.
+func ParseHexColor(hex string) (LabColor, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return LabColor{}, fmt.Errorf("invalid hex color %q", hex)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return LabColor{}, fmt.Errorf("invalid hex color %q", hex)
+	}
+	return rgbToLab(float64(rgb>>16&0xff), float64(rgb>>8&0xff), float64(rgb&0xff)), nil
+}
+
+func rgbToLab(r, g, b float64) LabColor {
+	linear := func(c float64) float64 {
+		c /= 255
+		if c <= 0.04045 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	rl, gl, bl := linear(r), linear(g), linear(b)
+
+	// sRGB to XYZ, normalized by the D65 white point
+	x := (0.4124564*rl + 0.3575761*gl + 0.1804375*bl) / 0.95047
+	y := 0.2126729*rl + 0.7151522*gl + 0.0721750*bl
+	z := (0.0193339*rl + 0.1191920*gl + 0.9503041*bl) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return LabColor{L: 116*fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+func labToRGB(c LabColor) (uint8, uint8, uint8) {
+	fy := (c.L + 16) / 116
+	fx := fy + c.A/500
+	fz := fy - c.B/200
+	finv := func(t float64) float64 {
+		if t*t*t > 216.0/24389 {
+			return t * t * t
+		}
+		return (116*t - 16) / (24389.0 / 27)
+	}
+	x, y, z := finv(fx)*0.95047, finv(fy), finv(fz)*1.08883
+
+	rl := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	gl := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	bl := 0.0556434*x - 0.2040259*y + 1.0572252*z
+
+	gamma := func(c float64) uint8 {
+		if c <= 0.0031308 {
+			c *= 12.92
+		} else {
+			c = 1.055*math.Pow(c, 1/2.4) - 0.055
+		}
+		return uint8(math.Round(math.Max(0, math.Min(1, c)) * 255))
+	}
+	return gamma(rl), gamma(gl), gamma(bl)
+}
+
+// dominantColors clusters the pixels of a (small) image with k-means in
+// CIELAB and returns up to k colors, most common first. The clusters are
+// seeded with the most populated coarse RGB buckets, so the result is
+// deterministic.
+func dominantColors(img image.Image, k int) []model.PaletteColor {
+	bounds := img.Bounds()
+	var pixels []LabColor
+	buckets := map[int][]int{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+			r8, g8, b8 := r>>8, g>>8, b>>8
+			bucket := int(r8>>5)<<6 | int(g8>>5)<<3 | int(b8>>5)
+			buckets[bucket] = append(buckets[bucket], len(pixels))
+			pixels = append(pixels, rgbToLab(float64(r8), float64(g8), float64(b8)))
+		}
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	seeds := make([]int, 0, len(buckets))
+	for bucket := range buckets {
+		seeds = append(seeds, bucket)
+	}
+	sort.Slice(seeds, func(a, b int) bool {
+		if len(buckets[seeds[a]]) != len(buckets[seeds[b]]) {
+			return len(buckets[seeds[a]]) > len(buckets[seeds[b]])
+		}
+		return seeds[a] < seeds[b]
+	})
+	if len(seeds) < k {
+		k = len(seeds)
+	}
+	centers := make([]LabColor, k)
+	for i := range centers {
+		centers[i] = meanColor(pixels, buckets[seeds[i]])
+	}
+
+	assignment := make([]int, len(pixels))
+	for iteration := 0; iteration < 10; iteration++ {
+		members := make([][]int, k)
+		for i, pixel := range pixels {
+			best := 0
+			for c := 1; c < k; c++ {
+				if pixel.Distance(centers[c]) < pixel.Distance(centers[best]) {
+					best = c
+				}
+			}
+			assignment[i] = best
+			members[best] = append(members[best], i)
+		}
+		for c := range centers {
+			if len(members[c]) > 0 {
+				centers[c] = meanColor(pixels, members[c])
+			}
+		}
+	}
+
+	counts := make([]int, k)
+	for _, c := range assignment {
+		counts[c]++
+	}
+	palette := make([]model.PaletteColor, 0, k)
+	for c, center := range centers {
+		if counts[c] == 0 {
+			continue
+		}
+		r, g, b := labToRGB(center)
+		palette = append(palette, model.PaletteColor{
+			Hex:    fmt.Sprintf("#%02x%02x%02x", r, g, b),
+			L:      math.Round(center.L*10) / 10,
+			A:      math.Round(center.A*10) / 10,
+			B:      math.Round(center.B*10) / 10,
+			Weight: math.Round(float64(counts[c])/float64(len(pixels))*1000) / 1000,
+		})
+	}
+	sort.SliceStable(palette, func(a, b int) bool {
+		return palette[a].Weight > palette[b].Weight
+	})
+	return palette
+}
+
+func meanColor(pixels []LabColor, indexes []int) LabColor {
+	var sum LabColor
+	for _, i := range indexes {
+		sum.L += pixels[i].L
+		sum.A += pixels[i].A
+		sum.B += pixels[i].B
+	}
+	n := float64(len(indexes))
+	return LabColor{L: sum.L / n, A: sum.A / n, B: sum.B / n}
+}
+
+// minPaletteWeight ignores palette colors that only cover a small part of
+// the photo when filtering by color.
+const minPaletteWeight = 0.05
+
+// colorFilter matches photos with a dominant color within distance of c.
+// The $elemMatch on the surrounding cube can use an index on the palette,
+// the $expr then keeps only colors inside the sphere.
+func colorFilter(c LabColor, distance float64) bson.M {
+	cube := bson.M{"$elemMatch": bson.M{
+		"l":      bson.M{"$gte": c.L - distance, "$lte": c.L + distance},
+		"a":      bson.M{"$gte": c.A - distance, "$lte": c.A + distance},
+		"b":      bson.M{"$gte": c.B - distance, "$lte": c.B + distance},
+		"weight": bson.M{"$gte": minPaletteWeight},
+	}}
+
+	squared := func(field string, value float64) bson.M {
+		return bson.M{"$pow": bson.A{bson.M{"$subtract": bson.A{"$$c." + field, value}}, 2}}
+	}
+	sphere := bson.M{"$expr": bson.M{"$gt": bson.A{
+		bson.M{"$size": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$palette", bson.A{}}},
+			"as":    "c",
+			"cond": bson.M{"$and": bson.A{
+				bson.M{"$gte": bson.A{"$$c.weight", minPaletteWeight}},
+				bson.M{"$lte": bson.A{
+					bson.M{"$add": bson.A{squared("l", c.L), squared("a", c.A), squared("b", c.B)}},
+					distance * distance,
+				}},
+			}},
+		}}},
+		0,
+	}}}
+
+	return bson.M{"$and": bson.A{bson.M{"palette": cube}, sphere}}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type DeviceDB interface {
+	SaveDevice(ctx context.Context, device model.Device) (*model.Device, error)
+	GetDevices(ctx context.Context, ownerID string) ([]model.Device, error)
+	GetDeviceByTokenHash(ctx context.Context, tokenHash string) (*model.Device, error)
+	RenameDevice(ctx context.Context, id string, ownerID string, name string) (*model.Device, error)
+	DeleteDevice(ctx context.Context, id string, ownerID string) error
+	TouchDevice(ctx context.Context, id primitive.ObjectID, seenAt time.Time) error
+}
+
+// DeviceStats summarizes the photos uploaded by a device.
+type DeviceStats struct {
+	DeviceID     primitive.ObjectID `bson:"_id"`
+	Photos       int64              `bson:"photos"`
+	Bytes        int64              `bson:"bytes"`
+	LastUploadAt time.Time          `bson:"last_upload_at"`
+}
+
+type MongoDeviceDB struct {
+	collection *mongo.Collection
+	Log        *zap.Logger
+}
+
+func NewMongoDeviceDB(database *mongo.Database, logger *zap.Logger) *MongoDeviceDB {
+	return &MongoDeviceDB{
+		collection: database.Collection("devices"),
+		Log:        logger,
+	}
+}
+
+func (db *MongoDeviceDB) SaveDevice(ctx context.Context, device model.Device) (*model.Device, error) {
+	result, err := db.collection.InsertOne(ctx, device)
+	if err != nil {
+		db.Log.Error("failed to save device to MongoDB", zap.Error(err), zap.String("owner_id", device.OwnerID))
+		return nil, err
+	}
+	oid, ok := result.InsertedID.(primitive.ObjectID)
+	if !ok {
+		db.Log.Error("invalid ObjectID returned from MongoDB insert", zap.Any("inserted_id", result.InsertedID))
+		return nil, mongo.ErrInvalidIndexValue
+	}
+	device.ID = oid
+	db.Log.Info("device saved to MongoDB", zap.String("device_id", oid.Hex()))
+	return &device, nil
+}
+
+func (db *MongoDeviceDB) GetDevices(ctx context.Context, ownerID string) ([]model.Device, error) {
+	devices := []model.Device{}
+
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	output, err := db.collection.Find(ctx, bson.M{"owner_id": ownerID}, opts)
+	if err != nil {
+		db.Log.Error("failed to query devices from MongoDB", zap.Error(err), zap.String("owner_id", ownerID))
+		return nil, err
+	}
+	if err = output.All(ctx, &devices); err != nil {
+		db.Log.Error("failed to decode devices from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (db *MongoDeviceDB) GetDeviceByTokenHash(ctx context.Context, tokenHash string) (*model.Device, error) {
+	var device model.Device
+
+	if err := db.collection.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&device); err != nil {
+		db.Log.Info("failed to get device from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (db *MongoDeviceDB) RenameDevice(ctx context.Context, id string, ownerID string, name string) (*model.Device, error) {
+	var device model.Device
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	filter := bson.M{"_id": oid, "owner_id": ownerID}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := db.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"name": name}}, opts).Decode(&device); err != nil {
+		db.Log.Info("failed to rename device in MongoDB", zap.Error(err), zap.String("device_id", id))
+		return nil, err
+	}
+	db.Log.Info("device renamed in MongoDB", zap.String("device_id", id))
+	return &device, nil
+}
+
+// DeleteDevice revokes the device's token. Its photos keep their
+// attribution.
+func (db *MongoDeviceDB) DeleteDevice(ctx context.Context, id string, ownerID string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+
+	result, err := db.collection.DeleteOne(ctx, bson.M{"_id": oid, "owner_id": ownerID})
+	if err != nil {
+		db.Log.Error("failed to delete device from MongoDB", zap.Error(err), zap.String("device_id", id))
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	db.Log.Info("device deleted from MongoDB", zap.String("device_id", id))
+	return nil
+}
+
+func (db *MongoDeviceDB) TouchDevice(ctx context.Context, id primitive.ObjectID, seenAt time.Time) error {
+	_, err := db.collection.UpdateByID(ctx, id, bson.M{"$max": bson.M{"last_seen_at": seenAt}})
+	if err != nil {
+		db.Log.Error("failed to update device last seen time in MongoDB", zap.Error(err), zap.String("device_id", id.Hex()))
+		return err
+	}
+	return nil
+}
+
+// GetDeviceStats counts the photos and bytes the owner uploaded from each
+// device.
+func (db *MongoPhotoDB) GetDeviceStats(ctx context.Context, ownerID string) ([]DeviceStats, error) {
+	stats := []DeviceStats{}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"device_id": bson.M{"$exists": true}, "$or": ownedBy(ownerID)}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            "$device_id",
+			"photos":         bson.M{"$sum": 1},
+			"bytes":          bson.M{"$sum": "$size"},
+			"last_upload_at": bson.M{"$max": "$uploaded_at"},
+		}}},
+	}
+	output, err := db.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		db.Log.Error("failed to aggregate device stats in MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &stats); err != nil {
+		db.Log.Error("failed to decode device stats from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"photo-backup/model"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GroupSimilar groups photos whose perceptual hashes differ in at most
+// maxDistance bits. Similarity is transitive, so a group can contain photos
+// that are further apart than maxDistance through a chain of similar ones.
+// With a positive burstWindow, photos are only grouped when they were taken
+// at most that far apart. Photos without a hash and groups of one are left
+// out.
+func GroupSimilar(photos []model.PhotoDB, maxDistance int, burstWindow time.Duration) [][]model.PhotoDB {
+	type entry struct {
+		index int
+		hash  uint64
+	}
+	entries := make([]entry, 0, len(photos))
+	for i, photo := range photos {
+		hash, err := ParseHash(photo.PHash)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{index: i, hash: hash})
+	}
+
+	parent := make([]int, len(photos))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) {
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[rb] = ra
+		}
+	}
+
+	if burstWindow > 0 {
+		// only photos inside the window need to be compared
+		sort.Slice(entries, func(a, b int) bool {
+			return photos[entries[a].index].TakenAt.Before(photos[entries[b].index].TakenAt)
+		})
+		for a := 0; a < len(entries); a++ {
+			for b := a + 1; b < len(entries); b++ {
+				if photos[entries[b].index].TakenAt.Sub(photos[entries[a].index].TakenAt) > burstWindow {
+					break
+				}
+				if HammingDistance(entries[a].hash, entries[b].hash) <= maxDistance {
+					union(entries[a].index, entries[b].index)
+				}
+			}
+		}
+	} else {
+		// look up the neighbours of every photo in a BK-tree instead of
+		// comparing all pairs
+		var tree bkTree
+		position := map[primitive.ObjectID]int{}
+		for _, e := range entries {
+			tree.add(indexEntry{id: photos[e.index].ID}, e.hash)
+			position[photos[e.index].ID] = e.index
+		}
+		for _, e := range entries {
+			tree.search(e.hash, maxDistance, func(entry indexEntry, _ int) {
+				union(e.index, position[entry.id])
+			})
+		}
+	}
+
+	byRoot := map[int][]model.PhotoDB{}
+	var roots []int
+	for _, e := range entries {
+		root := find(e.index)
+		if _, ok := byRoot[root]; !ok {
+			roots = append(roots, root)
+		}
+		byRoot[root] = append(byRoot[root], photos[e.index])
+	}
+
+	var groups [][]model.PhotoDB
+	for _, root := range roots {
+		if len(byRoot[root]) > 1 {
+			groups = append(groups, byRoot[root])
+		}
+	}
+	return groups
+}
+
+// BestPhoto picks the photo of a group worth keeping: favorites first, then
+// the highest rating, then the largest file, which usually is the least
+// compressed copy.
+func BestPhoto(group []model.PhotoDB) model.PhotoDB {
+	best := group[0]
+	for _, photo := range group[1:] {
+		switch {
+		case photo.Favorite != best.Favorite:
+			if photo.Favorite {
+				best = photo
+			}
+		case photo.Rating != best.Rating:
+			if photo.Rating > best.Rating {
+				best = photo
+			}
+		case photo.Size > best.Size:
+			best = photo
+		}
+	}
+	return best
+}
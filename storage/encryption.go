@@ -0,0 +1,543 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files start with a small header followed by the ciphertext
+// segments:
+//
+//	magic (4) | key id length (1) | key id | wrapped key length (2) | wrapped key | nonce prefix (7)
+//
+// Every segment holds up to segmentSize bytes of plaintext sealed with
+// AES-256-GCM under the file's data key. The segment nonce is the nonce
+// prefix, the big-endian segment counter and a flag marking the last
+// segment, so segments can't be reordered, dropped or truncated unnoticed.
+const (
+	segmentSize     = 64 * 1024
+	noncePrefixSize = 7
+	dataKeySize     = 32
+)
+
+var encryptionMagic = []byte("PBE1")
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// KeyRing holds the master keys used to wrap per-file data keys. New files
+// are always wrapped with the current key; older keys are kept so existing
+// files stay readable until they are rotated.
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// ParseKeyRing parses a comma separated list of "id:base64key" pairs, where
+// every key must decode to 32 bytes.
+func ParseKeyRing(spec, current string) (*KeyRing, error) {
+	ring := &KeyRing{current: current, keys: map[string][]byte{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key entry %q", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+		}
+		ring.keys[id] = key
+	}
+	if _, ok := ring.keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q not found in key ring", current)
+	}
+	return ring, nil
+}
+
+func (k *KeyRing) CurrentID() string {
+	return k.current
+}
+
+func (k *KeyRing) wrap(id string, dataKey []byte) ([]byte, error) {
+	aead, err := k.masterAEAD(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+func (k *KeyRing) unwrap(id string, wrapped []byte) ([]byte, error) {
+	aead, err := k.masterAEAD(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+func (k *KeyRing) masterAEAD(id string) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return newGCM(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type fileHeader struct {
+	keyID       string
+	wrappedKey  []byte
+	noncePrefix []byte
+}
+
+func (h fileHeader) size() int64 {
+	return int64(len(encryptionMagic) + 1 + len(h.keyID) + 2 + len(h.wrappedKey) + noncePrefixSize)
+}
+
+func (h fileHeader) write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.Write(encryptionMagic)
+	buf.WriteByte(byte(len(h.keyID)))
+	buf.WriteString(h.keyID)
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.wrappedKey)))
+	buf.Write(h.wrappedKey)
+	buf.Write(h.noncePrefix)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readFileHeader(r io.Reader) (*fileHeader, error) {
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, encryptionMagic) {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+
+	var idLen [1]byte
+	if _, err := io.ReadFull(r, idLen[:]); err != nil {
+		return nil, err
+	}
+	keyID := make([]byte, idLen[0])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, err
+	}
+
+	var wrappedLen uint16
+	if err := binary.Read(r, binary.BigEndian, &wrappedLen); err != nil {
+		return nil, err
+	}
+	wrapped := make([]byte, wrappedLen)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	return &fileHeader{keyID: string(keyID), wrappedKey: wrapped, noncePrefix: prefix}, nil
+}
+
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[noncePrefixSize+4] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals everything written to it into segments. A full
+// segment is only flushed once more data arrives, so that Close can always
+// mark the final segment as last.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	index  uint32
+	closed bool
+}
+
+func newEncryptWriter(w io.Writer, keys *KeyRing) (*encryptWriter, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := keys.wrap(keys.current, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := fileHeader{keyID: keys.current, wrappedKey: wrapped, noncePrefix: prefix}
+	if err := header.write(w); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, fmt.Errorf("write to closed encrypt writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == segmentSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.prefix, e.index, last), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// Close writes the final segment. It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+// decryptReader gives seekable access to the plaintext of an encrypted file,
+// decrypting one segment at a time.
+type decryptReader struct {
+	r          io.ReaderAt
+	aead       cipher.AEAD
+	prefix     []byte
+	dataOffset int64
+	bodySize   int64
+	size       int64
+	pos        int64
+	segIndex   int64
+	segment    []byte
+}
+
+func newDecryptReader(r io.ReaderAt, fileSize int64, keys *KeyRing) (*decryptReader, error) {
+	header, err := readFileHeader(io.NewSectionReader(r, 0, fileSize))
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := keys.unwrap(header.keyID, header.wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	bodySize := fileSize - header.size()
+	sealedSegment := int64(segmentSize + aead.Overhead())
+	segments := (bodySize + sealedSegment - 1) / sealedSegment
+	if segments == 0 {
+		return nil, fmt.Errorf("encrypted file is truncated")
+	}
+
+	return &decryptReader{
+		r:          r,
+		aead:       aead,
+		prefix:     header.noncePrefix,
+		dataOffset: header.size(),
+		bodySize:   bodySize,
+		size:       bodySize - segments*int64(aead.Overhead()),
+		segIndex:   -1,
+	}, nil
+}
+
+// Size returns the plaintext size.
+func (d *decryptReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptReader) loadSegment(index int64) error {
+	if index == d.segIndex {
+		return nil
+	}
+	sealedSegment := int64(segmentSize + d.aead.Overhead())
+	start := index * sealedSegment
+	length := min(sealedSegment, d.bodySize-start)
+	last := start+length == d.bodySize
+
+	sealed := make([]byte, length)
+	if _, err := d.r.ReadAt(sealed, d.dataOffset+start); err != nil && err != io.EOF {
+		return err
+	}
+	plain, err := d.aead.Open(sealed[:0], segmentNonce(d.prefix, uint32(index), last), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt segment %d: %w", index, err)
+	}
+	d.segIndex = index
+	d.segment = plain
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		// still authenticate the final segment of empty files
+		if d.size == 0 && d.segIndex < 0 {
+			if err := d.loadSegment(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := d.pos / segmentSize
+	if err := d.loadSegment(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, d.segment[d.pos-index*segmentSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = d.pos + offset
+	case io.SeekEnd:
+		pos = d.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	d.pos = pos
+	return pos, nil
+}
+
+// StoredFile is an opened original or thumbnail, already decrypted if the
+// file is encrypted at rest.
+type StoredFile struct {
+	io.ReadSeeker
+	file *os.File
+	size int64
+}
+
+func (f *StoredFile) Size() int64 {
+	return f.size
+}
+
+// Stat reports the plaintext size rather than the size on disk.
+func (f *StoredFile) Stat() (os.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return plainFileInfo{FileInfo: info, size: f.size}, nil
+}
+
+type plainFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i plainFileInfo) Size() int64 {
+	return i.size
+}
+
+func (f *StoredFile) Close() error {
+	return f.file.Close()
+}
+
+// isEncrypted reports whether the file starts with the encryption magic.
+func isEncrypted(file *os.File) (bool, error) {
+	magic := make([]byte, len(encryptionMagic))
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return n == len(magic) && bytes.Equal(magic, encryptionMagic), nil
+}
+
+// OpenFile opens a stored file for reading. Encrypted files are decrypted
+// transparently, plain files are returned as is, so a library can be
+// switched to encryption without converting existing files first.
+func (s *LocalPhotoStorage) OpenFile(path string) (*StoredFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	encrypted, err := isEncrypted(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !encrypted {
+		return &StoredFile{ReadSeeker: file, file: file, size: info.Size()}, nil
+	}
+
+	if s.Keys == nil {
+		file.Close()
+		return nil, fmt.Errorf("file %s is encrypted but no keys are configured", path)
+	}
+	reader, err := newDecryptReader(file, info.Size(), s.Keys)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &StoredFile{ReadSeeker: reader, file: file, size: reader.Size()}, nil
+}
+
+// writeFile streams r into path, encrypting it when a key ring is configured.
+// The file is written to a temporary name first and renamed into place.
+func (s *LocalPhotoStorage) writeFile(path string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(s.Directory, ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	buffered := bufio.NewWriter(tmp)
+	var w io.Writer = buffered
+	var enc *encryptWriter
+	if s.Keys != nil {
+		enc, err = newEncryptWriter(buffered, s.Keys)
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+		w = enc
+	}
+
+	written, err := io.Copy(w, r)
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		tmp.Close()
+		return written, err
+	}
+	if err := tmp.Close(); err != nil {
+		return written, err
+	}
+	return written, os.Rename(tmp.Name(), path)
+}
+
+// RotateFile re-wraps the data key of an encrypted file with the current
+// master key. The ciphertext segments are copied unchanged. It reports
+// whether the file was rewritten.
+func (s *LocalPhotoStorage) RotateFile(path string) (bool, error) {
+	if s.Keys == nil {
+		return false, fmt.Errorf("no keys configured")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	encrypted, err := isEncrypted(file)
+	if err != nil || !encrypted {
+		return false, err
+	}
+	header, err := readFileHeader(file)
+	if err != nil {
+		return false, err
+	}
+	if header.keyID == s.Keys.current {
+		return false, nil
+	}
+
+	dataKey, err := s.Keys.unwrap(header.keyID, header.wrappedKey)
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := s.Keys.wrap(s.Keys.current, dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(s.Directory, ".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	rotated := fileHeader{keyID: s.Keys.current, wrappedKey: wrapped, noncePrefix: header.noncePrefix}
+	if err := rotated.write(tmp); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if _, err := io.Copy(tmp, file); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/bits"
+	"photo-backup/model"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+const paletteSize = 5
+
+// analyzeImage returns the encoded thumbnail of the decoded photo, in the
+// format implied by thumbnailPath, together with the image features.
+func analyzeImage(src image.Image, thumbnailPath string) ([]byte, model.ImageFeatures, error) {
+	format, err := imaging.FormatFromFilename(thumbnailPath)
+	if err != nil {
+		return nil, model.ImageFeatures{}, err
+	}
+
+	dst := thumbnailImage(src)
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, dst, format); err != nil {
+		return nil, model.ImageFeatures{}, err
+	}
+	return buf.Bytes(), computeFeatures(src, dst), nil
+}
+
+// ComputeFeatures decodes an already stored photo and computes its image
+// features, e.g. for photos uploaded before a feature existed.
+func ComputeFeatures(r io.Reader) (model.ImageFeatures, error) {
+	hash := sha256.New()
+	r = io.TeeReader(r, hash)
+
+	src, err := imaging.Decode(r, imaging.AutoOrientation(true))
+	if err != nil {
+		return model.ImageFeatures{}, err
+	}
+	// the decoder may stop before the end of the file
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return model.ImageFeatures{}, err
+	}
+
+	features := computeFeatures(src, thumbnailImage(src))
+	features.Hash = hex.EncodeToString(hash.Sum(nil))
+	return features, nil
+}
+
+func thumbnailImage(src image.Image) image.Image {
+	return imaging.Fill(src, 100, 100, imaging.Center, imaging.Lanczos)
+}
+
+// computeFeatures derives the features from the full image and its
+// thumbnail.
+func computeFeatures(img image.Image, thumbnail image.Image) model.ImageFeatures {
+	return model.ImageFeatures{
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+		BlurHash:  blurHash(img),
+		PHash:     FormatHash(differenceHash(img)),
+		Histogram: colorHistogram(img),
+		Palette:   dominantColors(thumbnail, paletteSize),
+	}
+}
+
+// differenceHash computes a 64-bit dHash: the image is shrunk to 9x8 gray
+// pixels and every bit records whether a pixel is brighter than its right
+// neighbour. Re-compressed or resized copies end up with (nearly) the same
+// hash.
+func differenceHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[y*small.Stride+x*4]
+			right := small.Pix[y*small.Stride+(x+1)*4]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// colorHistogram returns the normalized share of pixels in each of 4x4x4 RGB
+// bins, computed on a downscaled copy of the image.
+func colorHistogram(img image.Image) []float64 {
+	const binsPerChannel = 4
+	small := imaging.Resize(img, 64, 64, imaging.Box)
+
+	histogram := make([]float64, binsPerChannel*binsPerChannel*binsPerChannel)
+	pixels := 0
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		r := int(small.Pix[i]) * binsPerChannel / 256
+		g := int(small.Pix[i+1]) * binsPerChannel / 256
+		b := int(small.Pix[i+2]) * binsPerChannel / 256
+		histogram[(r*binsPerChannel+g)*binsPerChannel+b]++
+		pixels++
+	}
+	for i := range histogram {
+		histogram[i] = math.Round(histogram[i]/float64(pixels)*10000) / 10000
+	}
+	return histogram
+}
+
+// HistogramIntersection returns the overlap of two normalized histograms,
+// from 0 (no common colors) to 1 (identical color distribution).
+func HistogramIntersection(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float64
+	for i := range a {
+		sum += math.Min(a[i], b[i])
+	}
+	return sum
+}
+
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func ParseHash(hash string) (uint64, error) {
+	return strconv.ParseUint(hash, 16, 64)
+}
+
+// HammingDistance returns the number of differing bits of two hashes.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -2,8 +2,8 @@ package storage
 
 import (
 	"context"
-	"math"
 	"photo-backup/model"
+	"regexp"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -18,13 +18,29 @@ type PhotoDB interface {
 	SavePhoto(ctx context.Context, photo model.PhotoDB) (*model.PhotoDB, error)
 	DeletePhoto(ctx context.Context, id string) (*model.PhotoDB, error)
 	GetPhoto(ctx context.Context, id string) (*model.PhotoDB, error)
-	GetPhotos(ctx context.Context, lastIdString string, limit int64) ([]model.PhotoDB, error)
-	SearchPhotosByLocation(ctx context.Context,  lastIdString string, limit int64, latMin float64, latMax float64,  longMin float64, longMax float64) ([]model.PhotoDB, error)
+	GetPhotosByIDs(ctx context.Context, ids []primitive.ObjectID) ([]model.PhotoDB, error)
+	QueryPhotos(ctx context.Context, filter PhotoFilter, sort string, cursor string, limit int64) (*PhotoPage, error)
+	UpdatePhoto(ctx context.Context, id string, update PhotoUpdate) (*model.PhotoDB, error)
+	UpdateTags(ctx context.Context, ownerID string, ids []primitive.ObjectID, add []string, remove []string) (int64, error)
+	GetTags(ctx context.Context, ownerID string, prefix string, limit int64) ([]TagCount, error)
+	GetPhotoHashes(ctx context.Context, ownerID string) ([]model.PhotoDB, error)
+	GetPhotosByHashes(ctx context.Context, ownerID string, hashes []string) ([]model.PhotoDB, error)
+	GetDeviceStats(ctx context.Context, ownerID string) ([]DeviceStats, error)
+	RecountUsage(ctx context.Context) error
+	GetPhotosMissingThumbnailSize(ctx context.Context, after primitive.ObjectID, limit int64) ([]model.PhotoDB, error)
+	SetThumbnailSize(ctx context.Context, id primitive.ObjectID, size int64) error
+	GetPhotosMissingFeatures(ctx context.Context, after primitive.ObjectID, limit int64) ([]model.PhotoDB, error)
+	UpdateImageFeatures(ctx context.Context, id primitive.ObjectID, features model.ImageFeatures) error
+	SetProcessed(ctx context.Context, id primitive.ObjectID, thumbnailPath string, thumbnailSize int64, features model.ImageFeatures) error
+	GetChanges(ctx context.Context, ownerID string, since string, limit int64) (*ChangePage, error)
+	AssignSequences(ctx context.Context) (int, error)
 }
 
 type MongoPhotoDB struct {
 	mongoClient      *mongo.Client
 	collection       *mongo.Collection
+	tombstones       *mongo.Collection
+	seqs             *sequencer
 	connectionString string
 	databaseName     string
 	collectionName   string
@@ -52,11 +68,19 @@ func (db *MongoPhotoDB) Connect(ctx context.Context, logger *zap.Logger, connect
 	}
 
 	db.collection = db.mongoClient.Database(db.databaseName).Collection(db.collectionName)
+	db.tombstones = db.mongoClient.Database(db.databaseName).Collection("photo_tombstones")
+	db.seqs = newSequencer(db.mongoClient.Database(db.databaseName).Collection("counters"))
 
 	db.Log.Info("connected to MongoDB", zap.String("database", databaseName), zap.String("collection", collectionName))
 	return nil
 }
 
+// Database returns the connected database, so other stores can share the
+// client.
+func (db *MongoPhotoDB) Database() *mongo.Database {
+	return db.mongoClient.Database(db.databaseName)
+}
+
 func (db *MongoPhotoDB) Close(ctx context.Context) error {
 	if db.mongoClient != nil {
 		err := db.mongoClient.Disconnect(ctx)
@@ -70,6 +94,14 @@ func (db *MongoPhotoDB) Close(ctx context.Context) error {
 }
 
 func (db *MongoPhotoDB) SavePhoto(ctx context.Context, photo model.PhotoDB) (*model.PhotoDB, error) {
+	seq, done, err := db.seqs.next(ctx)
+	if err != nil {
+		db.Log.Error("failed to allocate change sequence", zap.Error(err))
+		return nil, err
+	}
+	defer done()
+	photo.Seq, photo.CreatedSeq = seq, seq
+
 	savedPhoto, err := db.collection.InsertOne(ctx, photo)
 	if err != nil {
 		db.Log.Error("failed to save photo to MongoDB", zap.Error(err), zap.String("file_path", photo.FilePath))
@@ -94,12 +126,22 @@ func (db *MongoPhotoDB) DeletePhoto(ctx context.Context, id string) (*model.Phot
 		return nil, err
 	}
 
+	seq, done, err := db.seqs.next(ctx)
+	if err != nil {
+		db.Log.Error("failed to allocate change sequence", zap.Error(err))
+		return nil, err
+	}
+	defer done()
+
 	filter := bson.D{{Key: "_id", Value: oid}}
 	err = db.collection.FindOneAndDelete(ctx, filter).Decode(&photo)
 	if err != nil {
 		db.Log.Error("failed to delete photo from MongoDB", zap.Error(err), zap.String("photo_id", id))
 		return nil, err
 	}
+	if err := db.saveTombstone(ctx, &photo, seq); err != nil {
+		return nil, err
+	}
 	db.Log.Info("photo deleted from MongoDB", zap.String("photo_id", id))
 	return &photo, nil
 }
@@ -124,82 +166,313 @@ func (db *MongoPhotoDB) GetPhoto(ctx context.Context, id string) (*model.PhotoDB
 	return &photo, nil
 }
 
-func (db *MongoPhotoDB) GetPhotos(ctx context.Context, lastIdString string, limit int64) ([]model.PhotoDB, error) {
+func (db *MongoPhotoDB) GetPhotosByIDs(ctx context.Context, ids []primitive.ObjectID) ([]model.PhotoDB, error) {
 	var photos []model.PhotoDB
 
-	filter := bson.M{}
-	if lastIdString != "" {
-		lastId, err := primitive.ObjectIDFromHex(lastIdString)
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	output, err := db.collection.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query photos by IDs from MongoDB", zap.Error(err), zap.Int("count", len(ids)))
+		return nil, err
+	}
+	if err = output.All(ctx, &photos); err != nil {
+		db.Log.Error("failed to decode photos from MongoDB", zap.Error(err))
+		return nil, err
+	}
+
+	db.Log.Info("retrieved photos by IDs from MongoDB", zap.Int("requested", len(ids)), zap.Int("count", len(photos)))
+	return photos, nil
+}
+
+func (db *MongoPhotoDB) QueryPhotos(ctx context.Context, filter PhotoFilter, sort string, cursor string, limit int64) (*PhotoPage, error) {
+	if sort == "" {
+		sort = SortTakenDesc
+	}
+	order, ok := sortOrders[sort]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+
+	query := filter.bson()
+	total, err := db.collection.CountDocuments(ctx, query)
+	if err != nil {
+		db.Log.Error("failed to count photos in MongoDB", zap.Error(err), zap.Any("filter", filter))
+		return nil, err
+	}
+
+	if cursor != "" {
+		after, err := decodePageCursor(cursor, sort)
 		if err != nil {
-			db.Log.Info("invalid last ID format", zap.Error(err), zap.String("last_id", lastIdString))
+			db.Log.Info("invalid page cursor", zap.Error(err), zap.String("cursor", cursor))
 			return nil, err
 		}
-		filter = bson.M{"_id": bson.M{"$lt": lastId}}
+		and, _ := query["$and"].(bson.A)
+		query["$and"] = append(and, after.condition(order))
 	}
 
-	opts := options.Find().SetLimit(limit).SetSort(bson.M{"_id": -1})
-	output, err := db.collection.Find(ctx, filter, opts)
+	// fetch one more photo than requested to know whether there is a next page
+	opts := options.Find().
+		SetLimit(limit + 1).
+		SetSort(bson.D{{Key: order.field, Value: order.direction}, {Key: "_id", Value: order.direction}})
+	output, err := db.collection.Find(ctx, query, opts)
 	if err != nil {
-		db.Log.Error("failed to query photos from MongoDB", zap.Error(err), zap.Int64("limit", limit))
+		db.Log.Error("failed to query photos from MongoDB", zap.Error(err), zap.Any("filter", filter), zap.Int64("limit", limit))
 		return nil, err
 	}
-	if err = output.All(ctx, &photos); err != nil {
+	page := &PhotoPage{Photos: []model.PhotoDB{}, Total: total}
+	if err = output.All(ctx, &page.Photos); err != nil {
 		db.Log.Error("failed to decode photos from MongoDB", zap.Error(err))
 		return nil, err
 	}
 
-	db.Log.Info("retrieved photos from MongoDB", zap.Int("count", len(photos)))
-	return photos, nil
+	if int64(len(page.Photos)) > limit {
+		page.Photos = page.Photos[:limit]
+		page.NextCursor = newPageCursor(sort, order, page.Photos[limit-1]).encode()
+	}
+
+	db.Log.Info("retrieved photos from MongoDB", zap.Int("count", len(page.Photos)), zap.Int64("total", total), zap.String("sort", sort))
+	return page, nil
 }
 
-func (db *MongoPhotoDB) SearchPhotosByLocation(ctx context.Context,  lastIdString string, limit int64, latMin float64, latMax float64,  longMin float64, longMax float64) ([]model.PhotoDB, error) {
-	var photos []model.PhotoDB
+func (db *MongoPhotoDB) UpdatePhoto(ctx context.Context, id string, update PhotoUpdate) (*model.PhotoDB, error) {
+	var photo model.PhotoDB
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		db.Log.Error("invalid photo ID format", zap.Error(err), zap.String("id", id))
+		return nil, err
+	}
+
+	set := update.set()
+	if len(set) == 0 {
+		return db.GetPhoto(ctx, id)
+	}
+
+	seq, done, err := db.seqs.next(ctx)
+	if err != nil {
+		db.Log.Error("failed to allocate change sequence", zap.Error(err))
+		return nil, err
+	}
+	defer done()
+	set["seq"] = seq
+
+	filter := bson.D{{Key: "_id", Value: oid}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = db.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&photo)
+	if err != nil {
+		db.Log.Error("failed to update photo in MongoDB", zap.Error(err), zap.String("photo_id", id))
+		return nil, err
+	}
+	db.Log.Info("photo updated in MongoDB", zap.String("photo_id", id))
+	return &photo, nil
+}
+
+func (db *MongoPhotoDB) UpdateTags(ctx context.Context, ownerID string, ids []primitive.ObjectID, add []string, remove []string) (int64, error) {
+	filter := bson.M{"_id": bson.M{"$in": ids}, "$or": ownedBy(ownerID)}
+
+	// both updates share one sequence number; the tag conditions keep
+	// photos that would not change from being bumped
+	seq, done, err := db.seqs.next(ctx)
+	if err != nil {
+		db.Log.Error("failed to allocate change sequence", zap.Error(err))
+		return 0, err
+	}
+	defer done()
 
-	// Ensure proper order of coordinates
-    minLong := math.Min(longMin, longMax)
-    maxLong := math.Max(longMin, longMax)
-    minLat := math.Min(latMin, latMax)
-    maxLat := math.Max(latMin, latMax)
-
-    polygon := bson.A{
-        bson.A{minLong, minLat}, // bottom-left
-        bson.A{minLong, maxLat}, // top-left
-        bson.A{maxLong, maxLat}, // top-right
-        bson.A{maxLong, minLat}, // bottom-right
-        bson.A{minLong, minLat}, // close the polygon
-    }
-
-    filter := bson.M{
-        "lonlat": bson.M{
-            "$geoWithin": bson.M{
-                "$geometry": bson.M{
-                    "type":        "Polygon",
-                    "coordinates": bson.A{polygon},
-                },
-            },
-        },
-    }
-
-	if lastIdString != "" {
-		lastId, err := primitive.ObjectIDFromHex(lastIdString)
+	var modified int64
+	if len(add) > 0 {
+		addFilter := bson.M{"_id": filter["_id"], "$or": filter["$or"], "tags": bson.M{"$not": bson.M{"$all": add}}}
+		update := bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": add}}, "$set": bson.M{"seq": seq}}
+		result, err := db.collection.UpdateMany(ctx, addFilter, update)
 		if err != nil {
-			db.Log.Info("invalid last ID format", zap.Error(err), zap.String("last_id", lastIdString))
-			return nil, err
+			db.Log.Error("failed to add tags in MongoDB", zap.Error(err), zap.Strings("tags", add))
+			return 0, err
 		}
-		filter["_id"] = bson.M{"$lt": lastId}
+		modified += result.ModifiedCount
+	}
+	if len(remove) > 0 {
+		removeFilter := bson.M{"_id": filter["_id"], "$or": filter["$or"], "tags": bson.M{"$in": remove}}
+		update := bson.M{"$pullAll": bson.M{"tags": remove}, "$set": bson.M{"seq": seq}}
+		result, err := db.collection.UpdateMany(ctx, removeFilter, update)
+		if err != nil {
+			db.Log.Error("failed to remove tags in MongoDB", zap.Error(err), zap.Strings("tags", remove))
+			return 0, err
+		}
+		modified += result.ModifiedCount
 	}
 
-	opts := options.Find().SetLimit(limit).SetSort(bson.M{"_id": -1})
-	output, err := db.collection.Find(ctx, filter, opts)
+	db.Log.Info("updated photo tags in MongoDB", zap.Int("photos", len(ids)), zap.Int64("modified", modified))
+	return modified, nil
+}
+
+// GetTags counts the tags of the photos visible to the owner, or of all
+// photos when ownerID is empty.
+func (db *MongoPhotoDB) GetTags(ctx context.Context, ownerID string, prefix string, limit int64) ([]TagCount, error) {
+	tags := []TagCount{}
+
+	match := bson.M{}
+	if ownerID != "" {
+		match["$or"] = ownedBy(ownerID)
+	}
+	if prefix != "" {
+		match["tags"] = bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$unwind", Value: "$tags"}},
+	}
+	if prefix != "" {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"tags": match["tags"]}}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	)
+
+	output, err := db.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		db.Log.Error("failed to aggregate tags from MongoDB", zap.Error(err), zap.String("prefix", prefix))
+		return nil, err
+	}
+	if err = output.All(ctx, &tags); err != nil {
+		db.Log.Error("failed to decode tags from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return tags, nil
+}
+
+// GetPhotoHashes returns all hashed photos of the owner, or of all owners
+// when ownerID is empty, with only the fields needed to compare and rank
+// them.
+func (db *MongoPhotoDB) GetPhotoHashes(ctx context.Context, ownerID string) ([]model.PhotoDB, error) {
+	photos := []model.PhotoDB{}
+
+	filter := bson.M{"phash": bson.M{"$exists": true}}
+	if ownerID != "" {
+		filter["$or"] = ownedBy(ownerID)
+	}
+	projection := bson.M{"owner_id": 1, "phash": 1, "taken_at": 1, "size": 1, "favorite": 1, "rating": 1}
+	output, err := db.collection.Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		db.Log.Error("failed to query photo hashes from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &photos); err != nil {
+		db.Log.Error("failed to decode photo hashes from MongoDB", zap.Error(err))
+		return nil, err
+	}
+
+	db.Log.Info("retrieved photo hashes from MongoDB", zap.Int("count", len(photos)))
+	return photos, nil
+}
+
+// GetPhotosByHashes returns the photos of the owner whose original has one
+// of the given content hashes, with only their hash and size.
+func (db *MongoPhotoDB) GetPhotosByHashes(ctx context.Context, ownerID string, hashes []string) ([]model.PhotoDB, error) {
+	photos := []model.PhotoDB{}
+
+	filter := bson.M{"hash": bson.M{"$in": hashes}, "$or": ownedBy(ownerID)}
+	projection := bson.M{"hash": 1, "size": 1}
+	output, err := db.collection.Find(ctx, filter, options.Find().SetProjection(projection))
 	if err != nil {
-		db.Log.Error("failed to search photos by location", zap.Error(err), zap.Float64("latMin", latMin), zap.Float64("latMax", latMax), zap.Float64("longMin", longMin), zap.Float64("longMax", longMax))
+		db.Log.Error("failed to query photos by hash from MongoDB", zap.Error(err))
 		return nil, err
 	}
 	if err = output.All(ctx, &photos); err != nil {
-		db.Log.Error("failed to decode photos from location search", zap.Error(err))
+		db.Log.Error("failed to decode photos by hash from MongoDB", zap.Error(err))
 		return nil, err
 	}
 
-	db.Log.Info("retrieved photos by location", zap.Int("count", len(photos)), zap.Float64("latMin", latMin), zap.Float64("latMax", latMax), zap.Float64("longMin", longMin), zap.Float64("longMax", longMax))
+	db.Log.Info("retrieved photos by hash from MongoDB", zap.Int("hashes", len(hashes)), zap.Int("found", len(photos)))
+	return photos, nil
+}
+
+// GetPhotosMissingFeatures returns photos with an ID greater than after
+// that lack any of the image features computed at ingest, ordered by ID so
+// callers can page through them.
+func (db *MongoPhotoDB) GetPhotosMissingFeatures(ctx context.Context, after primitive.ObjectID, limit int64) ([]model.PhotoDB, error) {
+	photos := []model.PhotoDB{}
+
+	filter := bson.M{
+		"_id": bson.M{"$gt": after},
+		"$or": bson.A{
+			bson.M{"hash": bson.M{"$exists": false}},
+			bson.M{"phash": bson.M{"$exists": false}},
+			bson.M{"palette": bson.M{"$exists": false}},
+			bson.M{"blurhash": bson.M{"$exists": false}},
+			bson.M{"width": bson.M{"$exists": false}},
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit)
+	output, err := db.collection.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query photos missing features from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &photos); err != nil {
+		db.Log.Error("failed to decode photos missing features from MongoDB", zap.Error(err))
+		return nil, err
+	}
 	return photos, nil
 }
+
+func (db *MongoPhotoDB) UpdateImageFeatures(ctx context.Context, id primitive.ObjectID, features model.ImageFeatures) error {
+	return db.setFeatures(ctx, id, featureFields(features))
+}
+
+// SetProcessed records the thumbnail and image features of a photo saved
+// without them. It fails with mongo.ErrNoDocuments if the photo was deleted
+// in the meantime.
+func (db *MongoPhotoDB) SetProcessed(ctx context.Context, id primitive.ObjectID, thumbnailPath string, thumbnailSize int64, features model.ImageFeatures) error {
+	set := featureFields(features)
+	set["thumbnail_path"] = thumbnailPath
+	set["thumbnail_size"] = thumbnailSize
+	return db.setFeatures(ctx, id, set)
+}
+
+func featureFields(features model.ImageFeatures) bson.M {
+	return bson.M{
+		"hash":      features.Hash,
+		"width":     features.Width,
+		"height":    features.Height,
+		"blurhash":  features.BlurHash,
+		"phash":     features.PHash,
+		"histogram": features.Histogram,
+		"palette":   features.Palette,
+	}
+}
+
+// setFeatures updates computed fields with a new change sequence, so that
+// syncing clients fetch the photo again. It fails with mongo.ErrNoDocuments
+// if there is no such photo.
+func (db *MongoPhotoDB) setFeatures(ctx context.Context, id primitive.ObjectID, set bson.M) error {
+	seq, done, err := db.seqs.next(ctx)
+	if err != nil {
+		db.Log.Error("failed to allocate change sequence", zap.Error(err))
+		return err
+	}
+	defer done()
+	set["seq"] = seq
+
+	result, err := db.collection.UpdateByID(ctx, id, bson.M{"$set": set})
+	if err != nil {
+		db.Log.Error("failed to update image features in MongoDB", zap.Error(err), zap.String("photo_id", id.Hex()))
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// ownedBy matches photos of the given owner, including photos uploaded
+// before ownership was recorded.
+func ownedBy(ownerID string) bson.A {
+	return bson.A{
+		bson.M{"owner_id": ownerID},
+		bson.M{"owner_id": bson.M{"$exists": false}},
+	}
+}
@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"photo-backup/model"
+	"regexp"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ArchivedInclude = "include"
+	ArchivedExclude = "exclude"
+	ArchivedOnly    = "only"
+)
+
+// PhotoFilter narrows down a photo query. Zero values are ignored, so every
+// filter is optional and filters are combined with AND.
+type PhotoFilter struct {
+	OwnerID     string       `json:"-"` // if set, restricts results to photos visible to this user
+	Text        string       `json:"text,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	From        *time.Time   `json:"from,omitempty"`
+	To          *time.Time   `json:"to,omitempty"`
+	Box         *BoundingBox `json:"box,omitempty"`
+	HasLocation *bool        `json:"hasLocation,omitempty"`
+	ContentType string       `json:"contentType,omitempty"`
+	Camera      string       `json:"camera,omitempty"`
+	MinSize     int64        `json:"minSize,omitempty"`
+	MaxSize     int64        `json:"maxSize,omitempty"`
+	Favorite    *bool        `json:"favorite,omitempty"`
+	MinRating   int          `json:"minRating,omitempty"`
+	Archived    string       `json:"archived,omitempty"` // one of the Archived* modes, include when empty
+	Color       *LabColor    `json:"color,omitempty"`
+	ColorDelta  float64      `json:"colorDelta,omitempty"` // maximum ΔE76 distance to Color
+	DeviceID    string       `json:"deviceId,omitempty"`   // hex ID of the device that uploaded the photo
+}
+
+func (f PhotoFilter) bson() bson.M {
+	var and bson.A
+	if f.OwnerID != "" {
+		and = append(and, bson.M{"$or": ownedBy(f.OwnerID)})
+	}
+	if len(f.Tags) > 0 {
+		and = append(and, bson.M{"tags": bson.M{"$all": f.Tags}})
+	}
+	if f.From != nil {
+		and = append(and, bson.M{"taken_at": bson.M{"$gte": *f.From}})
+	}
+	if f.To != nil {
+		and = append(and, bson.M{"taken_at": bson.M{"$lte": *f.To}})
+	}
+	if f.Box != nil {
+		and = append(and, bson.M{"lonlat": f.Box.geoWithin()})
+	}
+	if f.HasLocation != nil {
+		and = append(and, bson.M{"lonlat": bson.M{"$exists": *f.HasLocation}})
+	}
+	if f.ContentType != "" {
+		and = append(and, bson.M{"content_type": f.ContentType})
+	}
+	if f.Camera != "" {
+		and = append(and, bson.M{"camera": bson.M{"$regex": regexp.QuoteMeta(f.Camera), "$options": "i"}})
+	}
+	if f.MinSize > 0 {
+		and = append(and, bson.M{"size": bson.M{"$gte": f.MinSize}})
+	}
+	if f.MaxSize > 0 {
+		and = append(and, bson.M{"size": bson.M{"$lte": f.MaxSize}})
+	}
+	if f.Favorite != nil {
+		if *f.Favorite {
+			and = append(and, bson.M{"favorite": true})
+		} else {
+			and = append(and, bson.M{"favorite": bson.M{"$ne": true}})
+		}
+	}
+	if f.MinRating > 0 {
+		and = append(and, bson.M{"rating": bson.M{"$gte": f.MinRating}})
+	}
+	if f.Color != nil {
+		and = append(and, colorFilter(*f.Color, f.ColorDelta))
+	}
+	if f.DeviceID != "" {
+		oid, _ := primitive.ObjectIDFromHex(f.DeviceID)
+		and = append(and, bson.M{"device_id": oid})
+	}
+	switch f.Archived {
+	case ArchivedExclude:
+		and = append(and, bson.M{"archived": bson.M{"$ne": true}})
+	case ArchivedOnly:
+		and = append(and, bson.M{"archived": true})
+	}
+
+	filter := bson.M{}
+	// $text has to stay at the top level of the query
+	if f.Text != "" {
+		filter["$text"] = bson.M{"$search": f.Text}
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	return filter
+}
+
+type BoundingBox struct {
+	LatMin  float64 `json:"latMin"`
+	LatMax  float64 `json:"latMax"`
+	LongMin float64 `json:"longMin"`
+	LongMax float64 `json:"longMax"`
+}
+
+func (b BoundingBox) geoWithin() bson.M {
+	// Ensure proper order of coordinates
+	minLong := math.Min(b.LongMin, b.LongMax)
+	maxLong := math.Max(b.LongMin, b.LongMax)
+	minLat := math.Min(b.LatMin, b.LatMax)
+	maxLat := math.Max(b.LatMin, b.LatMax)
+
+	polygon := bson.A{
+		bson.A{minLong, minLat}, // bottom-left
+		bson.A{minLong, maxLat}, // top-left
+		bson.A{maxLong, maxLat}, // top-right
+		bson.A{maxLong, minLat}, // bottom-right
+		bson.A{minLong, minLat}, // close the polygon
+	}
+
+	return bson.M{
+		"$geoWithin": bson.M{
+			"$geometry": bson.M{
+				"type":        "Polygon",
+				"coordinates": bson.A{polygon},
+			},
+		},
+	}
+}
+
+// PhotoUpdate holds the user editable fields of a photo. Nil fields are left
+// unchanged.
+type PhotoUpdate struct {
+	Caption  *string
+	Tags     *[]string
+	Favorite *bool
+	Rating   *int
+	Archived *bool
+}
+
+func (u PhotoUpdate) set() bson.M {
+	set := bson.M{}
+	if u.Caption != nil {
+		set["caption"] = *u.Caption
+	}
+	if u.Tags != nil {
+		set["tags"] = *u.Tags
+	}
+	if u.Favorite != nil {
+		set["favorite"] = *u.Favorite
+	}
+	if u.Rating != nil {
+		set["rating"] = *u.Rating
+	}
+	if u.Archived != nil {
+		set["archived"] = *u.Archived
+	}
+	return set
+}
+
+// Fields returns the names of the fields the update changes.
+func (u PhotoUpdate) Fields() []string {
+	fields := []string{}
+	for field := range u.set() {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+type TagCount struct {
+	Tag   string `bson:"_id" json:"tag"`
+	Count int64  `bson:"count" json:"count"`
+}
+
+const (
+	SortTakenDesc = "taken_desc"
+	SortTakenAsc  = "taken_asc"
+	SortSizeDesc  = "size_desc"
+	SortSizeAsc   = "size_asc"
+)
+
+var (
+	ErrInvalidSort   = errors.New("invalid sort order")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+type sortOrder struct {
+	field     string
+	direction int
+}
+
+var sortOrders = map[string]sortOrder{
+	SortTakenDesc: {field: "taken_at", direction: -1},
+	SortTakenAsc:  {field: "taken_at", direction: 1},
+	SortSizeDesc:  {field: "size", direction: -1},
+	SortSizeAsc:   {field: "size", direction: 1},
+}
+
+// ValidSort reports whether sort is a known sort order.
+func ValidSort(sort string) bool {
+	_, ok := sortOrders[sort]
+	return ok
+}
+
+// PhotoPage is one page of a photo query. NextCursor is empty on the last
+// page, Total counts all photos matching the filter.
+type PhotoPage struct {
+	Photos     []model.PhotoDB
+	NextCursor string
+	Total      int64
+}
+
+// pageCursor points behind the last photo of a page. The sort value is kept
+// next to the ID so that pages stay stable when several photos share it.
+type pageCursor struct {
+	Sort  string             `json:"s"`
+	Value int64              `json:"v"`
+	ID    primitive.ObjectID `json:"i"`
+}
+
+func newPageCursor(sort string, order sortOrder, photo model.PhotoDB) pageCursor {
+	cursor := pageCursor{Sort: sort, ID: photo.ID}
+	switch order.field {
+	case "taken_at":
+		cursor.Value = photo.TakenAt.UnixMilli()
+	case "size":
+		cursor.Value = photo.Size
+	}
+	return cursor
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageCursor(encoded string, sort string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+func (c pageCursor) condition(order sortOrder) bson.M {
+	var value any = c.Value
+	if order.field == "taken_at" {
+		value = time.UnixMilli(c.Value).UTC()
+	}
+	op := "$gt"
+	if order.direction < 0 {
+		op = "$lt"
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{order.field: bson.M{op: value}},
+		bson.M{order.field: value, "_id": bson.M{op: c.ID}},
+	}}
+}
@@ -1,73 +1,85 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"mime"
-	"mime/multipart"
 	"os"
 	"path/filepath"
+	"photo-backup/events"
 	"photo-backup/model"
+	"strings"
 	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/rwcarlsen/goexif/exif"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
 type PhotoStorage interface {
-	SavePhoto(ctx context.Context, fileHeader *multipart.FileHeader) error
+	SavePhoto(ctx context.Context, upload Upload) (*model.PhotoDB, error)
 	DeletePhoto(ctx context.Context, id string) error
+	OpenFile(path string) (*StoredFile, error)
+	FindSimilar(ctx context.Context, photo *model.PhotoDB, maxDistance int, ownerID string) ([]SimilarPhoto, error)
 }
 
 type LocalPhotoStorage struct {
 	Directory string
 	Db        PhotoDB
 	Log       *zap.Logger
+	Keys      *KeyRing         // optional, files are encrypted at rest when set
+	Index     *SimilarityIndex // optional, enables similar photo lookups
+	Events    events.Publisher // optional, notified when photos are added or removed
+	Usage     UsageDB          // optional, counts the storage used per user
 }
 
-func (s *LocalPhotoStorage) SavePhoto(ctx context.Context, fileHeader *multipart.FileHeader) error {
-	if fileHeader == nil {
-		s.Log.Error("file header is nil")
-		return fmt.Errorf("file header cannot be nil")
-	}
-
-	file, err := fileHeader.Open()
-	if err != nil {
-		s.Log.Error("failed to open file", zap.Error(err))
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
+// exifHeadSize is how much of an upload is buffered to read the EXIF data.
+// JPEG files keep it in an APP1 segment of at most 64 KiB near the start.
+const exifHeadSize = 256 * 1024
 
-	// create temp file
-	tmpFile, err := os.CreateTemp("", "photo-*.tmp")
-	if err != nil {
-		s.Log.Error("failed to create temp file", zap.Error(err))
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	tmpFilePath := tmpFile.Name()
-	defer os.Remove(tmpFilePath)
+var (
+	ErrFileTooLarge = errors.New("file exceeds the size limit")
+	ErrPhotoDeleted = errors.New("photo was deleted while being processed")
+)
 
-	// copy uploaded file to temp file
-	if _, err := io.Copy(tmpFile, file); err != nil {
-		tmpFile.Close()
-		s.Log.Error("failed to copy file to temp", zap.Error(err), zap.String("temp_path", tmpFilePath))
-		return fmt.Errorf("failed to copy file to temp: %w", err)
-	}
+// Upload is a photo file as it arrives from the client. Body is read once,
+// the file is never buffered as a whole.
+type Upload struct {
+	Body        io.Reader
+	Filename    string
+	ContentType string
+	OwnerID     string
+	MaxSize     int64 // bytes, reading more fails with ErrFileTooLarge
+	Info        model.UploadInfo
+}
 
-	// seek to beginning for EXIF reading
-	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
-		tmpFile.Close()
-		s.Log.Error("failed to seek to start of temp file", zap.Error(err), zap.String("temp_path", tmpFilePath))
-		return fmt.Errorf("failed to seek to start of temp file: %w", err)
-	}
+// SavePhoto streams the upload into its final location while hashing it and
+// decoding the image for the thumbnail and image features. The EXIF data is
+// read from the buffered head of the stream. The photo is listed as soon as
+// the original is stored, and updated once the thumbnail and features are
+// ready.
+func (s *LocalPhotoStorage) SavePhoto(ctx context.Context, upload Upload) (*model.PhotoDB, error) {
+	head := bufio.NewReaderSize(&limitedReader{r: upload.Body, n: upload.MaxSize}, exifHeadSize)
 
 	// extract EXIF data
 	var lonLat *model.GeoPoint
 	var takenAt time.Time
-	exifData, err := exif.Decode(tmpFile)
+	var camera string
+	peeked, err := head.Peek(exifHeadSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		s.Log.Error("failed to read upload", zap.Error(err), zap.String("filename", upload.Filename))
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	exifData, err := exif.Decode(bytes.NewReader(peeked))
 	if err != nil {
 		s.Log.Warn("failed to decode EXIF data, using defaults", zap.Error(err))
 		takenAt = time.Now()
@@ -83,25 +95,19 @@ func (s *LocalPhotoStorage) SavePhoto(ctx context.Context, fileHeader *multipart
 		} else {
 			takenAt = time.Now()
 		}
-	}
-
-	// close temp file
-	if err := tmpFile.Close(); err != nil {
-		s.Log.Error("failed to close temp file", zap.Error(err), zap.String("temp_path", tmpFilePath))
-		return fmt.Errorf("failed to close temp file: %w", err)
+		camera = cameraName(exifData)
 	}
 
 	// determine file extension
-	extension := filepath.Ext(fileHeader.Filename)
+	extension := filepath.Ext(upload.Filename)
 	if extension == "" {
-		contentType := fileHeader.Header.Get("Content-Type")
-		extensions, _ := mime.ExtensionsByType(contentType)
+		extensions, _ := mime.ExtensionsByType(upload.ContentType)
 		if len(extensions) > 0 {
 			extension = extensions[0]
-			s.Log.Debug("using extension from content type", zap.String("extension", extension), zap.String("content_type", contentType))
+			s.Log.Debug("using extension from content type", zap.String("extension", extension), zap.String("content_type", upload.ContentType))
 		} else {
 			extension = ".jpg"
-			s.Log.Warn("no extension found, defaulting to .jpg", zap.String("content_type", contentType))
+			s.Log.Warn("no extension found, defaulting to .jpg", zap.String("content_type", upload.ContentType))
 		}
 	}
 
@@ -112,72 +118,191 @@ func (s *LocalPhotoStorage) SavePhoto(ctx context.Context, fileHeader *multipart
 	filePath := filepath.Join(s.Directory, fileName)
 	thumbPath := filepath.Join(s.Directory, thumbName)
 
-	// move temp file to final location
-	if err := os.Rename(tmpFilePath, filePath); err != nil {
-		s.Log.Error("failed to move temp file", zap.Error(err), zap.String("file_path", filePath))
-		return fmt.Errorf("failed to move temp file to %s: %w", filePath, err)
+	// decode the image from a copy of the stream while it is written
+	type decoded struct {
+		img image.Image
+		err error
 	}
+	pr, pw := io.Pipe()
+	done := make(chan decoded, 1)
+	go func() {
+		img, err := imaging.Decode(pr, imaging.AutoOrientation(true))
+		io.Copy(io.Discard, pr) // the decoder may stop before the end of the file
+		done <- decoded{img, err}
+	}()
 
-	// generate thumbnail
-	if err := generateThumbnail(filePath, thumbPath); err != nil {
-		os.Remove(filePath) // Clean up main file
-		s.Log.Error("failed to generate thumbnail", zap.Error(err), zap.String("thumb_path", thumbPath))
-		return fmt.Errorf("failed to generate thumbnail: %w", err)
+	// write the original, encrypting it if enabled, and hash the content on the way
+	hash := sha256.New()
+	size, err := s.writeFile(filePath, io.TeeReader(head, io.MultiWriter(hash, pw)))
+	pw.CloseWithError(err)
+	result := <-done
+	if err != nil {
+		s.Log.Error("failed to write photo", zap.Error(err), zap.String("file_path", filePath))
+		return nil, fmt.Errorf("failed to write photo to %s: %w", filePath, err)
+	}
+	if result.err != nil {
+		os.Remove(filePath)
+		s.Log.Error("failed to decode image", zap.Error(result.err), zap.String("filename", upload.Filename))
+		return nil, fmt.Errorf("failed to decode image: %w", result.err)
 	}
 
 	// save to MongoDB
 	photo := model.PhotoDB{
 		ID:            id,
-		Size:          fileHeader.Size,
-		ContentType:   fileHeader.Header.Get("Content-Type"),
+		OwnerID:       upload.OwnerID,
+		Size:          size,
+		ContentType:   upload.ContentType,
+		Camera:        camera,
 		FilePath:      filePath,
-		ThumbnailPath: thumbPath,
 		TakenAt:       takenAt,
 		LonLat:        lonLat,
+		ImageFeatures: model.ImageFeatures{Hash: hex.EncodeToString(hash.Sum(nil))},
+		UploadInfo:    upload.Info,
 	}
+	photo.UploadedAt = time.Now()
 	if _, err := s.Db.SavePhoto(ctx, photo); err != nil {
-		// clean up files if database save fails
+		// clean up the file if database save fails
 		os.Remove(filePath)
-		os.Remove(thumbPath)
 		s.Log.Error("failed to save photo metadata to database", zap.Error(err), zap.String("file_path", filePath))
-		return fmt.Errorf("failed to save photo metadata: %w", err)
+		return nil, fmt.Errorf("failed to save photo metadata: %w", err)
+	}
+	s.publish(ctx, events.PhotoUploaded, upload.OwnerID, id)
+
+	// generate thumbnail and image features
+	err = s.process(ctx, &photo, result.img, thumbPath)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// deleted while processing, which published the deletion and
+		// removed the file, but not the thumbnail written since
+		s.Log.Info("photo deleted while processing", zap.String("photo_id", id.Hex()))
+		os.Remove(filePath)
+		os.Remove(thumbPath)
+		return nil, ErrPhotoDeleted
+	}
+	if err != nil {
+		s.Log.Error("failed to process photo", zap.Error(err), zap.String("photo_id", id.Hex()))
+		// undo the upload, clients that saw it learn about the deletion
+		if _, dbErr := s.Db.DeletePhoto(ctx, id.Hex()); dbErr == nil {
+			s.publish(ctx, events.PhotoDeleted, upload.OwnerID, id)
+		}
+		os.Remove(filePath)
+		os.Remove(thumbPath)
+		return nil, err
 	}
 
-	s.Log.Info("photo saved successfully", zap.String("file_path", filePath), zap.String("photo_id", id.Hex()))
+	if s.Usage != nil {
+		s.Usage.AddUsage(ctx, &photo, 1)
+	}
+	if s.Index != nil {
+		if hash, err := ParseHash(photo.PHash); err == nil {
+			s.Index.Add(id, upload.OwnerID, hash)
+		}
+	}
+	s.publish(ctx, events.PhotoProcessed, upload.OwnerID, id)
+
+	s.Log.Info("photo saved successfully", zap.String("file_path", filePath), zap.String("photo_id", id.Hex()), zap.Int64("size", size))
+	return &photo, nil
+}
+
+// process generates the thumbnail and image features of a saved photo and
+// records them.
+func (s *LocalPhotoStorage) process(ctx context.Context, photo *model.PhotoDB, img image.Image, thumbPath string) error {
+	thumbnail, features, err := analyzeImage(img, thumbPath)
+	if err != nil {
+		return fmt.Errorf("failed to generate thumbnail: %w", err)
+	}
+	features.Hash = photo.Hash
+	if _, err := s.writeFile(thumbPath, bytes.NewReader(thumbnail)); err != nil {
+		return fmt.Errorf("failed to write thumbnail: %w", err)
+	}
+
+	photo.ThumbnailPath = thumbPath
+	photo.ThumbnailSize = int64(len(thumbnail))
+	photo.ImageFeatures = features
+	if err := s.Db.SetProcessed(ctx, photo.ID, photo.ThumbnailPath, photo.ThumbnailSize, features); err != nil {
+		return fmt.Errorf("failed to save photo features: %w", err)
+	}
 	return nil
 }
 
+// limitedReader fails with ErrFileTooLarge once more than n bytes are read,
+// unlike io.LimitReader, which ends the stream silently.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrFileTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrFileTooLarge
+	}
+	return n, err
+}
+
 func (s LocalPhotoStorage) DeletePhoto(ctx context.Context, id string) error {
 	photo, err := s.Db.DeletePhoto(ctx, id)
 	if err != nil {
 		s.Log.Error("failed to delete photo from database", zap.Error(err), zap.String("photo_id", id))
 		return fmt.Errorf("failed to delete photo: %w", err)
 	}
+	// photos still processing have no thumbnail, and are not counted or
+	// indexed yet
+	processed := photo.ThumbnailPath != ""
+	if s.Index != nil && processed {
+		s.Index.Remove(photo.ID)
+	}
+	if s.Usage != nil && processed {
+		s.Usage.AddUsage(ctx, photo, -1)
+	}
+	s.publish(ctx, events.PhotoDeleted, photo.OwnerID, photo.ID)
 
 	// clean up files
 	if err := os.Remove(photo.FilePath); err != nil {
 		s.Log.Error("failed to remove photo file", zap.Error(err), zap.String("file_path", photo.FilePath))
 		return fmt.Errorf("failed to remove photo file: %w", err)
 	}
-	if err := os.Remove(photo.ThumbnailPath); err != nil {
-		s.Log.Error("failed to remove photo thumbnail", zap.Error(err), zap.String("thumb_path", photo.ThumbnailPath))
-		return fmt.Errorf("failed to remove photo thumbnail: %w", err)
+	if processed {
+		if err := os.Remove(photo.ThumbnailPath); err != nil {
+			s.Log.Error("failed to remove photo thumbnail", zap.Error(err), zap.String("thumb_path", photo.ThumbnailPath))
+			return fmt.Errorf("failed to remove photo thumbnail: %w", err)
+		}
 	}
 
 	s.Log.Info("photo deleted successfully", zap.String("photo_id", id))
 	return nil
 }
 
-func generateThumbnail(filePath, thumbnailPath string) error {
-	src, err := imaging.Open(filePath, imaging.AutoOrientation(true))
-	if err != nil {
-		return err
+func (s *LocalPhotoStorage) publish(ctx context.Context, eventType string, ownerID string, id primitive.ObjectID) {
+	if s.Events != nil {
+		s.Events.Publish(ctx, events.New(eventType, ownerID, events.Data{PhotoID: id.Hex()}))
 	}
+}
 
-	dst := imaging.Fill(src, 100, 100, imaging.Center, imaging.Lanczos)
-	err = imaging.Save(dst, thumbnailPath)
-	if err != nil {
-		return err
+// cameraName combines the EXIF make and model, e.g. "Apple iPhone 12".
+// Models that already start with the make are used as is.
+func cameraName(x *exif.Exif) string {
+	tagString := func(name exif.FieldName) string {
+		tag, err := x.Get(name)
+		if err != nil {
+			return ""
+		}
+		value, err := tag.StringVal()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(strings.Trim(value, "\x00"))
 	}
-	return nil
+
+	maker, modelName := tagString(exif.Make), tagString(exif.Model)
+	if maker == "" || strings.HasPrefix(strings.ToLower(modelName), strings.ToLower(maker)) {
+		return modelName
+	}
+	return strings.TrimSpace(maker + " " + modelName)
 }
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"photo-backup/events"
+	"photo-backup/model"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+type recordedEvents []string
+
+func (r *recordedEvents) Publish(ctx context.Context, event events.Event) {
+	*r = append(*r, event.Type)
+}
+
+// fakePhotoDB keeps the saved photo and the events published before it was
+// processed.
+type fakePhotoDB struct {
+	PhotoDB
+	events        *recordedEvents
+	saved         *model.PhotoDB
+	beforeProcess []string
+	processErr    error
+	onProcess     func() // runs while the photo is processed
+	deleted       bool
+}
+
+type countedUsage struct {
+	UsageDB
+	deltas []int64
+}
+
+func (u *countedUsage) AddUsage(ctx context.Context, photo *model.PhotoDB, delta int64) error {
+	u.deltas = append(u.deltas, delta)
+	return nil
+}
+
+func (db *fakePhotoDB) SavePhoto(ctx context.Context, photo model.PhotoDB) (*model.PhotoDB, error) {
+	db.saved = &photo
+	return &photo, nil
+}
+
+func (db *fakePhotoDB) SetProcessed(ctx context.Context, id primitive.ObjectID, thumbnailPath string, thumbnailSize int64, features model.ImageFeatures) error {
+	db.beforeProcess = slices.Clone(*db.events)
+	if db.onProcess != nil {
+		db.onProcess()
+	}
+	return db.processErr
+}
+
+func (db *fakePhotoDB) DeletePhoto(ctx context.Context, id string) (*model.PhotoDB, error) {
+	db.deleted = true
+	return db.saved, nil
+}
+
+func testImage(t *testing.T) *bytes.Buffer {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestSavePhotoPublishesUploadBeforeProcessing(t *testing.T) {
+	published := &recordedEvents{}
+	db := &fakePhotoDB{events: published}
+	s := &LocalPhotoStorage{Directory: t.TempDir(), Db: db, Log: zap.NewNop(), Events: published}
+
+	photo, err := s.SavePhoto(context.Background(), Upload{Body: testImage(t), Filename: "a.png", ContentType: "image/png", MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.saved.ThumbnailPath != "" || db.saved.Hash == "" {
+		t.Errorf("photo saved with thumbnail %q and hash %q, want it listed before processing", db.saved.ThumbnailPath, db.saved.Hash)
+	}
+	if !slices.Equal(db.beforeProcess, []string{events.PhotoUploaded}) {
+		t.Errorf("events before processing: %v", db.beforeProcess)
+	}
+	if !slices.Equal(*published, []string{events.PhotoUploaded, events.PhotoProcessed}) {
+		t.Errorf("events: %v", *published)
+	}
+	if photo.ThumbnailSize == 0 || photo.Width != 64 {
+		t.Errorf("returned photo lacks the thumbnail or features: %+v", photo)
+	}
+}
+
+func TestSavePhotoUndoneWhenProcessingFails(t *testing.T) {
+	published := &recordedEvents{}
+	db := &fakePhotoDB{events: published, processErr: errors.New("disk full")}
+	s := &LocalPhotoStorage{Directory: t.TempDir(), Db: db, Log: zap.NewNop(), Events: published}
+
+	if _, err := s.SavePhoto(context.Background(), Upload{Body: testImage(t), Filename: "a.png", ContentType: "image/png", MaxSize: 1 << 20}); err == nil {
+		t.Fatal("upload succeeded")
+	}
+	if !db.deleted {
+		t.Error("listed photo was not deleted")
+	}
+	if !slices.Equal(*published, []string{events.PhotoUploaded, events.PhotoDeleted}) {
+		t.Errorf("events: %v", *published)
+	}
+}
+
+func TestSavePhotoDeletedWhileProcessing(t *testing.T) {
+	published := &recordedEvents{}
+	usage := &countedUsage{}
+	// the photo is gone by the time the features are recorded
+	db := &fakePhotoDB{events: published, processErr: mongo.ErrNoDocuments}
+	dir := t.TempDir()
+	s := &LocalPhotoStorage{Directory: dir, Db: db, Log: zap.NewNop(), Events: published, Usage: usage, Index: NewSimilarityIndex()}
+	db.onProcess = func() {
+		if err := s.DeletePhoto(context.Background(), db.saved.ID.Hex()); err != nil {
+			t.Errorf("delete while processing: %v", err)
+		}
+	}
+
+	if _, err := s.SavePhoto(context.Background(), Upload{Body: testImage(t), Filename: "a.png", ContentType: "image/png", MaxSize: 1 << 20}); !errors.Is(err, ErrPhotoDeleted) {
+		t.Fatalf("upload: %v, want ErrPhotoDeleted", err)
+	}
+	if !slices.Equal(*published, []string{events.PhotoUploaded, events.PhotoDeleted}) {
+		t.Errorf("events: %v", *published)
+	}
+	if len(usage.deltas) != 0 {
+		t.Errorf("usage changed by %v", usage.deltas)
+	}
+	if matches := s.Index.Search(0, 64, ""); len(matches) != 0 {
+		t.Errorf("deleted photo indexed: %v", matches)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("files left behind: %v", files)
+	}
+}
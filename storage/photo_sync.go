@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const sortSeq = "seq"
+
+// sequencer hands out the change sequence numbers of the photo collection.
+// Numbers are allocated before the write that uses them, so a write with a
+// lower number may still be in flight while a higher one is visible. The
+// sequencer tracks allocated numbers until their write is done, and the
+// change feed only returns changes below the lowest one in flight, so
+// clients never skip a change. An allocation is tracked from before the
+// counter is incremented: its number is not known yet, but it is above the
+// highest one allocated when it started.
+type sequencer struct {
+	allocate func(ctx context.Context) (int64, error) // increments the counter
+	mu       sync.Mutex
+	highest  int64         // highest number allocated so far
+	reserved map[int64]int // allocations in flight, by highest when they started
+	pending  map[int64]struct{}
+}
+
+func newSequencer(counters *mongo.Collection) *sequencer {
+	s := &sequencer{reserved: map[int64]int{}, pending: map[int64]struct{}{}}
+	s.allocate = func(ctx context.Context) (int64, error) {
+		var counter struct {
+			Seq int64 `bson:"seq"`
+		}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		err := counters.FindOneAndUpdate(ctx, bson.M{"_id": "photos"}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+		return counter.Seq, err
+	}
+	return s
+}
+
+// next allocates a sequence number. done must be called once the write
+// using it has finished, whether it succeeded or not.
+func (s *sequencer) next(ctx context.Context) (seq int64, done func(), err error) {
+	s.mu.Lock()
+	floor := s.highest
+	s.reserved[floor]++
+	s.mu.Unlock()
+
+	seq, err = s.allocate(ctx)
+
+	s.mu.Lock()
+	if s.reserved[floor]--; s.reserved[floor] == 0 {
+		delete(s.reserved, floor)
+	}
+	if err == nil {
+		s.pending[seq] = struct{}{}
+		s.highest = max(s.highest, seq)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return seq, func() {
+		s.mu.Lock()
+		delete(s.pending, seq)
+		s.mu.Unlock()
+	}, nil
+}
+
+// stableBefore returns the lowest sequence number that may still be in
+// flight, or 0 if there is none.
+func (s *sequencer) stableBefore() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lowest int64
+	for seq := range s.pending {
+		if lowest == 0 || seq < lowest {
+			lowest = seq
+		}
+	}
+	for floor := range s.reserved {
+		if lowest == 0 || floor+1 < lowest {
+			lowest = floor + 1
+		}
+	}
+	return lowest
+}
+
+// Change is an upload, update or deletion of a photo. Exactly one of Photo
+// and Deleted is set. Created is set for photos uploaded after the since
+// cursor, which the client has never seen.
+type Change struct {
+	Seq     int64
+	Photo   *model.PhotoDB
+	Deleted *model.Tombstone
+	Created bool
+}
+
+func (c Change) id() primitive.ObjectID {
+	if c.Photo != nil {
+		return c.Photo.ID
+	}
+	return c.Deleted.ID
+}
+
+type ChangePage struct {
+	Changes []Change
+	Since   string // pass as since to continue after this page
+	HasMore bool
+}
+
+// GetChanges returns the changes visible to the owner, or all changes when
+// ownerID is empty, after the since cursor, in sequence order. An empty
+// since starts from the beginning.
+func (db *MongoPhotoDB) GetChanges(ctx context.Context, ownerID string, since string, limit int64) (*ChangePage, error) {
+	after := &pageCursor{Sort: sortSeq}
+	if since != "" {
+		var err error
+		if after, err = decodePageCursor(since, sortSeq); err != nil {
+			db.Log.Info("invalid sync cursor", zap.Error(err), zap.String("since", since))
+			return nil, err
+		}
+	}
+
+	order := sortOrder{field: "seq", direction: 1}
+	and := bson.A{after.condition(order)}
+	if ownerID != "" {
+		and = append(and, bson.M{"$or": ownedBy(ownerID)})
+	}
+	filter := bson.M{"$and": and}
+	if bound := db.seqs.stableBefore(); bound > 0 {
+		filter["seq"] = bson.M{"$lt": bound}
+	}
+	opts := options.Find().
+		SetLimit(limit + 1).
+		SetSort(bson.D{{Key: "seq", Value: 1}, {Key: "_id", Value: 1}})
+
+	photos := []model.PhotoDB{}
+	output, err := db.collection.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query changed photos from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &photos); err != nil {
+		db.Log.Error("failed to decode changed photos from MongoDB", zap.Error(err))
+		return nil, err
+	}
+
+	tombstones := []model.Tombstone{}
+	output, err = db.tombstones.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query tombstones from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &tombstones); err != nil {
+		db.Log.Error("failed to decode tombstones from MongoDB", zap.Error(err))
+		return nil, err
+	}
+
+	// merge both streams by (seq, _id)
+	page := &ChangePage{Changes: []Change{}}
+	i, j := 0, 0
+	for int64(len(page.Changes)) < limit && (i < len(photos) || j < len(tombstones)) {
+		takePhoto := j == len(tombstones)
+		if i < len(photos) && j < len(tombstones) {
+			p, t := photos[i], tombstones[j]
+			takePhoto = p.Seq < t.Seq || (p.Seq == t.Seq && p.ID.Hex() < t.ID.Hex())
+		}
+		if takePhoto {
+			page.Changes = append(page.Changes, Change{Seq: photos[i].Seq, Photo: &photos[i], Created: photos[i].CreatedSeq > after.Value})
+			i++
+		} else {
+			page.Changes = append(page.Changes, Change{Seq: tombstones[j].Seq, Deleted: &tombstones[j]})
+			j++
+		}
+	}
+	page.HasMore = i < len(photos) || j < len(tombstones)
+
+	if n := len(page.Changes); n > 0 {
+		after = &pageCursor{Sort: sortSeq, Value: page.Changes[n-1].Seq, ID: page.Changes[n-1].id()}
+	}
+	page.Since = after.encode()
+
+	db.Log.Info("retrieved changes from MongoDB", zap.Int("count", len(page.Changes)), zap.Bool("has_more", page.HasMore))
+	return page, nil
+}
+
+// AssignSequences numbers photos stored before change sequences existed, so
+// that they are part of the change feed.
+func (db *MongoPhotoDB) AssignSequences(ctx context.Context) (int, error) {
+	filter := bson.M{"seq": bson.M{"$exists": false}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.M{"_id": 1})
+	output, err := db.collection.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query photos without sequence from MongoDB", zap.Error(err))
+		return 0, err
+	}
+	defer output.Close(ctx)
+
+	assigned := 0
+	for output.Next(ctx) {
+		var photo model.PhotoDB
+		if err := output.Decode(&photo); err != nil {
+			return assigned, err
+		}
+		seq, done, err := db.seqs.next(ctx)
+		if err != nil {
+			return assigned, err
+		}
+		_, err = db.collection.UpdateByID(ctx, photo.ID, bson.M{"$set": bson.M{"seq": seq, "created_seq": seq}})
+		done()
+		if err != nil {
+			db.Log.Error("failed to assign photo sequence in MongoDB", zap.Error(err), zap.String("photo_id", photo.ID.Hex()))
+			return assigned, err
+		}
+		assigned++
+	}
+	return assigned, output.Err()
+}
+
+// saveTombstone records the deletion of a photo under a new sequence
+// number.
+func (db *MongoPhotoDB) saveTombstone(ctx context.Context, photo *model.PhotoDB, seq int64) error {
+	tombstone := model.Tombstone{ID: photo.ID, OwnerID: photo.OwnerID, Seq: seq, DeletedAt: time.Now()}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := db.tombstones.ReplaceOne(ctx, bson.M{"_id": photo.ID}, tombstone, opts); err != nil {
+		db.Log.Error("failed to save tombstone to MongoDB", zap.Error(err), zap.String("photo_id", photo.ID.Hex()))
+		return err
+	}
+	return nil
+}
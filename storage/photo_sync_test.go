@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestSequencerHoldsBackChangesWhileAllocating(t *testing.T) {
+	s := newSequencer(nil)
+	var mu sync.Mutex
+	var counter int64
+	allocated, release := make(chan struct{}), make(chan struct{})
+	s.allocate = func(ctx context.Context) (int64, error) {
+		mu.Lock()
+		counter++
+		seq := counter
+		mu.Unlock()
+		if seq == 1 {
+			// the counter is incremented, but the number not registered yet
+			close(allocated)
+			<-release
+		}
+		return seq, nil
+	}
+
+	first := make(chan func())
+	go func() {
+		_, done, err := s.next(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		first <- done
+	}()
+	<-allocated
+
+	// a later write finishes while the first is between allocation and
+	// registration
+	seq, done, err := s.next(context.Background())
+	if err != nil || seq != 2 {
+		t.Fatalf("second allocation %d, %v", seq, err)
+	}
+	done()
+	if bound := s.stableBefore(); bound == 0 || bound > 1 {
+		t.Fatalf("stable before %d while 1 is allocating, want 1", bound)
+	}
+
+	close(release)
+	doneFirst := <-first
+	if bound := s.stableBefore(); bound != 1 {
+		t.Errorf("stable before %d while 1 is written, want 1", bound)
+	}
+	doneFirst()
+	if bound := s.stableBefore(); bound != 0 {
+		t.Errorf("stable before %d with nothing in flight, want 0", bound)
+	}
+}
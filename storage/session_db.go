@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type SessionDB interface {
+	SaveSession(ctx context.Context, session model.Session) (*model.Session, error)
+	GetSessionByTokenHash(ctx context.Context, tokenHash string) (*model.Session, error)
+	GetSessions(ctx context.Context, userID string) ([]model.Session, error)
+	TouchSession(ctx context.Context, id primitive.ObjectID, seenAt time.Time, ip string, expiresAt time.Time) error
+	DeleteSession(ctx context.Context, id string, userID string) error
+	DeleteSessions(ctx context.Context, userID string, except primitive.ObjectID) (int64, error)
+}
+
+type MongoSessionDB struct {
+	collection *mongo.Collection
+	Log        *zap.Logger
+}
+
+func NewMongoSessionDB(database *mongo.Database, logger *zap.Logger) *MongoSessionDB {
+	return &MongoSessionDB{
+		collection: database.Collection("sessions"),
+		Log:        logger,
+	}
+}
+
+func (db *MongoSessionDB) SaveSession(ctx context.Context, session model.Session) (*model.Session, error) {
+	result, err := db.collection.InsertOne(ctx, session)
+	if err != nil {
+		db.Log.Error("failed to save session to MongoDB", zap.Error(err), zap.String("user_id", session.UserID))
+		return nil, err
+	}
+	oid, ok := result.InsertedID.(primitive.ObjectID)
+	if !ok {
+		db.Log.Error("invalid ObjectID returned from MongoDB insert", zap.Any("inserted_id", result.InsertedID))
+		return nil, mongo.ErrInvalidIndexValue
+	}
+	session.ID = oid
+	db.Log.Info("session saved to MongoDB", zap.String("session_id", oid.Hex()))
+	return &session, nil
+}
+
+// GetSessionByTokenHash returns the session unless it has expired. Expired
+// sessions are removed by a TTL index, but only once a minute.
+func (db *MongoSessionDB) GetSessionByTokenHash(ctx context.Context, tokenHash string) (*model.Session, error) {
+	var session model.Session
+
+	filter := bson.M{"token_hash": tokenHash, "expires_at": bson.M{"$gt": time.Now()}}
+	if err := db.collection.FindOne(ctx, filter).Decode(&session); err != nil {
+		db.Log.Info("failed to get session from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetSessions returns the active sessions of the user, most recently used
+// first.
+func (db *MongoSessionDB) GetSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	sessions := []model.Session{}
+
+	filter := bson.M{"user_id": userID, "expires_at": bson.M{"$gt": time.Now()}}
+	opts := options.Find().SetSort(bson.M{"last_seen_at": -1})
+	output, err := db.collection.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query sessions from MongoDB", zap.Error(err), zap.String("user_id", userID))
+		return nil, err
+	}
+	if err = output.All(ctx, &sessions); err != nil {
+		db.Log.Error("failed to decode sessions from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// TouchSession records activity and extends the session.
+func (db *MongoSessionDB) TouchSession(ctx context.Context, id primitive.ObjectID, seenAt time.Time, ip string, expiresAt time.Time) error {
+	update := bson.M{"$set": bson.M{"last_seen_at": seenAt, "ip": ip, "expires_at": expiresAt}}
+	if _, err := db.collection.UpdateByID(ctx, id, update); err != nil {
+		db.Log.Error("failed to update session in MongoDB", zap.Error(err), zap.String("session_id", id.Hex()))
+		return err
+	}
+	return nil
+}
+
+func (db *MongoSessionDB) DeleteSession(ctx context.Context, id string, userID string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+
+	result, err := db.collection.DeleteOne(ctx, bson.M{"_id": oid, "user_id": userID})
+	if err != nil {
+		db.Log.Error("failed to delete session from MongoDB", zap.Error(err), zap.String("session_id", id))
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	db.Log.Info("session deleted from MongoDB", zap.String("session_id", id))
+	return nil
+}
+
+// DeleteSessions revokes all sessions of the user except one, usually the
+// session making the request. Pass primitive.NilObjectID to revoke all.
+func (db *MongoSessionDB) DeleteSessions(ctx context.Context, userID string, except primitive.ObjectID) (int64, error) {
+	result, err := db.collection.DeleteMany(ctx, bson.M{"user_id": userID, "_id": bson.M{"$ne": except}})
+	if err != nil {
+		db.Log.Error("failed to delete sessions from MongoDB", zap.Error(err), zap.String("user_id", userID))
+		return 0, err
+	}
+	db.Log.Info("sessions deleted from MongoDB", zap.String("user_id", userID), zap.Int64("count", result.DeletedCount))
+	return result.DeletedCount, nil
+}
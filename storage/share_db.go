@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type ShareDB interface {
+	SaveShare(ctx context.Context, share model.ShareLink) (*model.ShareLink, error)
+	GetShareByToken(ctx context.Context, token string) (*model.ShareLink, error)
+	GetShares(ctx context.Context, ownerID string) ([]model.ShareLink, error)
+	RevokeShare(ctx context.Context, id string, ownerID string) error
+}
+
+type MongoShareDB struct {
+	collection *mongo.Collection
+	Log        *zap.Logger
+}
+
+func NewMongoShareDB(database *mongo.Database, logger *zap.Logger) *MongoShareDB {
+	return &MongoShareDB{
+		collection: database.Collection("shares"),
+		Log:        logger,
+	}
+}
+
+func (db *MongoShareDB) SaveShare(ctx context.Context, share model.ShareLink) (*model.ShareLink, error) {
+	result, err := db.collection.InsertOne(ctx, share)
+	if err != nil {
+		db.Log.Error("failed to save share link to MongoDB", zap.Error(err), zap.String("owner_id", share.OwnerID))
+		return nil, err
+	}
+	oid, ok := result.InsertedID.(primitive.ObjectID)
+	if !ok {
+		db.Log.Error("invalid ObjectID returned from MongoDB insert", zap.Any("inserted_id", result.InsertedID))
+		return nil, mongo.ErrInvalidIndexValue
+	}
+	share.ID = oid
+	db.Log.Info("share link saved to MongoDB", zap.String("share_id", oid.Hex()), zap.Int("photos", len(share.PhotoIDs)))
+	return &share, nil
+}
+
+func (db *MongoShareDB) GetShareByToken(ctx context.Context, token string) (*model.ShareLink, error) {
+	var share model.ShareLink
+
+	filter := bson.D{{Key: "token", Value: token}}
+	if err := db.collection.FindOne(ctx, filter).Decode(&share); err != nil {
+		db.Log.Info("failed to get share link from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return &share, nil
+}
+
+func (db *MongoShareDB) GetShares(ctx context.Context, ownerID string) ([]model.ShareLink, error) {
+	shares := []model.ShareLink{}
+
+	filter := bson.M{"owner_id": ownerID}
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	output, err := db.collection.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query share links from MongoDB", zap.Error(err), zap.String("owner_id", ownerID))
+		return nil, err
+	}
+	if err = output.All(ctx, &shares); err != nil {
+		db.Log.Error("failed to decode share links from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return shares, nil
+}
+
+func (db *MongoShareDB) RevokeShare(ctx context.Context, id string, ownerID string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		db.Log.Error("invalid share ID format", zap.Error(err), zap.String("id", id))
+		return err
+	}
+
+	filter := bson.M{"_id": oid, "owner_id": ownerID, "revoked_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now()}}
+	result, err := db.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		db.Log.Error("failed to revoke share link", zap.Error(err), zap.String("share_id", id))
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	db.Log.Info("share link revoked", zap.String("share_id", id))
+	return nil
+}
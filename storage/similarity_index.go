@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"photo-backup/model"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SimilarityIndex is an in-memory BK-tree over perceptual hashes. A BK-tree
+// uses the triangle inequality of the Hamming distance to skip most of the
+// tree, so lookups with a small distance only visit a fraction of the
+// photos. Photos are stored with their owner, so that lookups only return
+// the photos a user can see.
+type SimilarityIndex struct {
+	mu      sync.RWMutex
+	tree    bkTree
+	size    int // entries in the tree, including removed ones
+	removed map[primitive.ObjectID]bool
+}
+
+// compactShare is the share of removed entries at which the tree is
+// rebuilt without them.
+const compactShare = 4
+
+type HashMatch struct {
+	ID       primitive.ObjectID
+	Distance int
+}
+
+func NewSimilarityIndex() *SimilarityIndex {
+	return &SimilarityIndex{removed: map[primitive.ObjectID]bool{}}
+}
+
+// Load adds the hashes of all stored photos.
+func (i *SimilarityIndex) Load(ctx context.Context, db PhotoDB) error {
+	photos, err := db.GetPhotoHashes(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, photo := range photos {
+		if hash, err := ParseHash(photo.PHash); err == nil {
+			i.Add(photo.ID, photo.OwnerID, hash)
+		}
+	}
+	return nil
+}
+
+func (i *SimilarityIndex) Add(id primitive.ObjectID, ownerID string, hash uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.removed, id)
+	if i.tree.add(indexEntry{id: id, ownerID: ownerID}, hash) {
+		i.size++
+	}
+}
+
+// Remove hides the photo from lookups. BK-trees can't delete nodes cheaply,
+// so removed IDs are skipped instead, until they make up a quarter of the
+// tree and it is rebuilt without them.
+func (i *SimilarityIndex) Remove(id primitive.ObjectID) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.removed[id] = true
+	if len(i.removed)*compactShare > i.size {
+		i.compact()
+	}
+}
+
+func (i *SimilarityIndex) compact() {
+	var tree bkTree
+	size := 0
+	i.tree.walk(func(entry indexEntry, hash uint64) {
+		if !i.removed[entry.id] && tree.add(entry, hash) {
+			size++
+		}
+	})
+	i.tree, i.size = tree, size
+	i.removed = map[primitive.ObjectID]bool{}
+}
+
+// Search returns the photos visible to the owner, or all photos when
+// ownerID is empty, within maxDistance of hash, closest first.
+func (i *SimilarityIndex) Search(hash uint64, maxDistance int, ownerID string) []HashMatch {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var matches []HashMatch
+	i.tree.search(hash, maxDistance, func(entry indexEntry, distance int) {
+		visible := ownerID == "" || entry.ownerID == "" || entry.ownerID == ownerID
+		if visible && !i.removed[entry.id] {
+			matches = append(matches, HashMatch{ID: entry.id, Distance: distance})
+		}
+	})
+	sort.Slice(matches, func(a, b int) bool {
+		return matches[a].Distance < matches[b].Distance
+	})
+	return matches
+}
+
+// maxSimilarCandidates bounds how many hash matches are loaded and ranked.
+// Matches are only counted if the user can see them.
+const maxSimilarCandidates = 500
+
+type SimilarPhoto struct {
+	model.PhotoDB
+	Distance   int     `json:"distance"`
+	Similarity float64 `json:"similarity"`
+}
+
+// FindSimilar looks up photos visible to the owner, or to everyone when
+// ownerID is empty, whose hash is within maxDistance of the given photo and
+// ranks them by a mix of hash distance and color histogram overlap, most
+// similar first. The photo itself is not included.
+func (s *LocalPhotoStorage) FindSimilar(ctx context.Context, photo *model.PhotoDB, maxDistance int, ownerID string) ([]SimilarPhoto, error) {
+	if s.Index == nil {
+		return nil, fmt.Errorf("similarity index not available")
+	}
+	hash, err := ParseHash(photo.PHash)
+	if err != nil {
+		return nil, fmt.Errorf("photo %s has no perceptual hash", photo.ID.Hex())
+	}
+
+	matches := s.Index.Search(hash, maxDistance, ownerID)
+	distances := map[primitive.ObjectID]int{}
+	ids := make([]primitive.ObjectID, 0, len(matches))
+	for _, match := range matches {
+		if match.ID == photo.ID {
+			continue
+		}
+		if len(ids) == maxSimilarCandidates {
+			break
+		}
+		distances[match.ID] = match.Distance
+		ids = append(ids, match.ID)
+	}
+	if len(ids) == 0 {
+		return []SimilarPhoto{}, nil
+	}
+
+	candidates, err := s.Db.GetPhotosByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	similar := make([]SimilarPhoto, 0, len(candidates))
+	for _, candidate := range candidates {
+		distance := distances[candidate.ID]
+		similarity := 1 - float64(distance)/64
+		if len(photo.Histogram) > 0 && len(candidate.Histogram) > 0 {
+			similarity = 0.6*similarity + 0.4*HistogramIntersection(photo.Histogram, candidate.Histogram)
+		}
+		similar = append(similar, SimilarPhoto{
+			PhotoDB:    candidate,
+			Distance:   distance,
+			Similarity: math.Round(similarity*1000) / 1000,
+		})
+	}
+	sort.SliceStable(similar, func(a, b int) bool {
+		return similar[a].Similarity > similar[b].Similarity
+	})
+	return similar, nil
+}
+
+type bkTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	hash     uint64
+	entries  []indexEntry // photos sharing this exact hash
+	children map[int]*bkNode
+}
+
+type indexEntry struct {
+	id      primitive.ObjectID
+	ownerID string
+}
+
+// add reports whether the entry was added, it is not if it has the hash
+// already.
+func (t *bkTree) add(entry indexEntry, hash uint64) bool {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, entries: []indexEntry{entry}}
+		return true
+	}
+	node := t.root
+	for {
+		distance := HammingDistance(node.hash, hash)
+		if distance == 0 {
+			for _, existing := range node.entries {
+				if existing.id == entry.id {
+					return false
+				}
+			}
+			node.entries = append(node.entries, entry)
+			return true
+		}
+		child, ok := node.children[distance]
+		if !ok {
+			if node.children == nil {
+				node.children = map[int]*bkNode{}
+			}
+			node.children[distance] = &bkNode{hash: hash, entries: []indexEntry{entry}}
+			return true
+		}
+		node = child
+	}
+}
+
+// walk calls found for every entry of the tree.
+func (t *bkTree) walk(found func(entry indexEntry, hash uint64)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, entry := range node.entries {
+			found(entry, node.hash)
+		}
+		for _, child := range node.children {
+			stack = append(stack, child)
+		}
+	}
+}
+
+func (t *bkTree) search(hash uint64, maxDistance int, found func(entry indexEntry, distance int)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		distance := HammingDistance(node.hash, hash)
+		if distance <= maxDistance {
+			for _, entry := range node.entries {
+				found(entry, distance)
+			}
+		}
+		// only children in [distance-max, distance+max] can contain matches
+		for childDistance, child := range node.children {
+			if childDistance >= distance-maxDistance && childDistance <= distance+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// photosByID serves GetPhotosByIDs from a map.
+type photosByID struct {
+	PhotoDB
+	photos map[primitive.ObjectID]model.PhotoDB
+}
+
+func (db photosByID) GetPhotosByIDs(ctx context.Context, ids []primitive.ObjectID) ([]model.PhotoDB, error) {
+	var photos []model.PhotoDB
+	for _, id := range ids {
+		if photo, ok := db.photos[id]; ok {
+			photos = append(photos, photo)
+		}
+	}
+	return photos, nil
+}
+
+func TestSimilarityIndexSearchIsScopedToOwner(t *testing.T) {
+	index := NewSimilarityIndex()
+	alice, bob, legacy := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	index.Add(alice, "alice", 0)
+	index.Add(bob, "bob", 1)
+	index.Add(legacy, "", 3)
+
+	found := func(ownerID string) map[primitive.ObjectID]bool {
+		ids := map[primitive.ObjectID]bool{}
+		for _, match := range index.Search(0, 8, ownerID) {
+			ids[match.ID] = true
+		}
+		return ids
+	}
+	if ids := found("alice"); len(ids) != 2 || !ids[alice] || !ids[legacy] {
+		t.Errorf("alice finds %v, want her photo and the legacy photo", ids)
+	}
+	if ids := found(""); len(ids) != 3 {
+		t.Errorf("unrestricted search finds %d photos, want 3", len(ids))
+	}
+}
+
+func TestSimilarityIndexCompactsRemovedEntries(t *testing.T) {
+	index := NewSimilarityIndex()
+	ids := make([]primitive.ObjectID, 8)
+	for n := range ids {
+		ids[n] = primitive.NewObjectID()
+		index.Add(ids[n], "alice", uint64(n))
+	}
+
+	index.Remove(ids[0])
+	index.Remove(ids[1])
+	if len(index.removed) != 2 || index.size != 8 {
+		t.Fatalf("%d removed of %d before compacting", len(index.removed), index.size)
+	}
+	// a third removed entry is more than a quarter of the tree
+	index.Remove(ids[2])
+	if len(index.removed) != 0 || index.size != 5 {
+		t.Errorf("%d removed of %d after compacting, want 0 of 5", len(index.removed), index.size)
+	}
+	found := map[primitive.ObjectID]bool{}
+	for _, match := range index.Search(0, 64, "") {
+		found[match.ID] = true
+	}
+	if len(found) != 5 || found[ids[0]] || found[ids[2]] || !found[ids[7]] {
+		t.Errorf("found %d photos after compacting, want the 5 left", len(found))
+	}
+}
+
+func TestFindSimilarCapsOnlyVisibleCandidates(t *testing.T) {
+	db := photosByID{photos: map[primitive.ObjectID]model.PhotoDB{}}
+	s := &LocalPhotoStorage{Db: db, Index: NewSimilarityIndex()}
+	add := func(ownerID string, hash uint64) model.PhotoDB {
+		photo := model.PhotoDB{ID: primitive.NewObjectID(), OwnerID: ownerID}
+		photo.PHash = FormatHash(hash)
+		db.photos[photo.ID] = photo
+		s.Index.Add(photo.ID, ownerID, hash)
+		return photo
+	}
+
+	source := add("alice", 0)
+	// closer matches of another user that would fill the candidate cap
+	for i := 0; i < maxSimilarCandidates+100; i++ {
+		add("bob", 1)
+	}
+	match := add("alice", 3)
+
+	similar, err := s.FindSimilar(context.Background(), &source, 8, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(similar) != 1 || similar[0].ID != match.ID {
+		t.Fatalf("found %d photos, want only alice's match", len(similar))
+	}
+
+	all, err := s.FindSimilar(context.Background(), &source, 8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != maxSimilarCandidates {
+		t.Errorf("unrestricted lookup found %d photos, want the cap of %d", len(all), maxSimilarCandidates)
+	}
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const usageCollection = "usage"
+
+// UsageDB keeps per-user storage counters and quotas. The counters are
+// updated as photos are saved and deleted; RecountUsage on the photo
+// database rebuilds them from scratch.
+type UsageDB interface {
+	AddUsage(ctx context.Context, photo *model.PhotoDB, delta int64) error
+	GetUsage(ctx context.Context, ownerID string) ([]UsageBucket, error)
+	GetQuota(ctx context.Context, ownerID string) (int64, error)
+	SetQuota(ctx context.Context, ownerID string, quota *int64) error
+}
+
+// UsageBucket counts the photos of an owner with the same content type,
+// taken in the same year.
+type UsageBucket struct {
+	Key            UsageKey `bson:"_id"`
+	Photos         int64    `bson:"photos"`
+	OriginalBytes  int64    `bson:"original_bytes"`
+	RenditionBytes int64    `bson:"rendition_bytes"`
+}
+
+// UsageKey fields are kept in this order, both when counting and when
+// recounting, as MongoDB compares embedded documents field by field.
+type UsageKey struct {
+	OwnerID     string `bson:"owner_id"`
+	ContentType string `bson:"content_type"`
+	Year        int    `bson:"year"`
+}
+
+// TotalBytes sums the originals and renditions of all buckets.
+func TotalBytes(buckets []UsageBucket) int64 {
+	var total int64
+	for _, bucket := range buckets {
+		total += bucket.OriginalBytes + bucket.RenditionBytes
+	}
+	return total
+}
+
+type MongoUsageDB struct {
+	usage        *mongo.Collection
+	quotas       *mongo.Collection
+	DefaultQuota int64 // bytes per user without a quota of their own, 0 for unlimited
+	Log          *zap.Logger
+}
+
+func NewMongoUsageDB(database *mongo.Database, defaultQuota int64, logger *zap.Logger) *MongoUsageDB {
+	return &MongoUsageDB{
+		usage:        database.Collection(usageCollection),
+		quotas:       database.Collection("quotas"),
+		DefaultQuota: defaultQuota,
+		Log:          logger,
+	}
+}
+
+// AddUsage adds a photo to its owner's counters, or removes it with a
+// delta of -1.
+func (db *MongoUsageDB) AddUsage(ctx context.Context, photo *model.PhotoDB, delta int64) error {
+	key := UsageKey{OwnerID: photo.OwnerID, ContentType: photo.ContentType, Year: photo.TakenAt.UTC().Year()}
+	update := bson.M{"$inc": bson.M{
+		"photos":          delta,
+		"original_bytes":  delta * photo.Size,
+		"rendition_bytes": delta * photo.ThumbnailSize,
+	}}
+	opts := options.Update().SetUpsert(true)
+	if _, err := db.usage.UpdateByID(ctx, key, update, opts); err != nil {
+		db.Log.Error("failed to update usage in MongoDB", zap.Error(err), zap.String("owner_id", photo.OwnerID))
+		return err
+	}
+	return nil
+}
+
+func (db *MongoUsageDB) GetUsage(ctx context.Context, ownerID string) ([]UsageBucket, error) {
+	buckets := []UsageBucket{}
+
+	filter := bson.M{"_id.owner_id": ownerID, "photos": bson.M{"$gt": 0}}
+	opts := options.Find().SetSort(bson.D{{Key: "_id.year", Value: -1}, {Key: "_id.content_type", Value: 1}})
+	output, err := db.usage.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query usage from MongoDB", zap.Error(err), zap.String("owner_id", ownerID))
+		return nil, err
+	}
+	if err = output.All(ctx, &buckets); err != nil {
+		db.Log.Error("failed to decode usage from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// GetQuota returns the quota of the user in bytes, or 0 if the user may
+// store an unlimited amount.
+func (db *MongoUsageDB) GetQuota(ctx context.Context, ownerID string) (int64, error) {
+	var quota struct {
+		Bytes int64 `bson:"bytes"`
+	}
+	err := db.quotas.FindOne(ctx, bson.M{"_id": ownerID}).Decode(&quota)
+	if err == mongo.ErrNoDocuments {
+		return db.DefaultQuota, nil
+	}
+	if err != nil {
+		db.Log.Error("failed to get quota from MongoDB", zap.Error(err), zap.String("owner_id", ownerID))
+		return 0, err
+	}
+	return quota.Bytes, nil
+}
+
+// SetQuota gives the user a quota of their own, 0 meaning unlimited. A nil
+// quota reverts the user to the default.
+func (db *MongoUsageDB) SetQuota(ctx context.Context, ownerID string, quota *int64) error {
+	var err error
+	if quota == nil {
+		_, err = db.quotas.DeleteOne(ctx, bson.M{"_id": ownerID})
+	} else {
+		opts := options.Replace().SetUpsert(true)
+		_, err = db.quotas.ReplaceOne(ctx, bson.M{"_id": ownerID}, bson.M{"_id": ownerID, "bytes": *quota}, opts)
+	}
+	if err != nil {
+		db.Log.Error("failed to set quota in MongoDB", zap.Error(err), zap.String("owner_id", ownerID))
+		return err
+	}
+	db.Log.Info("quota set in MongoDB", zap.String("owner_id", ownerID))
+	return nil
+}
+
+// RecountUsage rebuilds the usage counters from the stored photos. The
+// counters are replaced at once when the aggregation has finished, but
+// photos saved or deleted meanwhile may be missed, so it is best run while
+// no uploads are in progress.
+func (db *MongoPhotoDB) RecountUsage(ctx context.Context) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.D{
+				{Key: "owner_id", Value: bson.M{"$ifNull": bson.A{"$owner_id", ""}}},
+				{Key: "content_type", Value: "$content_type"},
+				{Key: "year", Value: bson.M{"$year": "$taken_at"}},
+			},
+			"photos":          bson.M{"$sum": 1},
+			"original_bytes":  bson.M{"$sum": "$size"},
+			"rendition_bytes": bson.M{"$sum": bson.M{"$ifNull": bson.A{"$thumbnail_size", 0}}},
+		}}},
+		{{Key: "$out", Value: usageCollection}},
+	}
+	output, err := db.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		db.Log.Error("failed to recount usage in MongoDB", zap.Error(err))
+		return err
+	}
+	output.Close(ctx)
+	db.Log.Info("usage recounted in MongoDB")
+	return nil
+}
+
+// GetPhotosMissingThumbnailSize returns photos with an ID greater than
+// after whose thumbnail size was not recorded, ordered by ID so callers can
+// page through them.
+func (db *MongoPhotoDB) GetPhotosMissingThumbnailSize(ctx context.Context, after primitive.ObjectID, limit int64) ([]model.PhotoDB, error) {
+	photos := []model.PhotoDB{}
+
+	filter := bson.M{"_id": bson.M{"$gt": after}, "thumbnail_size": bson.M{"$exists": false}}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit).
+		SetProjection(bson.M{"thumbnail_path": 1})
+	output, err := db.collection.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query photos missing thumbnail size from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &photos); err != nil {
+		db.Log.Error("failed to decode photos missing thumbnail size from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return photos, nil
+}
+
+func (db *MongoPhotoDB) SetThumbnailSize(ctx context.Context, id primitive.ObjectID, size int64) error {
+	if _, err := db.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"thumbnail_size": size}}); err != nil {
+		db.Log.Error("failed to set thumbnail size in MongoDB", zap.Error(err), zap.String("photo_id", id.Hex()))
+		return err
+	}
+	return nil
+}
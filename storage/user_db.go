@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type UserDB interface {
+	GetUser(ctx context.Context, id string) (*model.User, error)
+	SetTwoFactor(ctx context.Context, id string, twoFactor *model.TwoFactor) error
+	UseTOTPStep(ctx context.Context, id string, step int64) error
+	UseRecoveryCode(ctx context.Context, id string, codeHash string) error
+	SetRecoveryCodes(ctx context.Context, id string, codeHashes []string) error
+	GetUsers(ctx context.Context) ([]model.User, error)
+	SetRole(ctx context.Context, id string, role string) error
+	CountRole(ctx context.Context, role string) (int64, error)
+	GetUserByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error)
+	LinkIdentity(ctx context.Context, id string, identity model.Identity) error
+	CreateUser(ctx context.Context, user model.User) error
+}
+
+type MongoUserDB struct {
+	collection *mongo.Collection
+	Log        *zap.Logger
+}
+
+func NewMongoUserDB(database *mongo.Database, logger *zap.Logger) *MongoUserDB {
+	return &MongoUserDB{
+		collection: database.Collection("users"),
+		Log:        logger,
+	}
+}
+
+// GetUser returns the stored settings of a user. Users are created on
+// first write, so a missing user has the default settings.
+func (db *MongoUserDB) GetUser(ctx context.Context, id string) (*model.User, error) {
+	var user model.User
+
+	err := db.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return &model.User{ID: id}, nil
+	}
+	if err != nil {
+		db.Log.Error("failed to get user from MongoDB", zap.Error(err), zap.String("user_id", id))
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetTwoFactor replaces the TOTP configuration of the user, nil disables
+// it.
+func (db *MongoUserDB) SetTwoFactor(ctx context.Context, id string, twoFactor *model.TwoFactor) error {
+	update := bson.M{
+		"$set":         bson.M{"two_factor": twoFactor},
+		"$setOnInsert": bson.M{"created_at": time.Now()},
+	}
+	if twoFactor == nil {
+		update["$unset"] = bson.M{"two_factor": ""}
+		delete(update, "$set")
+	}
+	opts := options.Update().SetUpsert(true)
+	if _, err := db.collection.UpdateByID(ctx, id, update, opts); err != nil {
+		db.Log.Error("failed to set two-factor settings in MongoDB", zap.Error(err), zap.String("user_id", id))
+		return err
+	}
+	db.Log.Info("two-factor settings updated in MongoDB", zap.String("user_id", id), zap.Bool("enabled", twoFactor != nil && twoFactor.Enabled))
+	return nil
+}
+
+// UseTOTPStep records that a code of the step was accepted. It fails with
+// mongo.ErrNoDocuments if a code of the same or a later step was accepted
+// before, so every code can only be used once.
+func (db *MongoUserDB) UseTOTPStep(ctx context.Context, id string, step int64) error {
+	filter := bson.M{"_id": id, "two_factor.last_step": bson.M{"$lt": step}}
+	result, err := db.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"two_factor.last_step": step}})
+	if err != nil {
+		db.Log.Error("failed to record TOTP step in MongoDB", zap.Error(err), zap.String("user_id", id))
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// UseRecoveryCode removes an unused recovery code. It fails with
+// mongo.ErrNoDocuments if the code is unknown or was used before.
+func (db *MongoUserDB) UseRecoveryCode(ctx context.Context, id string, codeHash string) error {
+	filter := bson.M{"_id": id, "two_factor.recovery_codes": codeHash}
+	result, err := db.collection.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"two_factor.recovery_codes": codeHash}})
+	if err != nil {
+		db.Log.Error("failed to use recovery code in MongoDB", zap.Error(err), zap.String("user_id", id))
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	db.Log.Info("recovery code used", zap.String("user_id", id))
+	return nil
+}
+
+func (db *MongoUserDB) SetRecoveryCodes(ctx context.Context, id string, codeHashes []string) error {
+	if _, err := db.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"two_factor.recovery_codes": codeHashes}}); err != nil {
+		db.Log.Error("failed to set recovery codes in MongoDB", zap.Error(err), zap.String("user_id", id))
+		return err
+	}
+	return nil
+}
+
+// GetUsers returns the users stored in the database, i.e. those who changed
+// a setting or were given a role.
+func (db *MongoUserDB) GetUsers(ctx context.Context) ([]model.User, error) {
+	users := []model.User{}
+
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetProjection(bson.M{"two_factor.secret": 0, "two_factor.recovery_codes": 0})
+	output, err := db.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		db.Log.Error("failed to query users from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &users); err != nil {
+		db.Log.Error("failed to decode users from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return users, nil
+}
+
+// SetRole assigns a role, creating the user if needed, so roles can be
+// given before the user's first login.
+func (db *MongoUserDB) SetRole(ctx context.Context, id string, role string) error {
+	update := bson.M{
+		"$set":         bson.M{"role": role},
+		"$setOnInsert": bson.M{"created_at": time.Now()},
+	}
+	opts := options.Update().SetUpsert(true)
+	if _, err := db.collection.UpdateByID(ctx, id, update, opts); err != nil {
+		db.Log.Error("failed to set role in MongoDB", zap.Error(err), zap.String("user_id", id))
+		return err
+	}
+	db.Log.Info("role set in MongoDB", zap.String("user_id", id), zap.String("role", role))
+	return nil
+}
+
+func (db *MongoUserDB) CountRole(ctx context.Context, role string) (int64, error) {
+	count, err := db.collection.CountDocuments(ctx, bson.M{"role": role})
+	if err != nil {
+		db.Log.Error("failed to count users in MongoDB", zap.Error(err), zap.String("role", role))
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetUserByIdentity returns the user linked to an OpenID Connect account,
+// or mongo.ErrNoDocuments.
+func (db *MongoUserDB) GetUserByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error) {
+	var user model.User
+
+	filter := bson.M{"identity.issuer": issuer, "identity.subject": subject}
+	if err := db.collection.FindOne(ctx, filter).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			db.Log.Error("failed to get user by identity from MongoDB", zap.Error(err), zap.String("subject", subject))
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LinkIdentity links an existing user to an OpenID Connect account, or
+// updates the email and name of the linked one. It fails with
+// mongo.ErrNoDocuments if the user does not exist or is linked to another
+// account.
+func (db *MongoUserDB) LinkIdentity(ctx context.Context, id string, identity model.Identity) error {
+	filter := bson.M{"_id": id, "$or": bson.A{
+		bson.M{"identity": bson.M{"$exists": false}},
+		bson.M{"identity.issuer": identity.Issuer, "identity.subject": identity.Subject},
+	}}
+	result, err := db.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"identity": identity}})
+	if err != nil {
+		db.Log.Error("failed to link identity in MongoDB", zap.Error(err), zap.String("user_id", id))
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// CreateUser inserts a new user. It fails with a duplicate key error if the
+// ID is taken.
+func (db *MongoUserDB) CreateUser(ctx context.Context, user model.User) error {
+	if _, err := db.collection.InsertOne(ctx, user); err != nil {
+		db.Log.Error("failed to create user in MongoDB", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+	db.Log.Info("user created in MongoDB", zap.String("user_id", user.ID), zap.String("role", user.Role))
+	return nil
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"photo-backup/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+type WebhookDB interface {
+	SaveWebhook(ctx context.Context, webhook model.Webhook) (*model.Webhook, error)
+	GetWebhooks(ctx context.Context, ownerID string) ([]model.Webhook, error)
+	GetWebhook(ctx context.Context, id string, ownerID string) (*model.Webhook, error)
+	UpdateWebhook(ctx context.Context, id string, ownerID string, update WebhookUpdate) (*model.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string, ownerID string) error
+	GetSubscribedWebhooks(ctx context.Context, ownerID string, eventType string) ([]model.Webhook, error)
+	SaveDeliveries(ctx context.Context, deliveries []model.WebhookDelivery) error
+	GetDueDeliveries(ctx context.Context, now time.Time, limit int64) ([]model.WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery model.WebhookDelivery) error
+	GetDeliveries(ctx context.Context, webhookID primitive.ObjectID, before primitive.ObjectID, limit int64) ([]model.WebhookDelivery, error)
+	CountDeliveries(ctx context.Context, webhookID primitive.ObjectID) (int64, error)
+}
+
+type WebhookUpdate struct {
+	URL         *string
+	Description *string
+	Events      *[]string
+	Active      *bool
+}
+
+func (u WebhookUpdate) set() bson.M {
+	set := bson.M{}
+	if u.URL != nil {
+		set["url"] = *u.URL
+	}
+	if u.Description != nil {
+		set["description"] = *u.Description
+	}
+	if u.Events != nil {
+		set["events"] = *u.Events
+	}
+	if u.Active != nil {
+		set["active"] = *u.Active
+	}
+	return set
+}
+
+type MongoWebhookDB struct {
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+	Log        *zap.Logger
+}
+
+func NewMongoWebhookDB(database *mongo.Database, logger *zap.Logger) *MongoWebhookDB {
+	return &MongoWebhookDB{
+		webhooks:   database.Collection("webhooks"),
+		deliveries: database.Collection("webhook_deliveries"),
+		Log:        logger,
+	}
+}
+
+func (db *MongoWebhookDB) SaveWebhook(ctx context.Context, webhook model.Webhook) (*model.Webhook, error) {
+	result, err := db.webhooks.InsertOne(ctx, webhook)
+	if err != nil {
+		db.Log.Error("failed to save webhook to MongoDB", zap.Error(err), zap.String("owner_id", webhook.OwnerID))
+		return nil, err
+	}
+	oid, ok := result.InsertedID.(primitive.ObjectID)
+	if !ok {
+		db.Log.Error("invalid ObjectID returned from MongoDB insert", zap.Any("inserted_id", result.InsertedID))
+		return nil, mongo.ErrInvalidIndexValue
+	}
+	webhook.ID = oid
+	db.Log.Info("webhook saved to MongoDB", zap.String("webhook_id", oid.Hex()))
+	return &webhook, nil
+}
+
+func (db *MongoWebhookDB) GetWebhooks(ctx context.Context, ownerID string) ([]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	output, err := db.webhooks.Find(ctx, bson.M{"owner_id": ownerID}, opts)
+	if err != nil {
+		db.Log.Error("failed to query webhooks from MongoDB", zap.Error(err), zap.String("owner_id", ownerID))
+		return nil, err
+	}
+	if err = output.All(ctx, &webhooks); err != nil {
+		db.Log.Error("failed to decode webhooks from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (db *MongoWebhookDB) GetWebhook(ctx context.Context, id string, ownerID string) (*model.Webhook, error) {
+	var webhook model.Webhook
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	filter := bson.M{"_id": oid, "owner_id": ownerID}
+	if err := db.webhooks.FindOne(ctx, filter).Decode(&webhook); err != nil {
+		db.Log.Info("failed to get webhook from MongoDB", zap.Error(err), zap.String("webhook_id", id))
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (db *MongoWebhookDB) UpdateWebhook(ctx context.Context, id string, ownerID string, update WebhookUpdate) (*model.Webhook, error) {
+	var webhook model.Webhook
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	set := update.set()
+	if len(set) == 0 {
+		return db.GetWebhook(ctx, id, ownerID)
+	}
+
+	filter := bson.M{"_id": oid, "owner_id": ownerID}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := db.webhooks.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&webhook); err != nil {
+		db.Log.Info("failed to update webhook in MongoDB", zap.Error(err), zap.String("webhook_id", id))
+		return nil, err
+	}
+	db.Log.Info("webhook updated in MongoDB", zap.String("webhook_id", id))
+	return &webhook, nil
+}
+
+// DeleteWebhook removes the webhook and its delivery log.
+func (db *MongoWebhookDB) DeleteWebhook(ctx context.Context, id string, ownerID string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+
+	result, err := db.webhooks.DeleteOne(ctx, bson.M{"_id": oid, "owner_id": ownerID})
+	if err != nil {
+		db.Log.Error("failed to delete webhook from MongoDB", zap.Error(err), zap.String("webhook_id", id))
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	if _, err := db.deliveries.DeleteMany(ctx, bson.M{"webhook_id": oid}); err != nil {
+		db.Log.Error("failed to delete webhook deliveries from MongoDB", zap.Error(err), zap.String("webhook_id", id))
+	}
+	db.Log.Info("webhook deleted from MongoDB", zap.String("webhook_id", id))
+	return nil
+}
+
+// GetSubscribedWebhooks returns the active webhooks of the owner that want
+// events of the given type, or those of every user when ownerID is empty,
+// for photos uploaded before ownership was recorded. The dispatcher checks
+// which of their owners may receive the event.
+func (db *MongoWebhookDB) GetSubscribedWebhooks(ctx context.Context, ownerID string, eventType string) ([]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+
+	filter := bson.M{
+		"active": true,
+		"$or": bson.A{
+			bson.M{"events": eventType},
+			bson.M{"events": bson.M{"$exists": false}},
+			bson.M{"events": bson.M{"$size": 0}},
+		},
+	}
+	if ownerID != "" {
+		filter["owner_id"] = ownerID
+	}
+	output, err := db.webhooks.Find(ctx, filter)
+	if err != nil {
+		db.Log.Error("failed to query subscribed webhooks from MongoDB", zap.Error(err), zap.String("event_type", eventType))
+		return nil, err
+	}
+	if err = output.All(ctx, &webhooks); err != nil {
+		db.Log.Error("failed to decode webhooks from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (db *MongoWebhookDB) SaveDeliveries(ctx context.Context, deliveries []model.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, len(deliveries))
+	for i, delivery := range deliveries {
+		documents[i] = delivery
+	}
+	if _, err := db.deliveries.InsertMany(ctx, documents); err != nil {
+		db.Log.Error("failed to save webhook deliveries to MongoDB", zap.Error(err), zap.Int("count", len(deliveries)))
+		return err
+	}
+	return nil
+}
+
+// GetDueDeliveries returns pending deliveries whose next attempt is due,
+// oldest first.
+func (db *MongoWebhookDB) GetDueDeliveries(ctx context.Context, now time.Time, limit int64) ([]model.WebhookDelivery, error) {
+	deliveries := []model.WebhookDelivery{}
+
+	filter := bson.M{"status": model.DeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	opts := options.Find().SetSort(bson.M{"next_attempt_at": 1}).SetLimit(limit)
+	output, err := db.deliveries.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query due webhook deliveries from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	if err = output.All(ctx, &deliveries); err != nil {
+		db.Log.Error("failed to decode webhook deliveries from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (db *MongoWebhookDB) UpdateDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	if _, err := db.deliveries.ReplaceOne(ctx, bson.M{"_id": delivery.ID}, delivery); err != nil {
+		db.Log.Error("failed to update webhook delivery in MongoDB", zap.Error(err), zap.String("delivery_id", delivery.ID.Hex()))
+		return err
+	}
+	return nil
+}
+
+// GetDeliveries returns the delivery log of a webhook, newest first. Pass
+// the last ID of the previous page as before, or a zero ID for the first
+// page.
+func (db *MongoWebhookDB) GetDeliveries(ctx context.Context, webhookID primitive.ObjectID, before primitive.ObjectID, limit int64) ([]model.WebhookDelivery, error) {
+	deliveries := []model.WebhookDelivery{}
+
+	filter := bson.M{"webhook_id": webhookID}
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit)
+	output, err := db.deliveries.Find(ctx, filter, opts)
+	if err != nil {
+		db.Log.Error("failed to query webhook deliveries from MongoDB", zap.Error(err), zap.String("webhook_id", webhookID.Hex()))
+		return nil, err
+	}
+	if err = output.All(ctx, &deliveries); err != nil {
+		db.Log.Error("failed to decode webhook deliveries from MongoDB", zap.Error(err))
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (db *MongoWebhookDB) CountDeliveries(ctx context.Context, webhookID primitive.ObjectID) (int64, error) {
+	count, err := db.deliveries.CountDocuments(ctx, bson.M{"webhook_id": webhookID})
+	if err != nil {
+		db.Log.Error("failed to count webhook deliveries in MongoDB", zap.Error(err), zap.String("webhook_id", webhookID.Hex()))
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,64 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the test vectors in RFC 6238,
+// Appendix B.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestCodeRFC6238(t *testing.T) {
+	// the RFC lists 8 digit codes, of which 6 digit codes are the last 6
+	for _, test := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		got := Code(rfc6238Secret, Step(time.Unix(test.unix, 0)))
+		if want := test.want[len(test.want)-Digits:]; got != want {
+			t.Errorf("code at %d: %s, want %s", test.unix, got, want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	for offset := int64(-Skew); offset <= Skew; offset++ {
+		got, ok := Verify(rfc6238Secret, Code(rfc6238Secret, step+offset), now)
+		if !ok || got != step+offset {
+			t.Errorf("code of step %+d: step %d, ok %v", offset, got, ok)
+		}
+	}
+	for _, offset := range []int64{-Skew - 1, Skew + 1} {
+		if _, ok := Verify(rfc6238Secret, Code(rfc6238Secret, step+offset), now); ok {
+			t.Errorf("code of step %+d accepted", offset)
+		}
+	}
+
+	code := Code(rfc6238Secret, step)
+	if _, ok := Verify(rfc6238Secret, code[:3]+" "+code[3:], now); !ok {
+		t.Error("code with a space rejected")
+	}
+	if _, ok := Verify(rfc6238Secret, code[:5], now); ok {
+		t.Error("short code accepted")
+	}
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	encoded := EncodeSecret(rfc6238Secret)
+	decoded, err := DecodeSecret(strings.ToLower(encoded[:8]) + " " + encoded[8:])
+	if err != nil || string(decoded) != string(rfc6238Secret) {
+		t.Errorf("decoded %q, %v", decoded, err)
+	}
+}
@@ -0,0 +1,75 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"photo-backup/model"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPublicAddress(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:2800::1":    true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+		"ff02::1":         false,
+	} {
+		if got := publicAddress(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddress(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	ctx := context.Background()
+	if err := CheckURL(ctx, "https://93.184.216.34/hook"); err != nil {
+		t.Errorf("public URL rejected: %v", err)
+	}
+	for _, raw := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+	} {
+		if err := CheckURL(ctx, raw); !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("CheckURL(%s) = %v, want ErrPrivateAddress", raw, err)
+		}
+	}
+	for _, raw := range []string{"ftp://example.com/hook", "/hook", "http://"} {
+		if err := CheckURL(ctx, raw); err == nil {
+			t.Errorf("CheckURL(%s) accepted an invalid URL", raw)
+		}
+	}
+}
+
+func TestDeliveryRefusesPrivateAddress(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	// e.g. a host that resolved to a public address when it was registered
+	d := NewDispatcher(nil, zap.NewNop())
+	attempt := d.send(context.Background(), &model.Webhook{URL: server.URL, Secret: "whsec_test"}, model.WebhookDelivery{Payload: "{}"})
+	if called || !strings.Contains(attempt.Error, ErrPrivateAddress.Error()) {
+		t.Errorf("delivery to %s: error %q, server called: %v", server.URL, attempt.Error, called)
+	}
+}
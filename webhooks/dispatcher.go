@@ -0,0 +1,263 @@
+// Package webhooks delivers library events to user configured URLs.
+//
+// Published events are queued and recorded as a pending delivery per
+// subscribed webhook, which a background loop sends, so recorded deliveries
+// survive restarts. Failed
+// deliveries are retried with exponential backoff. Requests are signed with
+// the webhook's secret, see Sign.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"photo-backup/events"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+
+	maxAttempts     = 6
+	deliveryTimeout = 10 * time.Second
+	pollInterval    = 15 * time.Second
+	batchSize       = 20
+	queueSize       = 1000 // events waiting to be recorded as deliveries
+)
+
+type Dispatcher struct {
+	Db     storage.WebhookDB
+	Client *http.Client // refuses non-public addresses, see CheckURL
+	Log    *zap.Logger
+
+	// CanReceive reports whether the owner of a webhook may be sent the
+	// event. Events go to every subscribed webhook if it is nil.
+	CanReceive func(ctx context.Context, userID string, event events.Event) bool
+
+	queue chan events.Event
+	wake  chan struct{}
+}
+
+func NewDispatcher(db storage.WebhookDB, logger *zap.Logger) *Dispatcher {
+	return &Dispatcher{
+		Db:     db,
+		Client: newClient(),
+		Log:    logger,
+		queue:  make(chan events.Event, queueSize),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// NewSecret generates a signing secret for a new webhook.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Sign returns the signature header value for a request body sent at the
+// given time: "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">".
+// Receivers recompute the HMAC with their secret and should reject old
+// timestamps to prevent replays.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Publish queues the event for Run, so that requests don't wait for the
+// webhooks to be looked up. Events are dropped if the queue is full.
+func (d *Dispatcher) Publish(ctx context.Context, event events.Event) {
+	select {
+	case d.queue <- event:
+	default:
+		d.Log.Error("webhook event queue full, event dropped", zap.String("event_id", event.ID), zap.String("event_type", event.Type))
+	}
+}
+
+// record saves a pending delivery for every webhook subscribed to the event
+// whose owner may receive it and wakes up the delivery loop.
+func (d *Dispatcher) record(ctx context.Context, event events.Event) {
+	subscribed, err := d.Db.GetSubscribedWebhooks(ctx, event.OwnerID, event.Type)
+	if err != nil {
+		return
+	}
+	webhooks := subscribed[:0]
+	allowed := map[string]bool{}
+	for _, webhook := range subscribed {
+		ok, checked := allowed[webhook.OwnerID]
+		if !checked {
+			ok = d.CanReceive == nil || d.CanReceive(ctx, webhook.OwnerID, event)
+			allowed[webhook.OwnerID] = ok
+		}
+		if ok {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		d.Log.Error("failed to encode webhook event", zap.String("event_type", event.Type), zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	deliveries := make([]model.WebhookDelivery, len(webhooks))
+	for i, webhook := range webhooks {
+		deliveries[i] = model.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			OwnerID:       webhook.OwnerID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Payload:       string(payload),
+			Status:        model.DeliveryPending,
+			Attempts:      []model.DeliveryAttempt{},
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+	}
+	if err := d.Db.SaveDeliveries(ctx, deliveries); err != nil {
+		return
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run records published events and sends due deliveries until the context
+// is canceled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-d.queue:
+				d.record(ctx, event)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := d.Db.GetDueDeliveries(ctx, time.Now(), batchSize)
+		if err != nil || len(deliveries) == 0 {
+			return
+		}
+		for _, delivery := range deliveries {
+			d.deliver(ctx, delivery)
+		}
+		if len(deliveries) < batchSize {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery model.WebhookDelivery) {
+	webhook, err := d.Db.GetWebhook(ctx, delivery.WebhookID.Hex(), delivery.OwnerID)
+	var attempt model.DeliveryAttempt
+	switch {
+	case err != nil:
+		attempt = model.DeliveryAttempt{At: time.Now(), Error: "webhook not found"}
+	case !webhook.Active:
+		attempt = model.DeliveryAttempt{At: time.Now(), Error: "webhook is disabled"}
+	default:
+		attempt = d.send(ctx, webhook, delivery)
+	}
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	delivery.NextAttemptAt = nil
+	switch {
+	case attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300:
+		delivery.Status = model.DeliverySucceeded
+	case err != nil || len(delivery.Attempts) >= maxAttempts:
+		delivery.Status = model.DeliveryFailed
+	default:
+		next := time.Now().Add(retryDelay(len(delivery.Attempts)))
+		delivery.NextAttemptAt = &next
+	}
+
+	if delivery.Status != model.DeliveryPending {
+		d.Log.Info("webhook delivery finished",
+			zap.String("delivery_id", delivery.ID.Hex()),
+			zap.String("status", delivery.Status),
+			zap.Int("attempts", len(delivery.Attempts)),
+		)
+	}
+	d.Db.UpdateDelivery(ctx, delivery)
+}
+
+// retryDelay is the wait after the given number of failed attempts:
+// 30s, 2m, 8m, 32m and about 2h.
+func retryDelay(attempts int) time.Duration {
+	return 30 * time.Second << (2 * (attempts - 1))
+}
+
+func (d *Dispatcher) send(ctx context.Context, webhook *model.Webhook, delivery model.WebhookDelivery) model.DeliveryAttempt {
+	start := time.Now()
+	attempt := model.DeliveryAttempt{At: start}
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "photo-backup-webhooks")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, delivery.ID.Hex())
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, start, body))
+
+	resp, err := d.Client.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		attempt.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return attempt
+}
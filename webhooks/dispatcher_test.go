@@ -0,0 +1,89 @@
+package webhooks
+
+import (
+	"context"
+	"photo-backup/events"
+	"photo-backup/model"
+	"photo-backup/storage"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+type fakeWebhookDB struct {
+	storage.WebhookDB
+	webhooks   []model.Webhook
+	mu         sync.Mutex
+	deliveries []model.WebhookDelivery
+}
+
+func (db *fakeWebhookDB) GetSubscribedWebhooks(ctx context.Context, ownerID string, eventType string) ([]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+	for _, webhook := range db.webhooks {
+		if ownerID == "" || webhook.OwnerID == ownerID {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+func (db *fakeWebhookDB) SaveDeliveries(ctx context.Context, deliveries []model.WebhookDelivery) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.deliveries = append(db.deliveries, deliveries...)
+	return nil
+}
+
+func (db *fakeWebhookDB) GetDueDeliveries(ctx context.Context, now time.Time, limit int64) ([]model.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (db *fakeWebhookDB) saved() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.deliveries)
+}
+
+func TestPublishChecksRecipients(t *testing.T) {
+	db := &fakeWebhookDB{webhooks: []model.Webhook{
+		{ID: primitive.NewObjectID(), OwnerID: "alice"},
+		{ID: primitive.NewObjectID(), OwnerID: "bob"},
+		{ID: primitive.NewObjectID(), OwnerID: "bob"},
+	}}
+	d := NewDispatcher(db, zap.NewNop())
+	checks := 0
+	d.CanReceive = func(ctx context.Context, userID string, event events.Event) bool {
+		checks++
+		return userID == "alice"
+	}
+
+	d.record(context.Background(), events.New(events.PhotoDeleted, "", events.Data{PhotoID: "p1"}))
+	if len(db.deliveries) != 1 || db.deliveries[0].OwnerID != "alice" {
+		t.Errorf("deliveries %+v, want one to alice", db.deliveries)
+	}
+	if checks != 2 {
+		t.Errorf("checked recipients %d times, want once per owner", checks)
+	}
+}
+
+func TestPublishDoesNotWait(t *testing.T) {
+	db := &fakeWebhookDB{webhooks: []model.Webhook{{ID: primitive.NewObjectID(), OwnerID: "alice"}}}
+	d := NewDispatcher(db, zap.NewNop())
+
+	d.Publish(context.Background(), events.New(events.PhotoUploaded, "alice", events.Data{PhotoID: "p1"}))
+	if db.saved() != 0 {
+		t.Fatal("Publish recorded the delivery itself")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+	for deadline := time.Now().Add(time.Second); db.saved() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Run did not record the queued event")
+		}
+	}
+}